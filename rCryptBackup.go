@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BACKUPVERSION is the version of the backup format written by rcrypt backup
+const BACKUPVERSION = 1
+
+// Backup is everything needed to carry on with an account on another
+// machine: the profile and the local state kept alongside it
+type Backup struct {
+	Version  int         `json:"version"`
+	Profile  string      `json:"profile"`
+	Created  int64       `json:"created"`
+	Config   CoreConf    `json:"config"`
+	Index    CryptIndex  `json:"index"`
+	Contacts ContactBook `json:"contacts"`
+}
+
+// BackupResult describes a backup written or restored in JSON output
+type BackupResult struct {
+	Path        string `json:"path"`
+	Profile     string `json:"profile"`
+	UserID      uint64 `json:"user_id"`
+	Fingerprint string `json:"fingerprint"`
+	Crypts      int    `json:"crypts"`
+	Contacts    int    `json:"contacts"`
+}
+
+// newBackupResult summarises backup, kept at path
+func newBackupResult(backup Backup, path string) BackupResult {
+	return BackupResult{
+		Path:        path,
+		Profile:     backup.Profile,
+		UserID:      backup.Config.UserID,
+		Fingerprint: backup.Config.Fingerprint,
+		Crypts:      len(backup.Index.Crypts),
+		Contacts:    len(backup.Contacts.Contacts),
+	}
+}
+
+// validateBackup checks a decrypted backup holds a usable account before it
+// replaces anything
+func validateBackup(backup Backup) error {
+	conf := backup.Config
+	if backup.Version != BACKUPVERSION {
+		return errors.New("unsupported backup version " + strconv.Itoa(backup.Version))
+	}
+	if conf.UserID == 0 || conf.PublicKey == "" {
+		return errors.New("the backup does not hold a registered account")
+	}
+
+	fingerprint, err := ripacrypt.VerifyGPGPublicKey(conf.PublicKey)
+	if err != nil {
+		return fmt.Errorf("the public key is invalid: %v", err)
+	}
+	if strings.EqualFold(fingerprint, conf.Fingerprint) == false {
+		return errors.New("the fingerprint " + conf.Fingerprint + " does not match the public key " + fingerprint)
+	}
+
+	// A protected key can't be looked into without its passphrase
+	if conf.PrivateKey != "" && ripacrypt.IsPrivateKeyProtected(conf.PrivateKey) == false {
+		entityList, err := ripacrypt.ReadKeyRing(conf.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("the private key is invalid: %v", err)
+		}
+		if entityList[0].PrivateKey == nil || ripacrypt.KeyFingerprint(entityList[0].PrimaryKey) != fingerprint {
+			return ripacrypt.ErrKeyMismatch
+		}
+	}
+
+	if conf.KeyBackend != "" && conf.KeyBackend != KEYBACKENDGPG {
+		return errors.New("unknown key_backend " + conf.KeyBackend)
+	}
+	_, err = packetConfig(conf.KeyType, conf.Cipher, conf.Compression)
+	return err
+}
+
+// runBackupCommand handles `rcrypt backup`, writing the active profile, its
+// crypt index and contacts to outPath as a passphrase encrypted OpenPGP
+// message
+func runBackupCommand(conf CoreConf, outPath string, force bool) {
+	if outPath == "" {
+		fail(ERRUSAGE, "usage: rcrypt backup -out=FILE [-force]", nil)
+		return
+	}
+	if conf.UserID == 0 {
+		fail(ERRCONFIG, "Profile "+activeProfile.Value+" is not registered, there is nothing to back up", nil)
+		return
+	}
+	if _, err := os.Lstat(outPath); err == nil && force == false {
+		fail(ERRLOCAL, outPath+" already exists, use -force to overwrite it", nil)
+		return
+	}
+
+	index, err := readIndex()
+	if err != nil {
+		fail(ERRLOCAL, "There was an error reading your crypt index", err)
+		return
+	}
+	book, err := readContacts()
+	if err != nil {
+		fail(ERRLOCAL, "There was an error reading your contacts", err)
+		return
+	}
+
+	backup := Backup{
+		Version:  BACKUPVERSION,
+		Profile:  activeProfile.Value,
+		Created:  time.Now().Unix(),
+		Config:   conf,
+		Index:    index,
+		Contacts: book,
+	}
+	plaintext, err := json.Marshal(backup)
+	if err != nil {
+		fail(ERRLOCAL, "There was an error preparing your backup", err)
+		return
+	}
+
+	passphrase, err := promptBackupPassphrase(true)
+	if err != nil {
+		fail(ERRCRYPTO, "There was an error reading the passphrase for your backup", err)
+		return
+	}
+	message, err := ripacrypt.SymmetricallyEncrypt(plaintext, passphrase)
+	if err != nil {
+		fail(ERRCRYPTO, "There was an error encrypting your backup", err)
+		return
+	}
+
+	if err = writeFileAtomic(outPath, []byte(message)); err != nil {
+		fail(ERRLOCAL, "There was an error writing your backup", err)
+		return
+	}
+
+	fmt.Println("Backed up user " + strconv.FormatUint(conf.UserID, 10) + " with " + strconv.Itoa(len(index.Crypts)) + " crypts and " + strconv.Itoa(len(book.Contacts)) + " contacts to " + outPath)
+	if conf.KeyBackend == KEYBACKENDGPG {
+		fmt.Println("Your secret key is kept by gpg and is not in the backup, save it with: gpg --export-secret-keys " + conf.GPGKey)
+	}
+	succeed(newBackupResult(backup, outPath), 0)
+}
+
+// runRestoreCommand handles `rcrypt restore`, installing a backup written by
+// runBackupCommand as the active profile. A registered profile is only
+// replaced if force is set.
+func runRestoreCommand(conf CoreConf, inPath string, force bool) {
+	if inPath == "" {
+		fail(ERRUSAGE, "usage: rcrypt restore -in=FILE [-force]", nil)
+		return
+	}
+	if conf.UserID != 0 && force == false {
+		fail(ERRCONFIG, "Profile "+activeProfile.Value+" is already registered as user "+strconv.FormatUint(conf.UserID, 10)+", use -force to replace it or choose another with -profile", nil)
+		return
+	}
+
+	message, err := ioutil.ReadFile(inPath)
+	if err != nil {
+		fail(ERRLOCAL, "There was an error reading your backup", err)
+		return
+	}
+
+	passphrase, err := promptBackupPassphrase(false)
+	if err != nil {
+		fail(ERRCRYPTO, "There was an error reading the passphrase for your backup", err)
+		return
+	}
+	plaintext, err := ripacrypt.SymmetricallyDecrypt(string(message), passphrase)
+	if err != nil {
+		fail(ERRCRYPTO, "There was an error decrypting your backup", err)
+		return
+	}
+
+	var backup Backup
+	if err = json.Unmarshal(plaintext, &backup); err != nil {
+		fail(ERRCONFIG, "There was an error reading your backup", err)
+		return
+	}
+	if err = validateBackup(backup); err != nil {
+		fail(ERRCONFIG, "Your backup is not usable", err)
+		return
+	}
+
+	// The config goes last as it is what makes the profile usable
+	if err = writeIndex(backup.Index); err != nil {
+		fail(ERRLOCAL, "There was an error writing your crypt index", err)
+		return
+	}
+	if err = writeContacts(backup.Contacts); err != nil {
+		fail(ERRLOCAL, "There was an error writing your contacts", err)
+		return
+	}
+	if err = writeConfig(backup.Config); err != nil {
+		fail(ERRLOCAL, "There was an error attempting to write your config file to disk", err)
+		return
+	}
+
+	fmt.Println("Restored user " + strconv.FormatUint(backup.Config.UserID, 10) + " (" + backup.Config.Fingerprint + ") with " + strconv.Itoa(len(backup.Index.Crypts)) + " crypts and " + strconv.Itoa(len(backup.Contacts.Contacts)) + " contacts into profile " + activeProfile.Value)
+	if backup.Config.KeyBackend == KEYBACKENDGPG {
+		fmt.Println("Your secret key is kept by gpg, import it with: gpg --import")
+	}
+	result := newBackupResult(backup, inPath)
+	result.Profile = activeProfile.Value
+	succeed(result, 0)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// CONFIGENV names the environment variable which overrides the location of
+// rc.conf
+const CONFIGENV = "RIPACRYPT_CONFIG"
+
+// configPath is the location of rc.conf, our other local state lives next to
+// it. main resolves it before any command runs.
+var configPath = setting{"", "default"}
+
+// resolveConfigPath picks the -config flag, then RIPACRYPT_CONFIG, then an
+// existing ~/.ripacrypt, then $XDG_CONFIG_HOME/ripacrypt and finally
+// ~/.ripacrypt for a fresh install
+func resolveConfigPath(flagValue string) setting {
+	if path := resolveSetting("config", flagValue, CONFIGENV, "", ""); path.Value != "" {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+
+	// Don't strand anyone who set XDG_CONFIG_HOME after registering
+	legacyDir := filepath.Join(home, ".ripacrypt")
+	if _, err = os.Stat(legacyDir); err == nil {
+		return setting{filepath.Join(legacyDir, "rc.conf"), "default"}
+	}
+
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return setting{filepath.Join(xdg, "ripacrypt", "rc.conf"), "environment XDG_CONFIG_HOME"}
+	}
+	return setting{filepath.Join(legacyDir, "rc.conf"), "default"}
+}
+
+// checkConfigPermissions refuses a config file (which holds the private key)
+// that other users can read or write
+func checkConfigPermissions(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is accessible by other users (mode %04o), fix it with: chmod 600 %s", path, info.Mode().Perm(), path)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data readable only by us. The data is
+// written to a temporary file which is renamed over path, so a crash mid
+// write never leaves a truncated file behind.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	// Once renamed this is a no-op
+	defer os.Remove(tmp.Name())
+
+	if err = tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Contact is someone else's public key, which crypts can be encrypted to and
+// whose signatures get trusts
+type Contact struct {
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint"`
+	PublicKey   string `json:"public_key"`
+	Added       int64  `json:"added"`
+}
+
+// ContactBook is the local contacts keyring, each profile has its own
+type ContactBook struct {
+	Contacts []Contact `json:"contacts"`
+}
+
+// ContactResult describes a contact in JSON output
+type ContactResult struct {
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint"`
+	Added       int64  `json:"added,omitempty"`
+}
+
+// stringList collects every use of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Find returns the contact with the given name or fingerprint, or nil
+func (book *ContactBook) Find(nameOrFingerprint string) *Contact {
+	for i := range book.Contacts {
+		if book.Contacts[i].Name == nameOrFingerprint || strings.EqualFold(book.Contacts[i].Fingerprint, nameOrFingerprint) {
+			return &book.Contacts[i]
+		}
+	}
+	return nil
+}
+
+// PublicKeys returns the armoured public key of every contact
+func (book *ContactBook) PublicKeys() []string {
+	keys := make([]string, 0, len(book.Contacts))
+	for _, contact := range book.Contacts {
+		keys = append(keys, contact.PublicKey)
+	}
+	return keys
+}
+
+// contactsPath returns the location of the contacts keyring
+func contactsPath() string {
+	return profileFile("contacts", ".json")
+}
+
+// readContacts loads the contacts keyring, a missing keyring is simply empty
+func readContacts() (ContactBook, error) {
+	var book ContactBook
+
+	b, err := ioutil.ReadFile(contactsPath())
+	if os.IsNotExist(err) {
+		return book, nil
+	}
+	if err != nil {
+		return book, err
+	}
+
+	err = json.Unmarshal(b, &book)
+	return book, err
+}
+
+// writeContacts saves the contacts keyring next to rc.conf
+func writeContacts(book ContactBook) error {
+	bookBuffer, jsonMarshalErr := json.MarshalIndent(book, "", "  ")
+	if jsonMarshalErr != nil {
+		return jsonMarshalErr
+	}
+
+	return writeFileAtomic(contactsPath(), bookBuffer)
+}
+
+// readPublicKeyFile loads a single armoured or binary key from path, keeping
+// only its public half. The name is taken from its first user ID.
+func readPublicKeyFile(path string) (Contact, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Contact{}, err
+	}
+
+	entityList, err := ripacrypt.ReadKeyRing(string(b))
+	if err != nil {
+		return Contact{}, err
+	}
+	if len(entityList) != 1 {
+		return Contact{}, fmt.Errorf("%s holds %d keys, expected exactly one", path, len(entityList))
+	}
+
+	publicKey, err := ripacrypt.ArmorPublicKey(entityList[0])
+	if err != nil {
+		return Contact{}, err
+	}
+
+	contact := Contact{
+		Fingerprint: ripacrypt.KeyFingerprint(entityList[0].PrimaryKey),
+		PublicKey:   publicKey,
+		Added:       time.Now().Unix(),
+	}
+	for name := range entityList[0].Identities {
+		contact.Name = name
+		break
+	}
+	return contact, nil
+}
+
+// resolveRecipients turns each -recipient (a key file, or the name or
+// fingerprint of a contact) into a contact
+func resolveRecipients(recipients []string) ([]Contact, error) {
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+
+	book, err := readContacts()
+	if err != nil {
+		return nil, err
+	}
+
+	contacts := make([]Contact, 0, len(recipients))
+	for _, recipient := range recipients {
+		if _, statErr := os.Stat(recipient); statErr == nil {
+			contact, err := readPublicKeyFile(recipient)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", recipient, err)
+			}
+			contacts = append(contacts, contact)
+			continue
+		}
+
+		contact := book.Find(recipient)
+		if contact == nil {
+			return nil, errors.New(recipient + " is neither a key file nor one of your contacts")
+		}
+		contacts = append(contacts, *contact)
+	}
+	return contacts, nil
+}
+
+// describeSigner names the key which signed something we retrieved
+func describeSigner(signer, ownFingerprint string) string {
+	if strings.EqualFold(signer, ownFingerprint) {
+		return "your key " + signer
+	}
+
+	book, _ := readContacts()
+	if contact := book.Find(signer); contact != nil {
+		return "contact " + contact.Name + " (" + signer + ")"
+	}
+	return signer
+}
+
+// runContactCommand handles `rcrypt contact list|add|remove`
+func runContactCommand(args []string) {
+	usage := "usage: rcrypt contact list | add [-name=NAME] KEYFILE | remove NAME|FINGERPRINT"
+	if len(args) == 0 {
+		fail(ERRUSAGE, usage, nil)
+		return
+	}
+
+	contactFlags := flag.NewFlagSet("contact "+args[0], flag.ContinueOnError)
+	name := contactFlags.String("name", "", "Name to know the contact by (defaults to the user ID of the key)")
+	if err := contactFlags.Parse(args[1:]); err != nil {
+		fail(ERRUSAGE, usage, err)
+		return
+	}
+	if (args[0] == "list") != (contactFlags.NArg() == 0) || contactFlags.NArg() > 1 {
+		fail(ERRUSAGE, usage, nil)
+		return
+	}
+
+	book, err := readContacts()
+	if err != nil {
+		fail(ERRLOCAL, "There was an error reading your contacts", err)
+		return
+	}
+
+	switch args[0] {
+	case "list":
+		results := []ContactResult{}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tFINGERPRINT\tADDED")
+		for _, contact := range book.Contacts {
+			results = append(results, ContactResult{contact.Name, contact.Fingerprint, contact.Added})
+			fmt.Fprintf(w, "%s\t%s\t%s\n", contact.Name, contact.Fingerprint, time.Unix(contact.Added, 0).Format("2006-01-02"))
+		}
+		w.Flush()
+
+		if len(book.Contacts) == 0 {
+			fmt.Println("You have no contacts, add one with: rcrypt contact add KEYFILE")
+		}
+		succeed(results, 0)
+
+	case "add":
+		contact, err := readPublicKeyFile(contactFlags.Arg(0))
+		if err != nil {
+			fail(ERRUSAGE, "There was an error reading that public key", err)
+			return
+		}
+		if *name != "" {
+			contact.Name = *name
+		}
+		if contact.Name == "" {
+			fail(ERRUSAGE, "The key has no user ID, name the contact with -name", nil)
+			return
+		}
+		if book.Find(contact.Fingerprint) != nil || book.Find(contact.Name) != nil {
+			fail(ERRUSAGE, "You already have a contact named "+contact.Name+" or with key "+contact.Fingerprint, nil)
+			return
+		}
+
+		book.Contacts = append(book.Contacts, contact)
+		if err = writeContacts(book); err != nil {
+			fail(ERRLOCAL, "There was an error writing your contacts", err)
+			return
+		}
+
+		fmt.Println("Added contact " + contact.Name + " with key " + contact.Fingerprint)
+		succeed(ContactResult{contact.Name, contact.Fingerprint, contact.Added}, 0)
+
+	case "remove":
+		contact := book.Find(contactFlags.Arg(0))
+		if contact == nil {
+			fail(ERRNOTFOUND, "You have no contact "+contactFlags.Arg(0), nil)
+			return
+		}
+		removed := *contact
+
+		contacts := book.Contacts[:0]
+		for _, c := range book.Contacts {
+			if c.Fingerprint != removed.Fingerprint {
+				contacts = append(contacts, c)
+			}
+		}
+		book.Contacts = contacts
+
+		if err = writeContacts(book); err != nil {
+			fail(ERRLOCAL, "There was an error writing your contacts", err)
+			return
+		}
+
+		fmt.Println("Removed contact " + removed.Name)
+		succeed(ContactResult{Name: removed.Name, Fingerprint: removed.Fingerprint}, 0)
+
+	default:
+		fail(ERRUSAGE, usage, nil)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// daemonMinBackoff is how long we wait before retrying a failed checkin
+	daemonMinBackoff = 30 * time.Second
+
+	// daemonMaxBackoff caps the exponential backoff between retries
+	daemonMaxBackoff = 15 * time.Minute
+)
+
+// daemonCrypt tracks when a crypt is next due a checkin and how many
+// consecutive attempts have failed
+type daemonCrypt struct {
+	next      time.Time
+	failures  uint
+	synced    bool
+	destroyed bool
+}
+
+// readCryptList reads one crypt ID per line from path, ignoring blank lines
+// and lines starting with #
+func readCryptList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cryptIDs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cryptIDs = append(cryptIDs, line)
+	}
+
+	return cryptIDs, scanner.Err()
+}
+
+// nextCheckin picks a time between half and three quarters of the way through
+// the crypts checkin duration. Checking in that early means a single missed
+// attempt never costs us a MissCount and the jitter stops our checkins from
+// forming an easily fingerprinted pattern.
+func nextCheckin(crypt ripacrypt.Crypt) time.Time {
+	duration := time.Duration(crypt.CheckInDuration) * time.Second
+	jitter := time.Duration(rand.Int63n(int64(duration/4) + 1))
+
+	return crypt.LastAlive().Add(duration/2 + jitter)
+}
+
+// backoff returns how long to wait after the given number of consecutive
+// failures
+func backoff(failures uint) time.Duration {
+	wait := daemonMinBackoff
+	for i := uint(1); i < failures && wait < daemonMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > daemonMaxBackoff {
+		wait = daemonMaxBackoff
+	}
+
+	// Spread retries out so they don't all land at once
+	return wait + time.Duration(rand.Int63n(int64(wait/4)+1))
+}
+
+// reloadProfile re-reads the active profile from the config file for a
+// daemon sent a SIGHUP, so it picks up e.g. the new key from rcrypt key
+// rotate. useTor is kept from when the daemon started.
+func reloadProfile(useTor bool) (*ripacrypt.Client, error) {
+	configFile, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	conf, ok := configFile.Profiles[activeProfile.Value]
+	if ok == false || conf.UserID == 0 {
+		return nil, errors.New("profile " + activeProfile.Value + " is no longer registered")
+	}
+	if useTor == true {
+		conf.UseTor = true
+	}
+	return newClient(conf), nil
+}
+
+// runDaemon keeps every crypt listed in listPath alive until we receive a
+// SIGTERM or SIGINT. A SIGHUP calls reload for a client with the current
+// profile, then re-reads listPath. With panicWipe the profile is wiped, as by
+// rcrypt panic, as soon as a watched crypt has been destroyed.
+func runDaemon(client *ripacrypt.Client, reload func() (*ripacrypt.Client, error), listPath string, debug bool, panicWipe bool, panicDestroy bool) {
+	schedule := make(map[string]*daemonCrypt)
+
+	load := func() {
+		cryptIDs, err := readCryptList(listPath)
+		if err != nil {
+			log.Println("Cannot read crypt list", listPath, err)
+			return
+		}
+
+		// A chunked payload is lost if any of its chunks are
+		for _, cryptID := range cryptIDs {
+			cryptIDs = append(cryptIDs, indexedChunks(cryptID)...)
+		}
+
+		listed := make(map[string]bool)
+		for _, cryptID := range cryptIDs {
+			listed[cryptID] = true
+			if _, ok := schedule[cryptID]; !ok {
+				log.Println("Watching crypt", cryptID)
+				schedule[cryptID] = &daemonCrypt{next: time.Now()}
+			}
+		}
+
+		for cryptID := range schedule {
+			if listed[cryptID] == false {
+				log.Println("No longer watching crypt", cryptID)
+				delete(schedule, cryptID)
+			}
+		}
+	}
+
+	load()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+
+	for {
+		wait := time.Hour
+		for _, state := range schedule {
+			if until := time.Until(state.next); until < wait {
+				wait = until
+			}
+		}
+		if wait < 0 {
+			wait = 0
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case sig := <-signals:
+			timer.Stop()
+			if sig == syscall.SIGHUP {
+				log.Println("Received SIGHUP, reloading profile", activeProfile.Value, "and", listPath)
+				reloaded, err := reload()
+				if err != nil {
+					log.Println("Cannot reload profile", activeProfile.Value, err, "- carrying on with the old one")
+				} else {
+					client = reloaded
+				}
+				load()
+
+				// Whatever made a checkin fail may have just been fixed
+				for _, state := range schedule {
+					if state.failures > 0 {
+						state.next = time.Now()
+					}
+				}
+				continue
+			}
+			log.Println("Received", sig, "shutting down")
+			return
+
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		for cryptID, state := range schedule {
+			if state.next.After(now) {
+				continue
+			}
+
+			if daemonCheckin(client, cryptID, state, debug) == false {
+				delete(schedule, cryptID)
+
+				if panicWipe == true && state.destroyed == true {
+					log.Println("Crypt", cryptID, "has been destroyed, wiping profile", activeProfile.Value)
+					daemonPanic(client, listPath, panicDestroy)
+					return
+				}
+			}
+		}
+	}
+}
+
+// daemonCheckin checks in with a crypt that has fallen due (or simply fetches
+// it if we don't yet know its schedule) and works out when it is next due. It
+// returns false if the crypt no longer needs watching.
+func daemonCheckin(client *ripacrypt.Client, cryptID string, state *daemonCrypt, debug bool) bool {
+	checkedIn := false
+
+	if state.synced == true {
+		log.Println("Checking in with crypt", cryptID, "attempt", state.failures+1)
+
+		// A destroyed crypt is confirmed by fetching it below
+		apiResponse, checkinErr := client.Checkin(cryptID)
+		if checkinErr != nil && ripacrypt.KindOf(checkinErr) != ripacrypt.KindDestroyed {
+			// Have gpg-agent ask again rather than hand back the same one
+			if errors.Is(checkinErr, ripacrypt.ErrBadPassphrase) {
+				forgetAgentPassphrase()
+			}
+			state.failures++
+			state.next = time.Now().Add(backoff(state.failures))
+			log.Println("Checkin with crypt", cryptID, "failed:", checkinErr, "- retrying at", state.next.Format(time.RFC3339))
+			return true
+		}
+
+		if checkinErr == nil {
+			log.Println("Checked in with crypt", cryptID, apiResponse.Message)
+			checkedIn = true
+			recordCheckin(cryptID, time.Now())
+		}
+	}
+
+	apiResponse, getErr := client.GetCrypt(cryptID)
+	if ripacrypt.KindOf(getErr) == ripacrypt.KindDestroyed || apiResponse.CryptPayload.IsDestroyed == true {
+		log.Println("Crypt", cryptID, "has been destroyed, no longer watching it")
+		recordDestroyed(cryptID)
+		state.destroyed = true
+		return false
+	}
+
+	if getErr == nil && apiResponse.CryptPayload.CheckInDuration <= 0 {
+		getErr = errors.New("the server did not return a checkin duration: " + apiResponse.Message)
+	}
+	if getErr != nil {
+		if errors.Is(getErr, ripacrypt.ErrBadPassphrase) {
+			forgetAgentPassphrase()
+		}
+		state.failures++
+		state.next = time.Now().Add(backoff(state.failures))
+		log.Println("Fetching crypt", cryptID, "failed:", getErr, "- retrying at", state.next.Format(time.RFC3339))
+		return true
+	}
+
+	state.failures = 0
+	state.synced = true
+	state.next = nextCheckin(apiResponse.CryptPayload)
+
+	// Don't hammer the server if its idea of our last checkin lags behind
+	if checkedIn == true && state.next.Before(time.Now()) {
+		state.next = time.Now().Add(time.Duration(apiResponse.CryptPayload.CheckInDuration) * time.Second / 2)
+	}
+
+	if debug == true {
+		log.Println("Crypt", cryptID, "deadline is", apiResponse.CryptPayload.Deadline().Format(time.RFC3339))
+	}
+	log.Println("Next checkin with crypt", cryptID, "at", state.next.Format(time.RFC3339))
+
+	return true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// APIURLENV names the environment variable which overrides the API endpoint
+	APIURLENV = "RIPACRYPT_URL"
+
+	// ONIONURLENV names the environment variable which overrides the Tor
+	// hidden service endpoint
+	ONIONURLENV = "RIPACRYPT_ONION_URL"
+
+	// SOCKSENV names the environment variable which overrides the SOCKS5
+	// proxy used with -usetor
+	SOCKSENV = "RIPACRYPT_SOCKS"
+)
+
+// setting is an effective configuration value along with where it came from
+type setting struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// Endpoints describes where API requests are sent
+type Endpoints struct {
+	APIURL   setting `json:"api_url"`
+	OnionURL setting `json:"onion_url"`
+	SOCKS    setting `json:"socks_addr"`
+}
+
+// effectiveEndpoints is resolved by main before any command runs
+var effectiveEndpoints = Endpoints{
+	APIURL:   setting{ripacrypt.RIPACRYPTURL, "default"},
+	OnionURL: setting{ripacrypt.HSURL, "default"},
+	SOCKS:    setting{ripacrypt.TORSOCKS, "default"},
+}
+
+// resolveSetting picks the first of a command line flag, an environment
+// variable or the config file that is set, falling back to defaultValue
+func resolveSetting(flagName, flagValue, envName, confValue, defaultValue string) setting {
+	if flagValue != "" {
+		return setting{flagValue, "flag -" + flagName}
+	}
+	if envValue := os.Getenv(envName); envValue != "" {
+		return setting{envValue, "environment " + envName}
+	}
+	if confValue != "" {
+		return setting{confValue, "config file"}
+	}
+	return setting{defaultValue, "default"}
+}
+
+// resolveEndpoints works out and validates the effective API endpoints
+func resolveEndpoints(conf CoreConf, apiURLFlag, onionURLFlag, socksFlag string) (Endpoints, error) {
+	endpoints := Endpoints{
+		APIURL:   resolveSetting("url", apiURLFlag, APIURLENV, conf.APIURL, ripacrypt.RIPACRYPTURL),
+		OnionURL: resolveSetting("onionurl", onionURLFlag, ONIONURLENV, conf.OnionURL, ripacrypt.HSURL),
+		SOCKS:    resolveSetting("socks", socksFlag, SOCKSENV, conf.SOCKSAddr, ripacrypt.TORSOCKS),
+	}
+
+	var err error
+	if endpoints.APIURL.Value, err = validateAPIURL(endpoints.APIURL.Value); err != nil {
+		return endpoints, fmt.Errorf("invalid API URL from %s: %v", endpoints.APIURL.Source, err)
+	}
+	if endpoints.OnionURL.Value, err = validateAPIURL(endpoints.OnionURL.Value); err != nil {
+		return endpoints, fmt.Errorf("invalid onion URL from %s: %v", endpoints.OnionURL.Source, err)
+	}
+	if err = validateSOCKSAddr(endpoints.SOCKS.Value); err != nil {
+		return endpoints, fmt.Errorf("invalid SOCKS address from %s: %v", endpoints.SOCKS.Source, err)
+	}
+
+	return endpoints, nil
+}
+
+// validateAPIURL checks rawURL is an absolute http(s) URL and returns it with
+// the trailing slash the client expects
+func validateAPIURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return "", errors.New("no host given")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.New("query strings and fragments are not allowed")
+	}
+
+	if strings.HasSuffix(rawURL, "/") == false {
+		rawURL += "/"
+	}
+	return rawURL, nil
+}
+
+// validateSOCKSAddr checks addr is a host:port pair
+func validateSOCKSAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New("no host given")
+	}
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 1 || portNumber > 65535 {
+		return errors.New("port must be between 1 and 65535")
+	}
+	return nil
+}
+
+// resolveUseTor works out whether Tor is used, a commands -usetor flag
+// forcing it on for that run whatever the config file says
+func resolveUseTor(flagValue bool, conf CoreConf) setting {
+	if flagValue == true {
+		return setting{"true", "flag -usetor"}
+	}
+	if conf.UseTor == true {
+		return setting{"true", "config file"}
+	}
+	return setting{"false", "default"}
+}
+
+// printEndpoints shows the effective endpoints and Tor setting and where each
+// came from
+func printEndpoints(endpoints Endpoints, useTor setting) {
+	fmt.Printf("api_url\t\t%s\t(%s)\n", endpoints.APIURL.Value, endpoints.APIURL.Source)
+	fmt.Printf("onion_url\t%s\t(%s)\n", endpoints.OnionURL.Value, endpoints.OnionURL.Source)
+	fmt.Printf("socks_addr\t%s\t(%s)\n", endpoints.SOCKS.Value, endpoints.SOCKS.Source)
+	fmt.Printf("usetor\t\t%s\t(%s)\n", useTor.Value, useTor.Source)
+}
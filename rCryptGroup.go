@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt/shamir"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shareMagic starts the plaintext of every crypt holding a share, the server
+// only ever sees it encrypted
+const shareMagic = "ripacrypt-share-v1"
+
+// share is one decoded piece of a split secret. The SHA256 of the secret is
+// appended to it before splitting, so we can tell when recombining produced
+// garbage without a share telling its holder anything about the secret.
+type share struct {
+	GroupID   string
+	Threshold int
+	Data      []byte
+}
+
+// GroupResult describes a share group in JSON output
+type GroupResult struct {
+	GroupID   string        `json:"group_id"`
+	Threshold int           `json:"threshold"`
+	Shares    []CryptResult `json:"shares,omitempty"`
+	Retrieved int           `json:"shares_retrieved,omitempty"`
+	Plaintext string        `json:"plaintext,omitempty"`
+	Signer    string        `json:"signer,omitempty"`
+}
+
+// encodeShare turns a share into the text stored in its crypt
+func encodeShare(s share) string {
+	return strings.Join([]string{
+		shareMagic,
+		s.GroupID,
+		strconv.Itoa(s.Threshold),
+		base64.StdEncoding.EncodeToString(s.Data),
+	}, " ")
+}
+
+// decodeShare reverses encodeShare
+func decodeShare(text string) (share, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 4 || fields[0] != shareMagic {
+		return share{}, errors.New("the crypt does not hold a share")
+	}
+
+	threshold, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return share{}, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return share{}, err
+	}
+
+	return share{GroupID: fields[1], Threshold: threshold, Data: data}, nil
+}
+
+// checkRecovered verifies recombined shares against the checksum appended to
+// the secret and returns the secret
+func checkRecovered(recovered []byte) ([]byte, error) {
+	if len(recovered) < sha256.Size {
+		return nil, errors.New("the recovered data is too short to hold its checksum")
+	}
+	secret := recovered[:len(recovered)-sha256.Size]
+	sum := sha256.Sum256(secret)
+	if bytes.Equal(sum[:], recovered[len(secret):]) == false {
+		return nil, errors.New("the recovered data does not match its checksum")
+	}
+	return secret, nil
+}
+
+// parseShareSettings expands a comma separated list of per share values,
+// falling back to fallback for every share if the list is empty
+func parseShareSettings(name, list string, fallback int64, shares int) ([]int64, error) {
+	values := make([]int64, shares)
+	if list == "" {
+		for i := range values {
+			values[i] = fallback
+		}
+		return values, nil
+	}
+
+	items := strings.Split(list, ",")
+	if len(items) != shares {
+		return nil, fmt.Errorf("-%s needs one value per share, %d given for %d shares", name, len(items), shares)
+	}
+	for i, item := range items {
+		value, err := strconv.ParseInt(strings.TrimSpace(item), 10, 64)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("-%s value %q is not a positive number", name, item)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// newGroupID returns a random ID for a share group
+func newGroupID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newShareGroup splits secret into shares, stores each in its own crypt and
+// records the group in the local index. Every share is also encrypted to the
+// client's Recipients, which are given.
+func newShareGroup(client *ripacrypt.Client, secret string, threshold int, description string, durations, missCounts []int64, recipients []Contact) {
+	groupID, err := newGroupID()
+	if err != nil {
+		fail(ERRLOCAL, "There was an error generating a share group ID", err)
+		return
+	}
+
+	if secret == "" {
+		fail(ERRUSAGE, "There was an error splitting your data into shares", errors.New("cannot split an empty secret"))
+		return
+	}
+
+	// The checksum is split along with the secret, only whoever holds
+	// enough shares to recover one sees the other
+	checksum := sha256.Sum256([]byte(secret))
+	parts, err := shamir.Split(append([]byte(secret), checksum[:]...), len(durations), threshold)
+	if err != nil {
+		fail(ERRUSAGE, "There was an error splitting your data into shares", err)
+		return
+	}
+
+	group := ShareGroup{
+		GroupID:     groupID,
+		Description: description,
+		Threshold:   threshold,
+		Created:     time.Now().Unix(),
+	}
+	result := GroupResult{GroupID: groupID, Threshold: threshold}
+
+	fmt.Println("Your share group ID is: ", groupID)
+
+	for i, part := range parts {
+		shareDescription := fmt.Sprintf("%s (share %d of %d)", description, i+1, len(parts))
+		text := encodeShare(share{
+			GroupID:   groupID,
+			Threshold: threshold,
+			Data:      part,
+		})
+
+		// Shares are always encrypted, the server holds all of them
+		apiResponse, newErr := client.NewCrypt(text, strings.TrimSpace(shareDescription), durations[i], missCounts[i], false)
+		if newErr != nil {
+			// Keep whatever we managed to create, enough shares may
+			// still have been stored to recover the secret
+			if len(group.Shares) > 0 {
+				recordGroup(group)
+			}
+			failAPI(fmt.Sprintf("There was an issue creating crypt for share %d, only %d of %d shares were stored", i+1, len(group.Shares), len(parts)), newErr)
+			return
+		}
+
+		crypt := apiResponse.CryptPayload
+		if crypt.Description == "" {
+			crypt.Description = strings.TrimSpace(shareDescription)
+		}
+		if crypt.CheckInDuration == 0 {
+			crypt.CheckInDuration = durations[i]
+		}
+		if crypt.MissCount == 0 {
+			crypt.MissCount = missCounts[i]
+		}
+		if crypt.CreateTimeStamp == 0 {
+			crypt.CreateTimeStamp = time.Now().Unix()
+		}
+		recordCrypt(crypt)
+		if len(recipients) > 0 {
+			recordRecipients(crypt.CryptID, recipients)
+		}
+
+		group.Shares = append(group.Shares, crypt.CryptID)
+		result.Shares = append(result.Shares, newCryptResult(crypt))
+		fmt.Printf("Share %d of %d CryptID is:  %s\n", i+1, len(parts), crypt.CryptID)
+	}
+
+	recordGroup(group)
+	fmt.Printf("Any %d of the %d shares will recover your data with: rcrypt get -group=%s\n", threshold, len(parts), groupID)
+	succeed(result, 0)
+}
+
+// getShareGroup fetches the shares of a group until it has enough to recover
+// the secret, which goes to sink if there is one
+func getShareGroup(client *ripacrypt.Client, groupID string, sink *secretSink) {
+	index, err := readIndex()
+	if err != nil {
+		fail(ERRLOCAL, "There was an error reading your local crypt index", err)
+		return
+	}
+
+	group := index.FindGroup(groupID)
+	if group == nil {
+		fail(ERRNOTFOUND, "Share group "+groupID+" is not in your local crypt index", nil)
+		return
+	}
+
+	// Unlock once rather than asking for the passphrase for every share
+	if client.KeyBackend == nil {
+		if _, err = client.UnlockPrivateKey(); err != nil {
+			fail(ERRCRYPTO, "There was an error unlocking your private key", err)
+			return
+		}
+	}
+
+	var parts [][]byte
+	var signer string
+	var lastErr error
+
+	for i, cryptID := range group.Shares {
+		if len(parts) == group.Threshold {
+			break
+		}
+
+		apiResponse, getErr := client.GetCrypt(cryptID)
+		if getErr != nil {
+			fmt.Println("Share", i+1, "("+cryptID+") could not be retrieved:", getErr)
+			if ripacrypt.KindOf(getErr) == ripacrypt.KindDestroyed {
+				recordDestroyed(cryptID)
+			}
+			lastErr = getErr
+			continue
+		}
+
+		plainText := new(bytes.Buffer)
+		payload, decryptErr := client.DecryptPayload(apiResponse.CryptPayload, plainText)
+		if decryptErr != nil {
+			fmt.Println("Share", i+1, "("+cryptID+") could not be decrypted:", decryptErr)
+			lastErr = decryptErr
+			continue
+		}
+
+		s, decodeErr := decodeShare(plainText.String())
+		if decodeErr == nil && s.GroupID != group.GroupID {
+			decodeErr = errors.New("the share belongs to group " + s.GroupID)
+		}
+		if decodeErr != nil {
+			fmt.Println("Share", i+1, "("+cryptID+") is not usable:", decodeErr)
+			lastErr = &ripacrypt.Error{Kind: ripacrypt.KindCrypto, Err: decodeErr}
+			continue
+		}
+
+		signer = payload.Signer
+		parts = append(parts, s.Data)
+	}
+
+	if len(parts) < group.Threshold {
+		message := fmt.Sprintf("Only %d of the %d shares needed to recover share group %s could be retrieved", len(parts), group.Threshold, group.GroupID)
+		if lastErr != nil {
+			failAPI(message, lastErr)
+		} else {
+			fail(ERRLOCAL, message, nil)
+		}
+		return
+	}
+
+	secret, err := shamir.Combine(parts)
+	if err == nil {
+		secret, err = checkRecovered(secret)
+	}
+	if err != nil {
+		fail(ERRCRYPTO, "There was an error recombining the shares", err)
+		return
+	}
+
+	reportSigner(signer, client.Credentials.Fingerprint)
+	result := GroupResult{
+		GroupID:   group.GroupID,
+		Threshold: group.Threshold,
+		Retrieved: len(parts),
+		Signer:    signer,
+	}
+
+	if sink != nil {
+		_, err = sink.Write(secret)
+		if err == nil {
+			err = sink.Commit()
+		}
+		if err != nil {
+			fail(ERRLOCAL, "There was an error writing the recovered data", err)
+			return
+		}
+		if sink.Path() != "" {
+			fmt.Println("The recovered data was written to " + sink.Path())
+		}
+		succeed(result, 0)
+		return
+	}
+
+	if jsonOutput == false {
+		fmt.Println(string(secret))
+	}
+	result.Plaintext = string(secret)
+	succeed(result, 0)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// IndexEntry describes a crypt this client has created. The server is the
+// authority on a crypts state, this is just so we don't forget about it.
+type IndexEntry struct {
+	CryptID         string `json:"crypt_id"`
+	Description     string `json:"description"`
+	CheckInDuration int64  `json:"check_in_duration"`
+	MissCount       int64  `json:"miss_count"`
+	Created         int64  `json:"created"`
+	LastCheckIn     int64  `json:"last_checkin"`
+	IsDestroyed     bool   `json:"is_destroyed"`
+
+	// GroupID is set if the crypt holds one share of a secret
+	GroupID string `json:"group_id,omitempty"`
+
+	// Chunks lists the crypts holding the data of a chunked payload, they
+	// must be checked in with alongside this one
+	Chunks []string `json:"chunks,omitempty"`
+
+	// Recipients are the fingerprints of the keys, besides our own, which
+	// can decrypt the crypt, and RecipientKeys the armoured keys themselves
+	// so it can be re-encrypted to them even if they aren't contacts
+	Recipients    []string `json:"recipients,omitempty"`
+	RecipientKeys []string `json:"recipient_keys,omitempty"`
+
+	// PreEncrypted is set for crypts stored with -isencrypted, which hold
+	// ciphertext we didn't produce and so can't re-encrypt
+	PreEncrypted bool `json:"pre_encrypted,omitempty"`
+}
+
+// ShareGroup describes a secret split across several crypts, any Threshold of
+// which can recover it
+type ShareGroup struct {
+	GroupID     string   `json:"group_id"`
+	Description string   `json:"description"`
+	Threshold   int      `json:"threshold"`
+	Created     int64    `json:"created"`
+	Shares      []string `json:"shares"`
+}
+
+// CryptIndex is the local record of every crypt we have created
+type CryptIndex struct {
+	Crypts []IndexEntry `json:"crypts"`
+	Groups []ShareGroup `json:"groups,omitempty"`
+
+	// Saved lists the files get -out has written crypt contents to, so
+	// rcrypt panic can shred them along with the index
+	Saved []string `json:"saved,omitempty"`
+}
+
+// Crypt converts the entry to a ripacrypt.Crypt so we can work out deadlines
+// the same way as for crypts fetched from the server
+func (e IndexEntry) Crypt() ripacrypt.Crypt {
+	return ripacrypt.Crypt{
+		CryptID:         e.CryptID,
+		Description:     e.Description,
+		CreateTimeStamp: e.Created,
+		LastCheckIn:     e.LastCheckIn,
+		CheckInDuration: e.CheckInDuration,
+		MissCount:       e.MissCount,
+		IsDestroyed:     e.IsDestroyed,
+	}
+}
+
+// Find returns the entry for cryptID or nil if we don't know about it
+func (index *CryptIndex) Find(cryptID string) *IndexEntry {
+	for i := range index.Crypts {
+		if index.Crypts[i].CryptID == cryptID {
+			return &index.Crypts[i]
+		}
+	}
+	return nil
+}
+
+// FindGroup returns the share group groupID or nil if we don't know about it
+func (index *CryptIndex) FindGroup(groupID string) *ShareGroup {
+	for i := range index.Groups {
+		if index.Groups[i].GroupID == groupID {
+			return &index.Groups[i]
+		}
+	}
+	return nil
+}
+
+// AliveShares counts the shares of group that, as far as we know, have not
+// been destroyed or passed their deadline
+func (index *CryptIndex) AliveShares(group ShareGroup) int {
+	alive := 0
+	for _, cryptID := range group.Shares {
+		entry := index.Find(cryptID)
+		if entry != nil && entry.IsDestroyed == false && time.Now().Before(entry.Crypt().Deadline()) {
+			alive++
+		}
+	}
+	return alive
+}
+
+// indexPath returns the location of the local crypt index, each profile has
+// its own
+func indexPath() string {
+	return profileFile("crypts", ".json")
+}
+
+// readIndex loads the local crypt index, a missing index is simply empty
+func readIndex() (CryptIndex, error) {
+	var index CryptIndex
+
+	b, err := ioutil.ReadFile(indexPath())
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return index, err
+	}
+
+	err = json.Unmarshal(b, &index)
+	return index, err
+}
+
+// writeIndex saves the local crypt index next to rc.conf
+func writeIndex(index CryptIndex) error {
+	indexBuffer, jsonMarshalErr := json.MarshalIndent(index, "", "  ")
+	if jsonMarshalErr != nil {
+		return jsonMarshalErr
+	}
+
+	return writeFileAtomic(indexPath(), indexBuffer)
+}
+
+// updateIndex loads the index, applies update and saves it again. Failing to
+// keep our local records should never fail the command itself so errors are
+// only logged.
+func updateIndex(update func(index *CryptIndex)) {
+	index, err := readIndex()
+	if err != nil {
+		log.Println("Cannot read the local crypt index", indexPath(), err)
+		return
+	}
+
+	update(&index)
+
+	if err = writeIndex(index); err != nil {
+		log.Println("Cannot write the local crypt index", indexPath(), err)
+	}
+}
+
+// recordCrypt adds (or refreshes) a crypt in the local index from the servers
+// view of it
+func recordCrypt(crypt ripacrypt.Crypt) {
+	updateIndex(func(index *CryptIndex) {
+		entry := index.Find(crypt.CryptID)
+		if entry == nil {
+			index.Crypts = append(index.Crypts, IndexEntry{CryptID: crypt.CryptID})
+			entry = &index.Crypts[len(index.Crypts)-1]
+		}
+
+		entry.Description = crypt.Description
+		entry.CheckInDuration = crypt.CheckInDuration
+		entry.MissCount = crypt.MissCount
+		entry.Created = crypt.CreateTimeStamp
+		entry.LastCheckIn = crypt.LastCheckIn
+		entry.IsDestroyed = crypt.IsDestroyed
+	})
+}
+
+// recordGroup adds a share group, and the group membership of its crypts, to
+// the local index. The crypts themselves must already have been recorded.
+func recordGroup(group ShareGroup) {
+	updateIndex(func(index *CryptIndex) {
+		index.Groups = append(index.Groups, group)
+
+		for _, cryptID := range group.Shares {
+			if entry := index.Find(cryptID); entry != nil {
+				entry.GroupID = group.GroupID
+			}
+		}
+	})
+}
+
+// recordChunks notes the chunk crypts behind a crypt we know about
+func recordChunks(cryptID string, chunks []string) {
+	updateIndex(func(index *CryptIndex) {
+		if entry := index.Find(cryptID); entry != nil {
+			entry.Chunks = chunks
+		}
+	})
+}
+
+// recordRecipients notes who else can decrypt a crypt we know about
+func recordRecipients(cryptID string, recipients []Contact) {
+	updateIndex(func(index *CryptIndex) {
+		if entry := index.Find(cryptID); entry != nil {
+			entry.Recipients, entry.RecipientKeys = nil, nil
+			for _, recipient := range recipients {
+				entry.Recipients = append(entry.Recipients, recipient.Fingerprint)
+				entry.RecipientKeys = append(entry.RecipientKeys, recipient.PublicKey)
+			}
+		}
+	})
+}
+
+// recordPreEncrypted notes that a crypt we know about holds the users own
+// ciphertext
+func recordPreEncrypted(cryptID string) {
+	updateIndex(func(index *CryptIndex) {
+		if entry := index.Find(cryptID); entry != nil {
+			entry.PreEncrypted = true
+		}
+	})
+}
+
+// indexedChunks returns the chunk crypts we know are behind cryptID
+func indexedChunks(cryptID string) []string {
+	index, err := readIndex()
+	if err != nil {
+		log.Println("Cannot read the local crypt index", indexPath(), err)
+		return nil
+	}
+
+	if entry := index.Find(cryptID); entry != nil {
+		return entry.Chunks
+	}
+	return nil
+}
+
+// recordCheckin notes a successful checkin with a crypt we know about
+func recordCheckin(cryptID string, when time.Time) {
+	updateIndex(func(index *CryptIndex) {
+		if entry := index.Find(cryptID); entry != nil {
+			entry.LastCheckIn = when.Unix()
+		}
+	})
+}
+
+// recordDestroyed notes that a crypt we know about has been destroyed
+func recordDestroyed(cryptID string) {
+	updateIndex(func(index *CryptIndex) {
+		if entry := index.Find(cryptID); entry != nil {
+			entry.IsDestroyed = true
+		}
+	})
+}
+
+// recordSaved notes a file get -out has written crypt contents to
+func recordSaved(path string) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	updateIndex(func(index *CryptIndex) {
+		for _, saved := range index.Saved {
+			if saved == path {
+				return
+			}
+		}
+		index.Saved = append(index.Saved, path)
+	})
+}
+
+// timeRemaining describes how long a crypt has left before it is destroyed
+func timeRemaining(crypt ripacrypt.Crypt) string {
+	if crypt.IsDestroyed == true {
+		return "destroyed"
+	}
+
+	remaining := time.Until(crypt.Deadline())
+	if remaining <= 0 {
+		return "deadline passed"
+	}
+	return remaining.Truncate(time.Second).String()
+}
+
+// printCryptStatus displays everything we know about a crypt
+func printCryptStatus(crypt ripacrypt.Crypt) {
+	fmt.Println("Crypt ID:\t\t", crypt.CryptID)
+	fmt.Println("Description:\t\t", crypt.Description)
+	fmt.Println("Created:\t\t", time.Unix(crypt.CreateTimeStamp, 0).Format(time.RFC1123))
+	if crypt.LastCheckIn != 0 {
+		fmt.Println("Last checkin:\t\t", time.Unix(crypt.LastCheckIn, 0).Format(time.RFC1123))
+	} else {
+		fmt.Println("Last checkin:\t\t never")
+	}
+	fmt.Println("Checkin duration:\t", time.Duration(crypt.CheckInDuration)*time.Second)
+	fmt.Println("Miss count:\t\t", crypt.MissCount)
+	if crypt.IsDestroyed == false {
+		fmt.Println("Deadline:\t\t", crypt.Deadline().Format(time.RFC1123))
+	}
+	fmt.Println("Time remaining:\t\t", timeRemaining(crypt))
+}
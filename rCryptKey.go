@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// KEYBACKENDGPG is the key_backend which leaves the secret key in GnuPG
+const KEYBACKENDGPG = "gpg"
+
+// keyType is the algorithm, and size or curve, of a key we generate
+type keyType struct {
+	Algorithm packet.PublicKeyAlgorithm
+	RSABits   int
+	Curve     packet.Curve
+}
+
+// keyTypes maps each -keytype register can generate to its algorithm. An
+// ed25519 key signs with its Ed25519 primary key and encrypts to a Curve25519
+// (cv25519) subkey, as GnuPG's default ECC keys do.
+var keyTypes = map[string]keyType{
+	"rsa2048":         {Algorithm: packet.PubKeyAlgoRSA, RSABits: 2048},
+	"rsa3072":         {Algorithm: packet.PubKeyAlgoRSA, RSABits: 3072},
+	"rsa4096":         {Algorithm: packet.PubKeyAlgoRSA, RSABits: 4096},
+	"ed25519":         {Algorithm: packet.PubKeyAlgoEdDSA, Curve: packet.Curve25519},
+	"ed25519/cv25519": {Algorithm: packet.PubKeyAlgoEdDSA, Curve: packet.Curve25519},
+}
+
+// ciphers are the -cipher choices. openpgp.Encrypt never picks AES192, so
+// it can be preferred by a key but not chosen here.
+var ciphers = map[string]packet.CipherFunction{
+	"aes256": packet.CipherAES256,
+	"aes128": packet.CipherAES128,
+}
+
+// compressions are the -compression preferences
+var compressions = map[string]packet.CompressionAlgo{
+	"none": packet.CompressionNone,
+	"zip":  packet.CompressionZIP,
+	"zlib": packet.CompressionZLIB,
+}
+
+// IDENTITYDOMAIN is the domain of the pseudonymous email addresses given to
+// generated keys
+const IDENTITYDOMAIN = "clients.ripacrypt.download"
+
+var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+
+// blindedKeyTime is the creation time given to keys generated with
+// -blindtime. Every such key shares it, so it says nothing about when the
+// key was really made.
+var blindedKeyTime = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// newPseudonymousEmail returns a random email address for a generated key.
+// It is drawn from crypto/rand so it can't be predicted or tied to when the
+// key was made.
+func newPseudonymousEmail() (string, error) {
+	b := make([]rune, 24)
+	max := big.NewInt(int64(len(letterRunes)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = letterRunes[n.Int64()]
+	}
+	return string(b) + "@" + IDENTITYDOMAIN, nil
+}
+
+// blindKeyTime makes keys generated with packetConf carry blindedKeyTime
+// rather than the current time
+func blindKeyTime(packetConf *packet.Config) {
+	packetConf.Time = func() time.Time { return blindedKeyTime }
+}
+
+// isKeyTimeBlinded reports whether entity was generated with -blindtime
+func isKeyTimeBlinded(entity *openpgp.Entity) bool {
+	return entity.PrimaryKey.CreationTime.Equal(blindedKeyTime)
+}
+
+// packetConfig turns the key type, cipher and compression recorded in a
+// profile into the packet.Config used to generate its key and encrypt its
+// payloads. Empty values leave the library defaults alone.
+func packetConfig(keyType, cipher, compression string) (*packet.Config, error) {
+	packetConf := &packet.Config{DefaultHash: crypto.SHA256}
+
+	if keyType != "" {
+		algorithm, ok := keyTypes[keyType]
+		if ok == false {
+			return nil, errors.New("unknown key type " + keyType + ", use rsa2048, rsa3072, rsa4096 or ed25519")
+		}
+		packetConf.Algorithm = algorithm.Algorithm
+		packetConf.RSABits = algorithm.RSABits
+		packetConf.Curve = algorithm.Curve
+	}
+
+	if cipher != "" {
+		cipherFunc, ok := ciphers[cipher]
+		if ok == false {
+			return nil, errors.New("unknown cipher " + cipher + ", use aes256 or aes128")
+		}
+		packetConf.DefaultCipher = cipherFunc
+	}
+
+	if compression != "" {
+		algo, ok := compressions[compression]
+		if ok == false {
+			return nil, errors.New("unknown compression " + compression + ", use none, zip or zlib")
+		}
+		packetConf.DefaultCompressionAlgo = algo
+	}
+	return packetConf, nil
+}
+
+// setKeyPreferences records the cipher and compression of packetConf as the
+// preferences of every identity of entity, so whoever encrypts to it uses
+// them. The identities must be signed again afterwards.
+func setKeyPreferences(entity *openpgp.Entity, packetConf *packet.Config) {
+	preferredSymmetric := []uint8{}
+	if packetConf.DefaultCipher != 0 {
+		preferredSymmetric = append(preferredSymmetric, uint8(packetConf.DefaultCipher))
+	}
+	for _, cipherFunc := range []packet.CipherFunction{packet.CipherAES256, packet.CipherAES192, packet.CipherAES128} {
+		if cipherFunc != packetConf.DefaultCipher {
+			preferredSymmetric = append(preferredSymmetric, uint8(cipherFunc))
+		}
+	}
+
+	preferredCompression := []uint8{uint8(packetConf.DefaultCompressionAlgo)}
+	for _, algo := range []packet.CompressionAlgo{packet.CompressionZLIB, packet.CompressionZIP, packet.CompressionNone} {
+		if algo != packetConf.DefaultCompressionAlgo {
+			preferredCompression = append(preferredCompression, uint8(algo))
+		}
+	}
+
+	for _, id := range entity.Identities {
+		id.SelfSignature.PreferredSymmetric = preferredSymmetric
+		id.SelfSignature.PreferredCompression = preferredCompression
+	}
+}
+
+// generateKey generates a key pair for the given identity using packetConf,
+// returning it along with its armoured public and private keys
+func generateKey(name, comment, email string, packetConf *packet.Config) (*openpgp.Entity, string, string, error) {
+	entity, err := openpgp.NewEntity(name, comment, email, packetConf)
+	if err != nil {
+		return nil, "", "", err
+	}
+	ripacrypt.OrderRSAPrimes(entity)
+
+	for _, id := range entity.Identities {
+		if err = id.SelfSignature.SignUserId(id.UserId.Id, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			return nil, "", "", err
+		}
+
+		id.SelfSignature.PreferredHash = []uint8{8}
+	}
+	setKeyPreferences(entity, packetConf)
+
+	// SerializePrivate signs the identities again, covering the preferences
+	privBuf := new(bytes.Buffer)
+	w, err := armor.Encode(privBuf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err = entity.SerializePrivate(w, packetConf); err != nil {
+		return nil, "", "", err
+	}
+	if err = w.Close(); err != nil {
+		return nil, "", "", err
+	}
+
+	publicKey, err := ripacrypt.ArmorPublicKey(entity)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return entity, publicKey, privBuf.String(), nil
+}
+
+// KeyResult describes the key of an account in JSON output
+type KeyResult struct {
+	Fingerprint string `json:"fingerprint"`
+	Protected   bool   `json:"passphrase_protected"`
+	Backend     string `json:"key_backend,omitempty"`
+}
+
+// importSecretKey reads the secret key at path, which must belong to
+// publicKey if that is set, and returns it ready to store in CoreConf. A key
+// which came with a passphrase keeps it, otherwise a new one is asked for
+// unless noPassphrase is set.
+func importSecretKey(path, publicKey string, noPassphrase bool) (ripacrypt.ImportedKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ripacrypt.ImportedKey{}, err
+	}
+
+	imported, err := ripacrypt.ImportSecretKey(string(b), publicKey, promptImportPassphrase)
+	if err != nil {
+		return imported, err
+	}
+
+	if noPassphrase == true {
+		return imported, nil
+	}
+
+	passphrase := imported.Passphrase
+	if passphrase == nil {
+		if passphrase, err = promptNewPassphrase(); err != nil {
+			return imported, err
+		}
+	}
+
+	imported.PrivateKey, err = ripacrypt.ProtectPrivateKey(imported.PrivateKey, passphrase)
+	return imported, err
+}
+
+// WhoamiResult describes the account of the active profile in JSON output
+type WhoamiResult struct {
+	Profile     string `json:"profile"`
+	UserID      uint64 `json:"user_id"`
+	Fingerprint string `json:"fingerprint"`
+	Algorithm   string `json:"algorithm"`
+	KeyType     string `json:"key_type,omitempty"`
+	Cipher      string `json:"cipher,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	Backend     string `json:"key_backend"`
+
+	// RetiredKeys are the fingerprints of keys an unfinished rotation still
+	// needs
+	RetiredKeys []string `json:"retired_keys,omitempty"`
+
+	// RekeyPending means the server may not have been told of the key yet
+	RekeyPending bool `json:"rekey_pending,omitempty"`
+}
+
+// gpgBackend returns the backend for a profile whose key_backend is gpg
+func gpgBackend(conf CoreConf) ripacrypt.GPG {
+	return ripacrypt.GPG{Path: conf.GPGPath, Key: conf.GPGKey}
+}
+
+// useGPGKey looks up keyID in the GnuPG keyring and makes sure gpg can sign
+// and decrypt with it. It returns the public key and its fingerprint, which
+// is stored as gpg_key.
+func useGPGKey(keyID, gpgPath, publicKey string) (string, string, error) {
+	backend := ripacrypt.GPG{Path: gpgPath, Key: keyID}
+	exported, err := backend.ExportPublicKey()
+	if err != nil {
+		return "", "", err
+	}
+
+	entityList, err := ripacrypt.ReadKeyRing(exported)
+	if err != nil {
+		return "", "", err
+	}
+	if publicKey != "" {
+		registered, err := ripacrypt.ReadKeyRing(publicKey)
+		if err != nil {
+			return "", "", err
+		}
+		if bytes.Equal(registered[0].PrimaryKey.Fingerprint, entityList[0].PrimaryKey.Fingerprint) == false {
+			return "", "", ripacrypt.ErrKeyMismatch
+		}
+	}
+
+	// Pin the exact key rather than whatever keyID happens to match later
+	backend.Key = ripacrypt.KeyFingerprint(entityList[0].PrimaryKey)
+	if err = ripacrypt.CheckKeyBackend(backend, exported); err != nil {
+		return "", "", err
+	}
+	return exported, backend.Key, nil
+}
+
+// runKeyCommand handles `rcrypt key import|gpg|rotate`
+func runKeyCommand(conf CoreConf, args []string) {
+	usage := "usage: rcrypt key import [-nopassphrase] [-force] SECRETKEY | gpg [-gpgpath=GPG] [-force] KEYID | rotate [-keytype=TYPE] [-nopassphrase]"
+	if len(args) == 0 {
+		fail(ERRUSAGE, usage, nil)
+		return
+	}
+	if args[0] == "rotate" {
+		runKeyRotateCommand(conf, args[1:])
+		return
+	}
+
+	keyFlags := flag.NewFlagSet("key "+args[0], flag.ContinueOnError)
+	noPassphrase := keyFlags.Bool("nopassphrase", false, "Store the private key without passphrase protection (not recommended)")
+	force := keyFlags.Bool("force", false, "Replace the private key already in your config")
+	gpgPath := keyFlags.String("gpgpath", conf.GPGPath, "The gpg binary to use (defaults to gpg from your PATH)")
+	if err := keyFlags.Parse(args[1:]); err != nil {
+		fail(ERRUSAGE, usage, err)
+		return
+	}
+
+	if keyFlags.NArg() != 1 || (args[0] != "import" && args[0] != "gpg") {
+		fail(ERRUSAGE, usage, nil)
+		return
+	}
+	if conf.UserID == 0 || conf.PublicKey == "" {
+		fail(ERRCONFIG, "Profile "+activeProfile.Value+" is not registered, use: rcrypt register -publickey=PUBLICKEY -secretkey=SECRETKEY", nil)
+		return
+	}
+	if (conf.PrivateKey != "" || conf.KeyBackend != "") && *force == false {
+		fail(ERRCONFIG, "Profile "+activeProfile.Value+" already has a private key, use -force to replace it", nil)
+		return
+	}
+
+	switch args[0] {
+	case "import":
+		imported, err := importSecretKey(keyFlags.Arg(0), conf.PublicKey, *noPassphrase)
+		if err != nil {
+			fail(ERRCRYPTO, "There was an error importing your secret key", err)
+			return
+		}
+
+		conf.PrivateKey = imported.PrivateKey
+		conf.KeyBackend, conf.GPGKey, conf.GPGPath = "", "", ""
+		if err = writeConfig(conf); err != nil {
+			fail(ERRLOCAL, "There was an error attempting to write your config file to disk", err)
+			return
+		}
+
+		fmt.Println("Imported the secret key for " + imported.Fingerprint)
+		succeed(KeyResult{Fingerprint: imported.Fingerprint, Protected: ripacrypt.IsPrivateKeyProtected(conf.PrivateKey)}, 0)
+
+	case "gpg":
+		_, fingerprint, err := useGPGKey(keyFlags.Arg(0), *gpgPath, conf.PublicKey)
+		if err != nil {
+			fail(ERRCRYPTO, "There was an error using your gpg key", err)
+			return
+		}
+
+		// From now on the secret key only lives in GnuPG
+		conf.PrivateKey = ""
+		conf.KeyBackend, conf.GPGKey, conf.GPGPath = KEYBACKENDGPG, fingerprint, *gpgPath
+		if err = writeConfig(conf); err != nil {
+			fail(ERRLOCAL, "There was an error attempting to write your config file to disk", err)
+			return
+		}
+
+		fmt.Println("Your secret key " + fingerprint + " is now used from gpg, it has been removed from your config")
+		succeed(KeyResult{Fingerprint: fingerprint, Backend: KEYBACKENDGPG}, 0)
+
+	default:
+		fail(ERRUSAGE, usage, nil)
+	}
+}
+
+// runWhoamiCommand handles `rcrypt whoami`
+func runWhoamiCommand(conf CoreConf) {
+	if conf.UserID == 0 || conf.PublicKey == "" {
+		fail(ERRCONFIG, "Profile "+activeProfile.Value+" is not registered, use: rcrypt register", nil)
+		return
+	}
+
+	entityList, err := ripacrypt.ReadKeyRing(conf.PublicKey)
+	if err != nil {
+		fail(ERRCONFIG, "There was an error reading the public key in your config", err)
+		return
+	}
+
+	result := WhoamiResult{
+		Profile:     activeProfile.Value,
+		UserID:      conf.UserID,
+		Fingerprint: ripacrypt.KeyFingerprint(entityList[0].PrimaryKey),
+		Algorithm:   ripacrypt.KeyAlgorithm(entityList[0].PrimaryKey),
+		KeyType:     conf.KeyType,
+		Cipher:      conf.Cipher,
+		Compression: conf.Compression,
+		Backend:     "config",
+
+		RekeyPending: conf.RekeyPending,
+	}
+	for _, retired := range conf.RetiredKeys {
+		result.RetiredKeys = append(result.RetiredKeys, retired.Fingerprint)
+	}
+	secretKey := "in your config"
+	switch {
+	case conf.KeyBackend == KEYBACKENDGPG:
+		result.Backend = KEYBACKENDGPG
+		secretKey = "in gpg"
+	case conf.PrivateKey == "":
+		result.Backend = "none"
+		secretKey = "missing, add it with: rcrypt key import SECRETKEY"
+	case ripacrypt.IsPrivateKeyProtected(conf.PrivateKey):
+		secretKey = "in your config, passphrase protected"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Profile:\t%s\n", result.Profile)
+	fmt.Fprintf(w, "User ID:\t%d\n", result.UserID)
+	fmt.Fprintf(w, "Fingerprint:\t%s\n", result.Fingerprint)
+	fmt.Fprintf(w, "Key:\t%s\n", result.Algorithm)
+	if result.KeyType != "" {
+		fmt.Fprintf(w, "Generated as:\t%s\n", result.KeyType)
+	}
+	fmt.Fprintf(w, "Cipher:\t%s\n", orDefault(result.Cipher))
+	fmt.Fprintf(w, "Compression:\t%s\n", orDefault(result.Compression))
+	fmt.Fprintf(w, "Secret key:\t%s\n", secretKey)
+	for _, fingerprint := range result.RetiredKeys {
+		fmt.Fprintf(w, "Retired key:\t%s, finish migrating with: rcrypt key rotate\n", fingerprint)
+	}
+	if result.RekeyPending == true {
+		fmt.Fprintf(w, "Server:\tnot yet confirmed to have this key, register it with: rcrypt key rotate\n")
+	}
+	w.Flush()
+
+	succeed(result, 0)
+}
+
+// orDefault names an unset preference for display
+func orDefault(value string) string {
+	if value == "" {
+		return "library default"
+	}
+	return value
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"io"
+	"os"
+	"time"
+)
+
+// Error codes reported in the error_code field of JSON output
+const (
+	ERRLOCAL     = "local"
+	ERRUSAGE     = "usage"
+	ERRCONFIG    = "config"
+	ERRNETWORK   = "network"
+	ERRAUTH      = "auth"
+	ERRNOTFOUND  = "not_found"
+	ERRDESTROYED = "destroyed"
+	ERRSERVER    = "server"
+	ERRCRYPTO    = "crypto"
+
+	// ERRABORTED is reported when the user declines to go ahead
+	ERRABORTED = "aborted"
+)
+
+// exitCodes maps each error code to the status rcrypt exits with, so scripts
+// (and cron) can tell a destroyed crypt from a flaky network
+var exitCodes = map[string]int{
+	ERRLOCAL:     1,
+	ERRUSAGE:     2,
+	ERRCONFIG:    3,
+	ERRNETWORK:   4,
+	ERRAUTH:      5,
+	ERRNOTFOUND:  6,
+	ERRDESTROYED: 7,
+	ERRSERVER:    8,
+	ERRCRYPTO:    9,
+	ERRABORTED:   10,
+}
+
+// kindCodes maps the ripacrypt error kinds to our error codes
+var kindCodes = map[ripacrypt.ErrorKind]string{
+	ripacrypt.KindNetwork:   ERRNETWORK,
+	ripacrypt.KindAuth:      ERRAUTH,
+	ripacrypt.KindNotFound:  ERRNOTFOUND,
+	ripacrypt.KindDestroyed: ERRDESTROYED,
+	ripacrypt.KindServer:    ERRSERVER,
+	ripacrypt.KindCrypto:    ERRCRYPTO,
+}
+
+// Report is the single JSON document written to stdout with -output=json
+type Report struct {
+	Command    string      `json:"command"`
+	Success    bool        `json:"success"`
+	StatusCode int         `json:"status_code,omitempty"`
+	ErrorCode  string      `json:"error_code,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+}
+
+// CryptResult describes a crypt in JSON output
+type CryptResult struct {
+	ripacrypt.Crypt
+	Deadline         int64    `json:"deadline,omitempty"`
+	SecondsRemaining int64    `json:"seconds_remaining"`
+	Plaintext        string   `json:"plaintext,omitempty"`
+	Chunks           []string `json:"chunks,omitempty"`
+	Signer           string   `json:"signer,omitempty"`
+	Recipients       []string `json:"recipients,omitempty"`
+}
+
+var (
+	// jsonOutput is set by -output=json
+	jsonOutput bool
+
+	// report accumulates the outcome of the command being run
+	report Report
+
+	// reportWriter is where the report goes, the real stdout
+	reportWriter io.Writer = os.Stdout
+)
+
+// setOutput selects the output format. In JSON mode everything the commands
+// print for humans is sent to stderr so stdout only ever carries the report.
+func setOutput(format string) error {
+	switch format {
+	case "text":
+		return nil
+	case "json":
+		jsonOutput = true
+		reportWriter = os.Stdout
+		os.Stdout = os.Stderr
+		return nil
+	}
+	return errors.New("unknown output format " + format + ", use text or json")
+}
+
+// fail prints message and err for humans and records them in the report. A
+// passphrase gpg-agent handed us which turned out wrong is not left cached.
+func fail(code, message string, err error) {
+	if errors.Is(err, ripacrypt.ErrBadPassphrase) {
+		forgetAgentPassphrase()
+	}
+
+	fmt.Println(message)
+	if err != nil {
+		fmt.Println(err)
+		message += ": " + err.Error()
+	}
+
+	report.Success = false
+	report.ErrorCode = code
+	report.Error = message
+}
+
+// failAPI is fail for an error returned by the ripacrypt package, picking the
+// error code from the kind of error
+func failAPI(message string, err error) {
+	code, ok := kindCodes[ripacrypt.KindOf(err)]
+	if ok == false {
+		code = ERRLOCAL
+	}
+
+	fail(code, message, err)
+	report.StatusCode = ripacrypt.StatusCodeOf(err)
+}
+
+// succeed records the result of a command
+func succeed(result interface{}, statusCode int) {
+	report.Success = true
+	report.StatusCode = statusCode
+	report.Result = result
+}
+
+// finish writes the report in JSON mode and exits with the status matching
+// the error code, if any. main defers it so it runs however a command returns.
+func finish() {
+	if jsonOutput == true {
+		encoder := json.NewEncoder(reportWriter)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	}
+
+	if report.ErrorCode != "" {
+		os.Exit(exitCodes[report.ErrorCode])
+	}
+}
+
+// newCryptResult adds the deadline and time remaining to a crypt
+func newCryptResult(crypt ripacrypt.Crypt) CryptResult {
+	result := CryptResult{Crypt: crypt}
+
+	if crypt.IsDestroyed == false {
+		result.Deadline = crypt.Deadline().Unix()
+		if remaining := time.Until(crypt.Deadline()); remaining > 0 {
+			result.SecondsRemaining = int64(remaining / time.Second)
+		}
+	}
+	return result
+}
+
+// reportSigner tells the user who signed the data they just retrieved. It
+// goes to stderr so stdout only ever carries the data itself.
+func reportSigner(signer, ownFingerprint string) {
+	if signer == "" {
+		fmt.Fprintln(os.Stderr, "WARNING: the data is not signed, there is no proof it came from you unaltered")
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Good signature from "+describeSigner(signer, ownFingerprint))
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PanicResult describes what rcrypt panic destroyed and wiped in JSON output
+type PanicResult struct {
+	Profile   string   `json:"profile"`
+	Destroyed []string `json:"destroyed,omitempty"`
+	Failed    []string `json:"failed,omitempty"`
+	Wiped     []string `json:"wiped"`
+}
+
+// shredFile overwrites path with random data before removing it, so its
+// contents can't be recovered by simply undeleting it. Journaling and copy on
+// write filesystems, SSD wear levelling and backups may still hold copies.
+func shredFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err == nil {
+		_, err = io.CopyN(f, rand.Reader, info.Size())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// destroyAll destroys every live crypt in the index or listed in listPath,
+// along with their chunks. A failure is logged and the rest are still
+// destroyed.
+func destroyAll(client *ripacrypt.Client, listPath string) ([]string, []string, error) {
+	index, err := readIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Crypts only the daemon knows about are destroyed too
+	cryptIDs, _ := readCryptList(listPath)
+	for _, cryptID := range cryptIDs {
+		if index.Find(cryptID) == nil {
+			index.Crypts = append(index.Crypts, IndexEntry{CryptID: cryptID})
+		}
+	}
+
+	var destroyed, failed []string
+	var lastErr error
+	for _, entry := range index.Crypts {
+		if entry.IsDestroyed == true {
+			continue
+		}
+
+		ok := true
+		for _, cryptID := range append([]string{entry.CryptID}, entry.Chunks...) {
+			if _, err := client.Destroy(cryptID); err != nil && ripacrypt.KindOf(err) != ripacrypt.KindDestroyed {
+				log.Println("Cannot destroy crypt", cryptID, err)
+				ok = false
+				lastErr = err
+			}
+		}
+
+		if ok == true {
+			destroyed = append(destroyed, entry.CryptID)
+		} else {
+			failed = append(failed, entry.CryptID)
+		}
+	}
+
+	return destroyed, failed, lastErr
+}
+
+// wipeProfile shreds everything kept locally for the active profile: the
+// files get -out saved crypts to, its crypt index, contacts, the crypt list at
+// listPath, any leftovers of interrupted writes and its entry in rc.conf. rc.conf itself is shredded
+// once no other profile is left in it. The files shredded are returned.
+func wipeProfile(listPath string) ([]string, error) {
+	wiped := []string{}
+	var lastErr error
+
+	shred := func(path string) {
+		err := shredFile(path)
+		if err == nil {
+			wiped = append(wiped, path)
+		} else if os.IsNotExist(err) == false {
+			log.Println("Cannot wipe", path, err)
+			lastErr = err
+		}
+	}
+
+	// The index is all that remembers where get -out saved things
+	if index, err := readIndex(); err == nil {
+		for _, path := range index.Saved {
+			shred(path)
+		}
+	}
+
+	shred(indexPath())
+	shred(contactsPath())
+	shred(listPath)
+
+	leftovers, _ := filepath.Glob(configDir() + ".*.tmp*")
+	for _, path := range leftovers {
+		shred(path)
+	}
+
+	configFile, err := loadConfigFile()
+	if err != nil {
+		return wiped, err
+	}
+	if _, exists := configFile.Profiles[activeProfile.Value]; exists == false {
+		return wiped, lastErr
+	}
+
+	delete(configFile.Profiles, activeProfile.Value)
+	if configFile.DefaultProfile == activeProfile.Value {
+		configFile.DefaultProfile = ""
+	}
+	if len(configFile.Profiles) == 0 {
+		shred(configPath.Value)
+		return wiped, lastErr
+	}
+
+	// The old rc.conf is moved aside rather than overwritten in place so the
+	// other profiles survive if we are interrupted
+	old := configPath.Value + ".wipe"
+	if err = os.Rename(configPath.Value, old); err != nil {
+		return wiped, err
+	}
+	if err = writeConfigFile(configFile); err != nil {
+		return wiped, err
+	}
+	if err = shredFile(old); err != nil {
+		return wiped, err
+	}
+	wiped = append(wiped, configPath.Value)
+
+	return wiped, lastErr
+}
+
+// runPanicCommand handles `rcrypt panic`, wiping the private key, crypt
+// index, contacts and get -out files of the active profile. With destroy every crypt it knows about
+// is destroyed first.
+func runPanicCommand(conf CoreConf, destroy bool, skipConfirm bool) {
+	if skipConfirm == false {
+		if destroy == true {
+			fmt.Println("Every crypt of profile " + activeProfile.Value + " will be destroyed immediately, this cannot be undone!")
+		}
+		fmt.Println("The private key, crypt index, contacts and files saved with get -out of profile " + activeProfile.Value + " will be overwritten and deleted, this cannot be undone!")
+		fmt.Print("Type 'yes' to continue: ")
+
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			fail(ERRABORTED, "Not wiping profile "+activeProfile.Value, nil)
+			return
+		}
+	}
+
+	result := PanicResult{Profile: activeProfile.Value}
+	listPath := profileFile("crypts", ".list")
+
+	var destroyErr error
+	if destroy == true && conf.UserID != 0 {
+		result.Destroyed, result.Failed, destroyErr = destroyAll(newClient(conf), listPath)
+		for _, cryptID := range result.Destroyed {
+			fmt.Println("Destroyed crypt " + cryptID)
+		}
+	}
+
+	wiped, wipeErr := wipeProfile(listPath)
+	result.Wiped = wiped
+	for _, path := range wiped {
+		fmt.Println("Wiped " + path)
+	}
+	if conf.KeyBackend == KEYBACKENDGPG {
+		fmt.Println("Your secret key is kept by gpg, delete it with: gpg --delete-secret-keys " + conf.Fingerprint)
+	}
+
+	if wipeErr != nil {
+		fail(ERRLOCAL, "There was an error wiping profile "+activeProfile.Value, wipeErr)
+		report.Result = result
+		return
+	}
+	if destroyErr != nil {
+		failAPI(strconv.Itoa(len(result.Failed))+" crypts could not be destroyed, profile "+activeProfile.Value+" has still been wiped", destroyErr)
+		report.Result = result
+		return
+	}
+
+	fmt.Println("Wiped profile " + activeProfile.Value)
+	succeed(result, 0)
+}
+
+// daemonPanic is rcrypt panic for a daemon that has found a watched crypt
+// destroyed
+func daemonPanic(client *ripacrypt.Client, listPath string, destroy bool) {
+	if destroy == true {
+		destroyed, failed, _ := destroyAll(client, listPath)
+		for _, cryptID := range destroyed {
+			log.Println("Destroyed crypt", cryptID)
+		}
+		if len(failed) > 0 {
+			log.Println(len(failed), "crypts could not be destroyed")
+		}
+	}
+
+	wiped, err := wipeProfile(listPath)
+	for _, path := range wiped {
+		log.Println("Wiped", path)
+	}
+	if err != nil {
+		log.Println("There was an error wiping profile", activeProfile.Value, err)
+		return
+	}
+	log.Println("Wiped profile", activeProfile.Value)
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"rsc.io/qr"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PAPERVERSION is the version of the paper key format
+	PAPERVERSION = 1
+
+	// paperGroups is the number of 4 character groups on each line, 30 bytes
+	paperGroups = 12
+
+	// paperQRLines is the number of lines in each QR code
+	paperQRLines = 8
+
+	// paperProtected flags a payload whose key is passphrase protected
+	paperProtected = 1
+)
+
+// paperEncoding only uses characters that QR codes can hold in their compact
+// alphanumeric mode and that are hard to mistype
+var paperEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// paperLinePattern matches the number which starts each line
+var paperLinePattern = regexp.MustCompile(`^([0-9]{3}):$`)
+
+// PaperResult describes a paper key in JSON output
+type PaperResult struct {
+	UserID      uint64   `json:"user_id"`
+	Fingerprint string   `json:"fingerprint"`
+	Protected   bool     `json:"passphrase_protected"`
+	Lines       int      `json:"lines"`
+	Files       []string `json:"files,omitempty"`
+}
+
+// paperKey is what a paper key holds: enough to rebuild the profile
+type paperKey struct {
+	UserID      uint64
+	BTCAddr     string
+	KeyType     string
+	Cipher      string
+	Compression string
+	Protected   bool
+
+	// Key is the binary private key, or the binary OpenPGP message holding
+	// it if it is protected
+	Key []byte
+}
+
+// marshal packs the paper key as densely as possible: a version byte, a
+// flags byte, the user ID and then length prefixed strings, with the key
+// taking up the rest
+func (p paperKey) marshal() []byte {
+	buf := new(bytes.Buffer)
+	var flags byte
+	if p.Protected == true {
+		flags |= paperProtected
+	}
+	buf.Write([]byte{PAPERVERSION, flags})
+
+	varint := make([]byte, binary.MaxVarintLen64)
+	buf.Write(varint[:binary.PutUvarint(varint, p.UserID)])
+	for _, field := range []string{p.BTCAddr, p.KeyType, p.Cipher, p.Compression} {
+		buf.Write(varint[:binary.PutUvarint(varint, uint64(len(field)))])
+		buf.WriteString(field)
+	}
+	buf.Write(p.Key)
+	return buf.Bytes()
+}
+
+// unmarshalPaperKey reverses marshal
+func unmarshalPaperKey(b []byte) (paperKey, error) {
+	var p paperKey
+	r := bytes.NewReader(b)
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return p, err
+	}
+	if version != PAPERVERSION {
+		return p, errors.New("unsupported paper key version " + strconv.Itoa(int(version)))
+	}
+	flags, err := r.ReadByte()
+	if err != nil {
+		return p, err
+	}
+	p.Protected = flags&paperProtected != 0
+
+	if p.UserID, err = binary.ReadUvarint(r); err != nil {
+		return p, err
+	}
+	for _, field := range []*string{&p.BTCAddr, &p.KeyType, &p.Cipher, &p.Compression} {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return p, err
+		}
+		if length > uint64(r.Len()) {
+			return p, io.ErrUnexpectedEOF
+		}
+		value := make([]byte, length)
+		r.Read(value)
+		*field = string(value)
+	}
+
+	p.Key, err = ioutil.ReadAll(r)
+	return p, err
+}
+
+// paperChecksum catches typing mistakes and swapped lines
+func paperChecksum(number int, data string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%03d:%s", number, data)))
+	return strings.ToUpper(hex.EncodeToString(sum[:2]))
+}
+
+// paperHeader starts every paper key and QR code, naming the number of lines
+// and a checksum of everything in them
+func paperHeader(payload []byte, lines int) string {
+	sum := sha256.Sum256(payload)
+	return fmt.Sprintf("RIPACRYPT PAPER KEY V%d LINES %d SHA256 %s", PAPERVERSION, lines, strings.ToUpper(hex.EncodeToString(sum[:8])))
+}
+
+// encodePaper splits payload into numbered, checksummed lines of base32
+func encodePaper(payload []byte) []string {
+	encoded := paperEncoding.EncodeToString(payload)
+
+	var lines []string
+	for number := 1; len(encoded) > 0; number++ {
+		n := paperGroups * 4
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		data := encoded[:n]
+		encoded = encoded[n:]
+
+		groups := []string{fmt.Sprintf("%03d:", number)}
+		for i := 0; i < len(data); i += 4 {
+			end := i + 4
+			if end > len(data) {
+				end = len(data)
+			}
+			groups = append(groups, data[i:end])
+		}
+		lines = append(lines, strings.Join(append(groups, paperChecksum(number, data)), " "))
+	}
+	return lines
+}
+
+// decodePaper reassembles the payload from typed or scanned text. Only the
+// words matter, not how they are split across lines, so the contents of
+// several QR codes can simply be pasted one after another. Lines starting
+// with # are ignored.
+func decodePaper(r io.Reader) ([]byte, error) {
+	var words []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); strings.HasPrefix(line, "#") == false {
+			words = append(words, strings.Fields(strings.ToUpper(line))...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	header := ""
+	lines := make(map[int]string)
+	var badLines []string
+	for i := 0; i < len(words); i++ {
+		if words[i] == "RIPACRYPT" {
+			if i+7 >= len(words) {
+				return nil, errors.New("the header line is incomplete")
+			}
+			found := strings.Join(words[i:i+8], " ")
+			if header != "" && header != found {
+				return nil, errors.New("the lines come from more than one paper key")
+			}
+			header = found
+			i += 7
+			continue
+		}
+
+		match := paperLinePattern.FindStringSubmatch(words[i])
+		if match == nil {
+			return nil, errors.New("unexpected " + words[i] + ", every line must start with its number e.g. 001:")
+		}
+		number, _ := strconv.Atoi(match[1])
+
+		var groups []string
+		for i+1 < len(words) && words[i+1] != "RIPACRYPT" && paperLinePattern.MatchString(words[i+1]) == false {
+			i++
+			groups = append(groups, words[i])
+		}
+		if len(groups) < 2 || paperChecksum(number, strings.Join(groups[:len(groups)-1], "")) != groups[len(groups)-1] {
+			badLines = append(badLines, match[1])
+			continue
+		}
+		lines[number] = strings.Join(groups[:len(groups)-1], "")
+	}
+
+	if len(badLines) > 0 {
+		return nil, errors.New("checksum mismatch on line " + strings.Join(badLines, ", ") + ", check them for typing mistakes")
+	}
+	if header == "" {
+		return nil, errors.New("the header line starting RIPACRYPT PAPER KEY is missing")
+	}
+
+	fields := strings.Fields(header)
+	total, err := strconv.Atoi(fields[5])
+	if fields[1] != "PAPER" || fields[2] != "KEY" || fields[4] != "LINES" || fields[6] != "SHA256" || err != nil {
+		return nil, errors.New("the header line is not a RIPACrypt paper key")
+	}
+	if fields[3] != "V"+strconv.Itoa(PAPERVERSION) {
+		return nil, errors.New("unsupported paper key version " + fields[3])
+	}
+
+	var missing []string
+	encoded := ""
+	for number := 1; number <= total; number++ {
+		data, ok := lines[number]
+		if ok == false {
+			missing = append(missing, fmt.Sprintf("%03d", number))
+		}
+		encoded += data
+	}
+	if len(missing) > 0 {
+		return nil, errors.New("line " + strings.Join(missing, ", ") + " missing")
+	}
+
+	payload, err := paperEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if paperHeader(payload, total) != header {
+		return nil, errors.New("the lines do not add up to the key described by the header (SHA256 " + fields[7] + ")")
+	}
+	return payload, nil
+}
+
+// writePaperQRCodes renders the header and lines as a sequence of QR codes
+// named PREFIX-01.png, PREFIX-02.png and so on
+func writePaperQRCodes(prefix, header string, lines []string, force bool) ([]string, error) {
+	var files []string
+	total := (len(lines) + paperQRLines - 1) / paperQRLines
+	for i := 0; i < total; i++ {
+		end := (i + 1) * paperQRLines
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		// Spaces rather than newlines keep to the alphanumeric mode
+		code, err := qr.Encode(header+" "+strings.Join(lines[i*paperQRLines:end], " "), qr.M)
+		if err != nil {
+			return files, err
+		}
+
+		file := fmt.Sprintf("%s-%02d.png", prefix, i+1)
+		if _, err = os.Lstat(file); err == nil && force == false {
+			return files, errors.New(file + " already exists, use -force to overwrite it")
+		}
+		if err = writeFileAtomic(file, code.PNG()); err != nil {
+			return files, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// dearmor returns the binary contents of an armoured block
+func dearmor(armoured string) ([]byte, error) {
+	block, err := armor.Decode(strings.NewReader(armoured))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(block.Body)
+}
+
+// rearmor is the opposite of dearmor
+func rearmor(b []byte, blockType string) (string, error) {
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, blockType, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err = w.Write(b); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// runExportPaperCommand handles `rcrypt export-paper`, printing the account
+// as lines of text to type back in and optionally as QR codes to scan
+func runExportPaperCommand(conf CoreConf, outPath, pngPrefix string, force, noPassphrase bool) {
+	if conf.UserID == 0 {
+		fail(ERRCONFIG, "Profile "+activeProfile.Value+" is not registered, there is nothing to export", nil)
+		return
+	}
+	if conf.KeyBackend == KEYBACKENDGPG {
+		fail(ERRCONFIG, "Your secret key is kept by gpg, put it on paper with: gpg --export-secret-keys "+conf.GPGKey+" | paperkey", nil)
+		return
+	}
+	if conf.PrivateKey == "" {
+		fail(ERRCONFIG, "Your config file doesn't contain a private key - there is nothing to export", nil)
+		return
+	}
+	if len(conf.RetiredKeys) > 0 {
+		// A paper key only holds the current key, which can't read crypts
+		// still encrypted to the old one
+		fail(ERRCONFIG, "Your key rotation hasn't finished, finish it with rcrypt key rotate before exporting a paper key (or use rcrypt backup, which keeps your old key too)", nil)
+		return
+	}
+	if outPath == "" && jsonOutput == true {
+		fail(ERRUSAGE, "-output=json needs -out, stdout carries the report", nil)
+		return
+	}
+	if _, err := os.Lstat(outPath); outPath != "" && err == nil && force == false {
+		fail(ERRLOCAL, outPath+" already exists, use -force to overwrite it", nil)
+		return
+	}
+
+	privateKey := conf.PrivateKey
+	if ripacrypt.IsPrivateKeyProtected(privateKey) == false && noPassphrase == false {
+		passphrase, err := promptNewPassphrase()
+		if err != nil {
+			fail(ERRCRYPTO, "There was an error reading the passphrase for your paper key", err)
+			return
+		}
+		if privateKey, err = ripacrypt.ProtectPrivateKey(privateKey, passphrase); err != nil {
+			fail(ERRCRYPTO, "There was an error protecting your private key with your passphrase", err)
+			return
+		}
+	}
+
+	key, err := dearmor(privateKey)
+	if err != nil {
+		fail(ERRCONFIG, "There was an error reading the private key in your config", err)
+		return
+	}
+	paper := paperKey{
+		UserID:      conf.UserID,
+		BTCAddr:     conf.BTCAddr,
+		KeyType:     conf.KeyType,
+		Cipher:      conf.Cipher,
+		Compression: conf.Compression,
+		Protected:   ripacrypt.IsPrivateKeyProtected(privateKey),
+		Key:         key,
+	}
+	payload := paper.marshal()
+	lines := encodePaper(payload)
+	header := paperHeader(payload, len(lines))
+
+	text := new(bytes.Buffer)
+	fmt.Fprintf(text, "# RIPACrypt paper key for user %d, key %s\n", conf.UserID, conf.Fingerprint)
+	fmt.Fprintf(text, "# Printed %s. Restore it by typing or scanning every line into: rcrypt import-paper\n", time.Now().Format("2006-01-02"))
+	if paper.Protected == true {
+		fmt.Fprintln(text, "# The private key is protected by your passphrase.")
+	} else {
+		fmt.Fprintln(text, "# The private key is NOT passphrase protected, anyone who reads this page has it.")
+	}
+	fmt.Fprintln(text, "# The last group of each line is a checksum which catches typing mistakes.")
+	fmt.Fprintln(text)
+	fmt.Fprintln(text, header)
+	for _, line := range lines {
+		fmt.Fprintln(text, line)
+	}
+
+	result := PaperResult{UserID: conf.UserID, Fingerprint: conf.Fingerprint, Protected: paper.Protected, Lines: len(lines)}
+	if pngPrefix != "" {
+		if result.Files, err = writePaperQRCodes(pngPrefix, header, lines, force); err != nil {
+			fail(ERRLOCAL, "There was an error writing the QR codes", err)
+			return
+		}
+		fmt.Println("Wrote " + strconv.Itoa(len(result.Files)) + " QR codes, print and scan all of them: " + strings.Join(result.Files, " "))
+	}
+
+	if outPath != "" {
+		if err = writeFileAtomic(outPath, text.Bytes()); err != nil {
+			fail(ERRLOCAL, "There was an error writing your paper key", err)
+			return
+		}
+		result.Files = append(result.Files, outPath)
+		fmt.Println("Wrote your paper key to " + outPath + ", print it and then delete it")
+	} else {
+		fmt.Print(text.String())
+	}
+	succeed(result, 0)
+}
+
+// runImportPaperCommand handles `rcrypt import-paper`, rebuilding the active
+// profile from the lines of a paper key read from inPath or stdin
+func runImportPaperCommand(conf CoreConf, inPath string, force bool) {
+	if conf.UserID != 0 && force == false {
+		fail(ERRCONFIG, "Profile "+activeProfile.Value+" is already registered as user "+strconv.FormatUint(conf.UserID, 10)+", use -force to replace it or choose another with -profile", nil)
+		return
+	}
+
+	var r io.Reader = os.Stdin
+	if inPath != "" {
+		f, err := os.Open(inPath)
+		if err != nil {
+			fail(ERRLOCAL, "There was an error reading your paper key", err)
+			return
+		}
+		defer f.Close()
+		r = f
+	}
+
+	payload, err := decodePaper(r)
+	if err != nil {
+		fail(ERRCONFIG, "There was an error reading your paper key", err)
+		return
+	}
+	paper, err := unmarshalPaperKey(payload)
+	if err != nil {
+		fail(ERRCONFIG, "There was an error reading your paper key", err)
+		return
+	}
+
+	blockType := openpgp.PrivateKeyType
+	if paper.Protected == true {
+		blockType = "PGP MESSAGE"
+	}
+	privateKey, err := rearmor(paper.Key, blockType)
+	if err != nil {
+		fail(ERRCRYPTO, "There was an error reading the private key on your paper key", err)
+		return
+	}
+
+	// The public key is not on paper, it comes from the private key
+	unlocked, err := ripacrypt.UnlockPrivateKey(privateKey, promptPassphrase)
+	if err != nil {
+		fail(ERRCRYPTO, "There was an error unlocking the private key on your paper key", err)
+		return
+	}
+	entityList, err := ripacrypt.ReadKeyRing(unlocked)
+	if err != nil || entityList[0].PrivateKey == nil {
+		fail(ERRCRYPTO, "The paper key does not hold a usable private key", err)
+		return
+	}
+	publicKey, err := ripacrypt.ArmorPublicKey(entityList[0])
+	if err != nil {
+		fail(ERRCRYPTO, "There was an error reading the private key on your paper key", err)
+		return
+	}
+
+	restored := CoreConf{
+		UseTor:      conf.UseTor,
+		UserID:      paper.UserID,
+		BTCAddr:     paper.BTCAddr,
+		PublicKey:   publicKey,
+		PrivateKey:  privateKey,
+		Fingerprint: ripacrypt.KeyFingerprint(entityList[0].PrimaryKey),
+		KeyType:     paper.KeyType,
+		Cipher:      paper.Cipher,
+		Compression: paper.Compression,
+		APIURL:      conf.APIURL,
+		OnionURL:    conf.OnionURL,
+		SOCKSAddr:   conf.SOCKSAddr,
+	}
+	if _, err = packetConfig(restored.KeyType, restored.Cipher, restored.Compression); err != nil {
+		fail(ERRCONFIG, "Your paper key is not usable", err)
+		return
+	}
+	if err = writeConfig(restored); err != nil {
+		fail(ERRLOCAL, "There was an error attempting to write your config file to disk", err)
+		return
+	}
+
+	fmt.Println("Restored user " + strconv.FormatUint(restored.UserID, 10) + " (" + restored.Fingerprint + ") into profile " + activeProfile.Value)
+	fmt.Println("Your crypt index is not part of a paper key, keep a note of your crypt IDs or use rcrypt backup as well")
+	succeed(PaperResult{UserID: restored.UserID, Fingerprint: restored.Fingerprint, Protected: paper.Protected}, 0)
+}
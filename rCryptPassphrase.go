@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/term"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PASSPHRASEENV names the environment variable that may hold the passphrase
+	// protecting your private key (handy for the daemon, dangerous elsewhere)
+	PASSPHRASEENV = "RIPACRYPT_PASSPHRASE"
+
+	// PASSPHRASEFDENV names the environment variable holding a file descriptor
+	// number from which the passphrase is read e.g. RIPACRYPT_PASSPHRASE_FD=3
+	PASSPHRASEFDENV = "RIPACRYPT_PASSPHRASE_FD"
+
+	// PASSPHRASEAGENTENV names the environment variable which, when set, has
+	// the passphrase for your private key asked for and cached by gpg-agent
+	PASSPHRASEAGENTENV = "RIPACRYPT_PASSPHRASE_AGENT"
+
+	// NEWPASSPHRASEENV names the environment variable that may hold a new
+	// passphrase, needed to change it with passwd when not on a terminal
+	NEWPASSPHRASEENV = "RIPACRYPT_NEW_PASSPHRASE"
+)
+
+// fdPassphrase is the passphrase once read from PASSPHRASEFDENV, which only
+// yields it once
+var fdPassphrase []byte
+
+// promptPassphrase is used to unlock a protected private key. The passphrase
+// is taken from the environment, a file descriptor, gpg-agent if
+// PASSPHRASEAGENTENV is set or finally the terminal.
+func promptPassphrase() ([]byte, error) {
+	if os.Getenv(PASSPHRASEAGENTENV) != "" && isPassphraseSupplied() == false {
+		return agentPassphrase()
+	}
+	return readPassphrase("Passphrase for your private key: ")
+}
+
+// promptImportPassphrase unlocks a secret key being imported, looking in the
+// same places as promptPassphrase
+func promptImportPassphrase() ([]byte, error) {
+	return readPassphrase("Passphrase for the secret key being imported: ")
+}
+
+// readPassphrase takes a passphrase from the environment, a file descriptor
+// or finally asks for it on the terminal with prompt
+func readPassphrase(prompt string) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(PASSPHRASEENV); ok == true {
+		return []byte(passphrase), nil
+	}
+
+	if fdPassphrase != nil {
+		return fdPassphrase, nil
+	}
+
+	if fdString := os.Getenv(PASSPHRASEFDENV); fdString != "" {
+		fd, err := strconv.Atoi(fdString)
+		if err != nil {
+			return nil, errors.New(PASSPHRASEFDENV + " is not a file descriptor number")
+		}
+
+		line, err := bufio.NewReader(os.NewFile(uintptr(fd), "passphrase")).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, err
+		}
+		fdPassphrase = []byte(strings.TrimRight(line, "\r\n"))
+		return fdPassphrase, nil
+	}
+
+	return readTerminalPassphrase(prompt)
+}
+
+// isPassphraseSupplied reports whether readPassphrase will find a passphrase
+// without asking on the terminal
+func isPassphraseSupplied() bool {
+	_, fromEnv := os.LookupEnv(PASSPHRASEENV)
+	return fromEnv == true || os.Getenv(PASSPHRASEFDENV) != ""
+}
+
+// promptNewPassphrase picks a new passphrase for the private key. It is taken
+// from NEWPASSPHRASEENV, then the places readPassphrase looks so register and
+// key rotate can run unattended, and only then asked for twice on the
+// terminal.
+func promptNewPassphrase() ([]byte, error) {
+	errEmpty := errors.New("an empty passphrase offers no protection, use -nopassphrase if you really want this")
+
+	passphrase, fromEnv := os.LookupEnv(NEWPASSPHRASEENV)
+	switch {
+	case fromEnv == true:
+		if passphrase == "" {
+			return nil, errEmpty
+		}
+		return []byte(passphrase), nil
+	case isPassphraseSupplied() == true:
+		newPassphrase, err := readPassphrase("")
+		if err == nil && len(newPassphrase) == 0 {
+			err = errEmpty
+		}
+		return newPassphrase, err
+	}
+	return readNewTerminalPassphrase("New passphrase for your private key: ", errEmpty)
+}
+
+// promptBackupPassphrase asks for the passphrase protecting a backup, twice
+// on the terminal when confirm is set. Like promptPassphrase it is taken from
+// the environment or a file descriptor first.
+func promptBackupPassphrase(confirm bool) ([]byte, error) {
+	errEmpty := errors.New("a backup must be protected by a passphrase")
+
+	if confirm == true && isPassphraseSupplied() == false {
+		return readNewTerminalPassphrase("New passphrase for the backup: ", errEmpty)
+	}
+
+	passphrase, err := readPassphrase("Passphrase for the backup: ")
+	if err == nil && len(passphrase) == 0 {
+		err = errEmpty
+	}
+	return passphrase, err
+}
+
+// agentCacheID is what gpg-agent caches the passphrase of the active profiles
+// private key under
+func agentCacheID() string {
+	return "rcrypt:" + activeProfile.Value
+}
+
+// agentEscape percent-escapes an argument to an Assuan command, where a +
+// stands for a space
+func agentEscape(arg string) string {
+	escaped := ""
+	for _, c := range []byte(arg) {
+		switch {
+		case c == ' ':
+			escaped += "+"
+		case c < ' ' || c == '+' || c == '%':
+			escaped += fmt.Sprintf("%%%02X", c)
+		default:
+			escaped += string(c)
+		}
+	}
+	return escaped
+}
+
+// agentCommand sends command to gpg-agent with gpg-connect-agent, starting
+// the agent if need be, and returns what followed the OK of its reply
+func agentCommand(command string, args ...string) (string, error) {
+	for _, arg := range args {
+		command += " " + agentEscape(arg)
+	}
+
+	cmd := exec.Command("gpg-connect-agent")
+	cmd.Stdin = strings.NewReader(command + "\n/bye\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot talk to gpg-agent: %v", err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "OK":
+			return "", nil
+		case strings.HasPrefix(line, "OK "):
+			return strings.TrimPrefix(line, "OK "), nil
+		case strings.HasPrefix(line, "ERR "):
+			return "", errors.New("gpg-agent: " + strings.TrimPrefix(line, "ERR "))
+		}
+	}
+	return "", errors.New("gpg-agent gave no answer")
+}
+
+// agentPassphrase asks gpg-agent for the passphrase of the active profiles
+// private key. Its pinentry asks the first time, after which the agent
+// caches it just like the passphrases of its own keys, so e.g. the daemon
+// can be restarted without typing it again.
+func agentPassphrase() ([]byte, error) {
+	reply, err := agentCommand("GET_PASSPHRASE", agentCacheID(), "X", "Passphrase:", "Passphrase for the private key of rcrypt profile "+activeProfile.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	passphrase, err := hex.DecodeString(reply)
+	if err != nil {
+		return nil, errors.New("gpg-agent sent a malformed passphrase")
+	}
+	return passphrase, nil
+}
+
+// forgetAgentPassphrase has gpg-agent drop the passphrase it cached for the
+// active profile, once it has turned out wrong or been changed
+func forgetAgentPassphrase() {
+	if os.Getenv(PASSPHRASEAGENTENV) == "" {
+		return
+	}
+
+	if _, err := agentCommand("CLEAR_PASSPHRASE", agentCacheID()); err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot clear the passphrase cached by gpg-agent:", err)
+	}
+}
+
+// readNewTerminalPassphrase asks for a passphrase twice on the terminal with
+// prompt and makes sure both match, returning errEmpty if it is empty
+func readNewTerminalPassphrase(prompt string, errEmpty error) ([]byte, error) {
+	passphrase, err := readTerminalPassphrase(prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(passphrase) == 0 {
+		return nil, errEmpty
+	}
+
+	confirm, err := readTerminalPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if string(passphrase) != string(confirm) {
+		return nil, errors.New("passphrases do not match")
+	}
+
+	return passphrase, nil
+}
+
+// readTerminalPassphrase reads a passphrase without echoing it. We use
+// /dev/tty rather than stdin as that is often carrying the data to store.
+func readTerminalPassphrase(prompt string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.New("cannot open a terminal to ask for your passphrase, set " + PASSPHRASEENV + ", " + PASSPHRASEFDENV + " or " + PASSPHRASEAGENTENV)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	passphrase, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+
+	return passphrase, err
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	// PROFILEENV names the environment variable which selects the profile
+	PROFILEENV = "RIPACRYPT_PROFILE"
+
+	// DEFAULTPROFILE is used when no profile is chosen, and is where a
+	// config file from before profiles existed ends up
+	DEFAULTPROFILE = "default"
+)
+
+// ConfigFile describes rc.conf, which holds one CoreConf per named profile
+type ConfigFile struct {
+	DefaultProfile string              `json:"default_profile,omitempty"`
+	Profiles       map[string]CoreConf `json:"profiles"`
+}
+
+// ProfileResult describes a profile in JSON output
+type ProfileResult struct {
+	Name        string `json:"name"`
+	Default     bool   `json:"default"`
+	UserID      uint64 `json:"user_id,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	APIURL      string `json:"api_url,omitempty"`
+	UseTor      bool   `json:"usetor"`
+}
+
+// activeProfile is resolved by main before any command runs
+var activeProfile = setting{DEFAULTPROFILE, "default"}
+
+// profileNamePattern keeps profile names safe to use in file names
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateProfileName checks name can be used for a profile
+func validateProfileName(name string) error {
+	if profileNamePattern.MatchString(name) == false {
+		return errors.New("profile names may only contain letters, numbers, '.', '_' and '-'")
+	}
+	return nil
+}
+
+// profileFile returns the path of a per profile state file, the default
+// profile keeps the names used before profiles existed
+func profileFile(name, ext string) string {
+	if activeProfile.Value == DEFAULTPROFILE {
+		return configDir() + name + ext
+	}
+	return configDir() + name + "-" + activeProfile.Value + ext
+}
+
+// loadConfigFile reads rc.conf, a missing file has no profiles. A config
+// written before profiles existed becomes the default profile.
+func loadConfigFile() (ConfigFile, error) {
+	configFile := ConfigFile{Profiles: make(map[string]CoreConf)}
+
+	if err := checkConfigPermissions(configPath.Value); err != nil {
+		return configFile, err
+	}
+
+	b, err := ioutil.ReadFile(configPath.Value)
+	if os.IsNotExist(err) {
+		return configFile, nil
+	}
+	if err != nil {
+		return configFile, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(b, &fields); err != nil {
+		return configFile, err
+	}
+
+	if _, ok := fields["profiles"]; ok == false {
+		var conf CoreConf
+		err = json.Unmarshal(b, &conf)
+		configFile.Profiles[DEFAULTPROFILE] = conf
+		return configFile, err
+	}
+
+	err = json.Unmarshal(b, &configFile)
+	if configFile.Profiles == nil {
+		configFile.Profiles = make(map[string]CoreConf)
+	}
+	return configFile, err
+}
+
+// migrateFingerprints replaces the 16 digit key IDs stored as the
+// fingerprint by older versions with the full fingerprint of the profiles
+// public key, returning whether anything changed
+func migrateFingerprints(configFile ConfigFile) bool {
+	migrated := false
+	for name, conf := range configFile.Profiles {
+		if len(conf.Fingerprint) != 16 || conf.PublicKey == "" {
+			continue
+		}
+
+		entityList, err := ripacrypt.ReadKeyRing(conf.PublicKey)
+		if err != nil {
+			continue
+		}
+		fingerprint := ripacrypt.KeyFingerprint(entityList[0].PrimaryKey)
+		if strings.HasSuffix(fingerprint, strings.ToUpper(conf.Fingerprint)) == false {
+			continue
+		}
+
+		conf.Fingerprint = fingerprint
+		configFile.Profiles[name] = conf
+		migrated = true
+	}
+	return migrated
+}
+
+// writeConfigFile saves every profile to rc.conf
+func writeConfigFile(configFile ConfigFile) error {
+	configFileBuffer, jsonMarshalErr := json.MarshalIndent(configFile, "", "  ")
+	if jsonMarshalErr != nil {
+		return jsonMarshalErr
+	}
+
+	return writeFileAtomic(configPath.Value, configFileBuffer)
+}
+
+// runProfileCommand handles `rcrypt profile list|add|remove|default`
+func runProfileCommand(configFile ConfigFile, args []string) {
+	usage := "usage: rcrypt profile list | add [-url=URL] [-onionurl=URL] [-socks=host:port] [-usetor] NAME | remove [-yes] NAME | default NAME"
+	if len(args) == 0 {
+		fail(ERRUSAGE, usage, nil)
+		return
+	}
+
+	profileFlags := flag.NewFlagSet("profile "+args[0], flag.ContinueOnError)
+	apiURL := profileFlags.String("url", "", "Base URL of the RIPACrypt API for this profile")
+	onionURL := profileFlags.String("onionurl", "", "Base URL of the RIPACrypt Tor hidden service for this profile")
+	socksAddr := profileFlags.String("socks", "", "host:port of the Tor SOCKS5 proxy for this profile")
+	useTor := profileFlags.Bool("usetor", false, "Always use Tor with this profile")
+	skipConfirm := profileFlags.Bool("yes", false, "Do not ask for confirmation before removing the profile")
+
+	// Allow flags either side of the profile name
+	var name string
+	rest := args[1:]
+	for {
+		if err := profileFlags.Parse(rest); err != nil {
+			fail(ERRUSAGE, usage, err)
+			return
+		}
+		if profileFlags.NArg() == 0 {
+			break
+		}
+		if name != "" {
+			fail(ERRUSAGE, usage, nil)
+			return
+		}
+		name = profileFlags.Arg(0)
+		rest = profileFlags.Args()[1:]
+	}
+
+	if args[0] != "list" {
+		if name == "" {
+			fail(ERRUSAGE, usage, nil)
+			return
+		}
+		if err := validateProfileName(name); err != nil {
+			fail(ERRUSAGE, "Invalid profile name "+name, err)
+			return
+		}
+	}
+
+	defaultProfile := configFile.DefaultProfile
+	if defaultProfile == "" {
+		defaultProfile = DEFAULTPROFILE
+	}
+
+	switch args[0] {
+	case "list":
+		names := make([]string, 0, len(configFile.Profiles))
+		for profileName := range configFile.Profiles {
+			names = append(names, profileName)
+		}
+		sort.Strings(names)
+
+		results := []ProfileResult{}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "PROFILE\tUSER ID\tFINGERPRINT\tAPI URL\tTOR")
+		for _, profileName := range names {
+			conf := configFile.Profiles[profileName]
+			results = append(results, ProfileResult{
+				Name:        profileName,
+				Default:     profileName == defaultProfile,
+				UserID:      conf.UserID,
+				Fingerprint: conf.Fingerprint,
+				APIURL:      conf.APIURL,
+				UseTor:      conf.UseTor,
+			})
+
+			marker := ""
+			if profileName == defaultProfile {
+				marker = " (default)"
+			}
+			fmt.Fprintf(w, "%s%s\t%d\t%s\t%s\t%t\n", profileName, marker, conf.UserID, conf.Fingerprint, conf.APIURL, conf.UseTor)
+		}
+		w.Flush()
+
+		if len(names) == 0 {
+			fmt.Println("You have no profiles, register to create one")
+		}
+		succeed(results, 0)
+
+	case "add":
+		if _, exists := configFile.Profiles[name]; exists == true {
+			fail(ERRCONFIG, "A profile named "+name+" already exists", nil)
+			return
+		}
+
+		conf := CoreConf{UseTor: *useTor, SOCKSAddr: *socksAddr}
+		var err error
+		if *apiURL != "" {
+			if conf.APIURL, err = validateAPIURL(*apiURL); err != nil {
+				fail(ERRUSAGE, "Invalid API URL", err)
+				return
+			}
+		}
+		if *onionURL != "" {
+			if conf.OnionURL, err = validateAPIURL(*onionURL); err != nil {
+				fail(ERRUSAGE, "Invalid onion URL", err)
+				return
+			}
+		}
+		if *socksAddr != "" {
+			if err = validateSOCKSAddr(*socksAddr); err != nil {
+				fail(ERRUSAGE, "Invalid SOCKS address", err)
+				return
+			}
+		}
+
+		configFile.Profiles[name] = conf
+		if err = writeConfigFile(configFile); err != nil {
+			fail(ERRLOCAL, "There was an error attempting to write your config file to disk", err)
+			return
+		}
+
+		fmt.Println("Added profile " + name + ", now run: rcrypt -profile=" + name + " register")
+		succeed(ProfileResult{Name: name, APIURL: conf.APIURL, UseTor: conf.UseTor}, 0)
+
+	case "remove":
+		conf, exists := configFile.Profiles[name]
+		if exists == false {
+			fail(ERRCONFIG, "There is no profile named "+name, nil)
+			return
+		}
+
+		if *skipConfirm == false && conf.PrivateKey != "" {
+			fmt.Println("Profile " + name + " holds the only copy of the private key for its account, without it its crypts cannot be decrypted!")
+			fmt.Print("Type 'yes' to continue: ")
+
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if strings.TrimSpace(answer) != "yes" {
+				fail(ERRABORTED, "Not removing profile "+name, nil)
+				return
+			}
+		}
+
+		delete(configFile.Profiles, name)
+		if configFile.DefaultProfile == name {
+			configFile.DefaultProfile = ""
+		}
+		if err := writeConfigFile(configFile); err != nil {
+			fail(ERRLOCAL, "There was an error attempting to write your config file to disk", err)
+			return
+		}
+
+		fmt.Println("Removed profile " + name)
+		succeed(ProfileResult{Name: name}, 0)
+
+	case "default":
+		if _, exists := configFile.Profiles[name]; exists == false {
+			fail(ERRCONFIG, "There is no profile named "+name, nil)
+			return
+		}
+
+		configFile.DefaultProfile = name
+		if err := writeConfigFile(configFile); err != nil {
+			fail(ERRLOCAL, "There was an error attempting to write your config file to disk", err)
+			return
+		}
+
+		fmt.Println("Profile " + name + " is now the default")
+		succeed(ProfileResult{Name: name, Default: true}, 0)
+
+	default:
+		fail(ERRUSAGE, usage, nil)
+	}
+}
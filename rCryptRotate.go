@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"strconv"
+)
+
+// RotateResult describes a key rotation in JSON output
+type RotateResult struct {
+	Fingerprint string   `json:"fingerprint"`
+	Retired     []string `json:"retired_fingerprints,omitempty"`
+	Migrated    []string `json:"migrated"`
+	Skipped     []string `json:"skipped,omitempty"`
+	Failed      []string `json:"failed,omitempty"`
+}
+
+// runKeyRotateCommand handles `rcrypt key rotate`. A new key replaces the
+// accounts key on the server, then every live crypt in the index (bar those
+// stored with -isencrypted) is re-encrypted to it. The old key is kept as a
+// retired key until all of them have been migrated; running rotate again
+// picks up where it left off.
+func runKeyRotateCommand(conf CoreConf, args []string) {
+	usage := "usage: rcrypt key rotate [-keytype=TYPE] [-nopassphrase]"
+	rotateFlags := flag.NewFlagSet("key rotate", flag.ContinueOnError)
+	keyType := rotateFlags.String("keytype", conf.KeyType, "Type of key to generate: rsa2048, rsa3072, rsa4096 or ed25519 (defaults to the current key type)")
+	noPassphrase := rotateFlags.Bool("nopassphrase", false, "Store the new private key without passphrase protection (not recommended)")
+	if err := rotateFlags.Parse(args); err != nil || rotateFlags.NArg() != 0 {
+		fail(ERRUSAGE, usage, err)
+		return
+	}
+
+	if conf.UserID == 0 || conf.PublicKey == "" {
+		fail(ERRCONFIG, "Profile "+activeProfile.Value+" is not registered, use: rcrypt register", nil)
+		return
+	}
+	if conf.KeyBackend == KEYBACKENDGPG {
+		fail(ERRCONFIG, "Your secret key is kept by gpg, rotate it there and switch to it with: rcrypt key gpg -force NEWKEYID", nil)
+		return
+	}
+	if conf.PrivateKey == "" {
+		fail(ERRCONFIG, "Your config file doesn't contain a private key - there is nothing to rotate", nil)
+		return
+	}
+
+	var passphrase []byte
+	var previous *CoreConf
+	if len(conf.RetiredKeys) == 0 {
+		rotated, newPassphrase, ok := rotateKey(conf, *keyType, *noPassphrase)
+		if ok == false {
+			return
+		}
+		original := conf
+		previous = &original
+		conf, passphrase = rotated, newPassphrase
+	} else {
+		fmt.Println("Resuming the migration of your crypts to " + conf.Fingerprint)
+	}
+
+	result := RotateResult{Fingerprint: conf.Fingerprint, Migrated: []string{}}
+	for _, retired := range conf.RetiredKeys {
+		result.Retired = append(result.Retired, retired.Fingerprint)
+	}
+
+	index, err := readIndex()
+	if err != nil {
+		fail(ERRLOCAL, "There was an error reading your crypt index", err)
+		return
+	}
+	book, err := readContacts()
+	if err != nil {
+		fail(ERRLOCAL, "There was an error reading your contacts", err)
+		return
+	}
+
+	// Challenges are answered with whichever of the new and retired keys the
+	// server encrypted them to, so one client does before and after the rekey
+	client := newClient(conf)
+	if passphrase != nil {
+		client.Credentials.Passphrase = func() ([]byte, error) { return passphrase, nil }
+	}
+
+	if conf.RekeyPending == true {
+		if _, err = client.Rekey(conf.PublicKey); err != nil {
+			if previous != nil && rekeyRefused(err) == true {
+				if writeErr := writeConfig(*previous); writeErr != nil {
+					fmt.Println("There was an error restoring your config file, your old key is retired in it:", writeErr)
+				}
+				failAPI("The server refused your new key, your old key has been kept;", err)
+				return
+			}
+
+			// The server may have switched keys before the reply was lost
+			failAPI("There was an error registering your new key. Both keys have been kept in case the server switched to the new one, run rcrypt key rotate again to retry;", err)
+			return
+		}
+
+		conf.RekeyPending = false
+		if err = writeConfig(conf); err != nil {
+			fail(ERRLOCAL, "There was an error attempting to write your config file to disk", err)
+			return
+		}
+		fmt.Println("Registered your new key " + conf.Fingerprint + ", your old key is kept until every crypt has been re-encrypted")
+		fmt.Println("If rcrypt daemon is running send it a SIGHUP (or restart it), until then it can't check in with the old key")
+	}
+
+	var live []IndexEntry
+	for _, entry := range index.Crypts {
+		if entry.IsDestroyed == false {
+			live = append(live, entry)
+		}
+	}
+
+	var lastErr error
+	for i, entry := range live {
+		progress := "[" + strconv.Itoa(i+1) + "/" + strconv.Itoa(len(live)) + "] " + entry.CryptID
+
+		if entry.PreEncrypted == true {
+			fmt.Println(progress + " skipped: it was stored with -isencrypted, so its contents are encrypted to whatever key you chose rather than your account key")
+			result.Skipped = append(result.Skipped, entry.CryptID)
+			continue
+		}
+
+		err := reencryptEntry(client, book, entry)
+		switch {
+		case err == nil:
+			fmt.Println(progress + " re-encrypted")
+			result.Migrated = append(result.Migrated, entry.CryptID)
+		case ripacrypt.KindOf(err) == ripacrypt.KindDestroyed, ripacrypt.KindOf(err) == ripacrypt.KindNotFound:
+			// Nothing left to migrate, a server may forget destroyed crypts
+			fmt.Println(progress + " has been destroyed")
+			recordDestroyed(entry.CryptID)
+		default:
+			fmt.Println(progress+" failed:", err)
+			result.Failed = append(result.Failed, entry.CryptID)
+			lastErr = err
+		}
+	}
+
+	if len(result.Failed) > 0 {
+		failAPI(strconv.Itoa(len(result.Failed))+" of "+strconv.Itoa(len(live))+" crypts could not be re-encrypted, your old key has been kept so they can still be read. Run rcrypt key rotate again to retry", lastErr)
+		report.Result = result
+		return
+	}
+
+	conf.RetiredKeys = nil
+	if err = writeConfig(conf); err != nil {
+		fail(ERRLOCAL, "There was an error attempting to write your config file to disk", err)
+		return
+	}
+
+	fmt.Println("Every crypt has been re-encrypted to " + conf.Fingerprint + ", your old key has been removed")
+	succeed(result, 0)
+}
+
+// rotateKey generates a new key with the same identity as the current one,
+// blinding its creation time if the current one was. The returned config,
+// already written to disk, has the new key with the old one retired, both
+// protected by the returned passphrase (nil with noPassphrase), and is marked
+// RekeyPending until the server has been told of the new key.
+func rotateKey(conf CoreConf, keyType string, noPassphrase bool) (CoreConf, []byte, bool) {
+	packetConf, err := packetConfig(keyType, conf.Cipher, conf.Compression)
+	if err != nil {
+		fail(ERRUSAGE, "There was an error choosing the key type", err)
+		return conf, nil, false
+	}
+
+	oldKey, err := ripacrypt.UnlockPrivateKey(conf.PrivateKey, promptPassphrase)
+	if err != nil {
+		fail(ERRCRYPTO, "There was an error unlocking your private key", err)
+		return conf, nil, false
+	}
+
+	entityList, err := ripacrypt.ReadKeyRing(conf.PublicKey)
+	if err != nil {
+		fail(ERRCONFIG, "There was an error reading the public key in your config", err)
+		return conf, nil, false
+	}
+	var name, comment, email string
+	for _, id := range entityList[0].Identities {
+		name, comment, email = id.UserId.Name, id.UserId.Comment, id.UserId.Email
+		break
+	}
+	if isKeyTimeBlinded(entityList[0]) == true {
+		blindKeyTime(packetConf)
+	}
+
+	fmt.Println("Generating your new key")
+	entity, publicKey, privateKey, err := generateKey(name, comment, email, packetConf)
+	if err != nil {
+		fail(ERRCRYPTO, "There was an error generating your new key", err)
+		return conf, nil, false
+	}
+
+	retired := ripacrypt.RetiredKey{Fingerprint: conf.Fingerprint, PublicKey: conf.PublicKey, PrivateKey: oldKey}
+	var passphrase []byte
+	if noPassphrase == false {
+		// The old key is kept under the new passphrase so one unlocks both
+		if passphrase, err = promptNewPassphrase(); err != nil {
+			fail(ERRCRYPTO, "There was an error reading the passphrase for your new key", err)
+			return conf, nil, false
+		}
+		privateKey, err = ripacrypt.ProtectPrivateKey(privateKey, passphrase)
+		if err == nil {
+			retired.PrivateKey, err = ripacrypt.ProtectPrivateKey(oldKey, passphrase)
+		}
+		if err != nil {
+			fail(ERRCRYPTO, "There was an error protecting your private key with your passphrase", err)
+			return conf, nil, false
+		}
+	}
+
+	rotated := conf
+	rotated.Fingerprint = ripacrypt.KeyFingerprint(entity.PrimaryKey)
+	rotated.PublicKey = publicKey
+	rotated.PrivateKey = privateKey
+	rotated.KeyType = keyType
+	rotated.RetiredKeys = []ripacrypt.RetiredKey{retired}
+	rotated.RekeyPending = true
+
+	// Written before the server learns of the new key, so it can't be lost
+	if err = writeConfig(rotated); err != nil {
+		fail(ERRLOCAL, "There was an error attempting to write your config file to disk", err)
+		return conf, nil, false
+	}
+	return rotated, passphrase, true
+}
+
+// rekeyRefused reports whether a failed rekey was turned down by the server,
+// so it certainly still has the old key. Anything else, such as a timeout,
+// might have happened after the server switched.
+func rekeyRefused(err error) bool {
+	statusCode := ripacrypt.StatusCodeOf(err)
+	return ripacrypt.KindOf(err) == ripacrypt.KindAuth || (statusCode >= 400 && statusCode < 500)
+}
+
+// reencryptEntry re-encrypts a crypt from the index, and any chunks behind
+// it, to the clients key and the keys it was shared with
+func reencryptEntry(client *ripacrypt.Client, book ContactBook, entry IndexEntry) error {
+	client.Recipients = nil
+	for i, fingerprint := range entry.Recipients {
+		if i < len(entry.RecipientKeys) {
+			client.Recipients = append(client.Recipients, entry.RecipientKeys[i])
+			continue
+		}
+
+		// Indexed before the keys were recorded
+		contact := book.Find(fingerprint)
+		if contact == nil {
+			return errors.New("recipient " + fingerprint + " is no longer in your contacts")
+		}
+		client.Recipients = append(client.Recipients, contact.PublicKey)
+	}
+
+	// The manifest goes last so a chunked payload is only complete once every
+	// chunk has been done
+	for _, cryptID := range append(append([]string{}, entry.Chunks...), entry.CryptID) {
+		if _, err := client.Reencrypt(cryptID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
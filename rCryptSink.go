@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// secretSink is where `get -out` and `get -pipe` send the exact bytes of a
+// crypt. Nothing is left behind unless Commit is called, so a failed or
+// tampered download never looks like a good one.
+type secretSink struct {
+	w io.Writer
+
+	// For -out=path the data goes to tmp and is renamed over path
+	tmp   *os.File
+	path  string
+	force bool
+
+	// For -pipe the data goes to the stdin of cmd
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	done bool
+}
+
+// openSecretSink prepares the destination chosen by -out or -pipe (only one
+// of which may be set), or returns nil if the plaintext should be printed as
+// before. An existing file is only replaced if force is set.
+func openSecretSink(outPath, pipeCommand string, force bool) (*secretSink, error) {
+	switch {
+	case pipeCommand != "":
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", pipeCommand)
+		} else {
+			cmd = exec.Command("/bin/sh", "-c", pipeCommand)
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &secretSink{w: stdin, cmd: cmd, stdin: stdin}, nil
+
+	case outPath == "-":
+		return &secretSink{w: os.Stdout}, nil
+
+	case outPath != "":
+		if _, err := os.Lstat(outPath); err == nil && force == false {
+			return nil, fmt.Errorf("%s already exists, use -force to overwrite it", outPath)
+		}
+
+		tmp, err := ioutil.TempFile(filepath.Dir(outPath), "."+filepath.Base(outPath)+".tmp")
+		if err != nil {
+			return nil, err
+		}
+		if err = tmp.Chmod(0600); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+		return &secretSink{w: tmp, tmp: tmp, path: outPath, force: force}, nil
+	}
+
+	return nil, nil
+}
+
+func (s *secretSink) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+// Commit finishes a successful write: the file is moved into place, and
+// recorded for rcrypt panic to shred, or the command is told the data is
+// complete and waited for
+func (s *secretSink) Commit() error {
+	s.done = true
+
+	switch {
+	case s.cmd != nil:
+		s.stdin.Close()
+		if err := s.cmd.Wait(); err != nil {
+			return fmt.Errorf("%s: %v", s.cmd.Args[len(s.cmd.Args)-1], err)
+		}
+
+	case s.tmp != nil:
+		defer os.Remove(s.tmp.Name())
+
+		if err := s.tmp.Sync(); err != nil {
+			s.tmp.Close()
+			return err
+		}
+		if err := s.tmp.Close(); err != nil {
+			return err
+		}
+
+		// Don't clobber anything created while we were downloading
+		if _, err := os.Lstat(s.path); err == nil && s.force == false {
+			return fmt.Errorf("%s already exists, use -force to overwrite it", s.path)
+		}
+		if err := os.Rename(s.tmp.Name(), s.path); err != nil {
+			return err
+		}
+		recordSaved(s.path)
+	}
+	return nil
+}
+
+// Abort throws away whatever has been written. The command is killed before
+// it sees the end of its input, so it can't mistake partial data for the
+// real thing. Once committed this does nothing.
+func (s *secretSink) Abort() {
+	if s.done == true {
+		return
+	}
+	s.done = true
+
+	switch {
+	case s.cmd != nil:
+		s.cmd.Process.Kill()
+		s.stdin.Close()
+		s.cmd.Wait()
+
+	case s.tmp != nil:
+		s.tmp.Close()
+		os.Remove(s.tmp.Name())
+	}
+}
+
+// Path returns the file the data is written to, if any. Stdout and a piped
+// command belong to the data so nothing else should be printed there.
+func (s *secretSink) Path() string {
+	return s.path
+}
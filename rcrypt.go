@@ -1,19 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"crypto"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"golang.org/x/crypto/openpgp"
-	"golang.org/x/crypto/openpgp/armor"
-	"golang.org/x/crypto/openpgp/packet"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
+	"text/tabwriter"
 	"time"
 )
 
@@ -25,44 +26,71 @@ type CoreConf struct {
 	PublicKey   string `json:"public_key"`
 	PrivateKey  string `json:"private_key"`
 	Fingerprint string `json:"fingerprint"`
-}
-
-const (
-	// RIPACRYPTURL is the base URL for all queries
-	RIPACRYPTURL = "https://ripacrypt.download/1/"
-
-	//HSURL is the base URL for the Tor Hidden Service instance
-	HSURL = "http://rcryptrz2t2gpxq7.onion/1/"
-
-	// CLIENTVERSION is not currently used but useful to have
-	CLIENTVERSION = "1.0.0"
-
-	// TORSOCKS defines the SOCKS5 host we use if a user wants to use Tor
-	TORSOCKS = "localhost:9050"
-)
 
-var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	// KeyBackend is where the secret key is kept: empty for PrivateKey above,
+	// or "gpg" for the GnuPG keyring (via gpg-agent) under GPGKey
+	KeyBackend string `json:"key_backend,omitempty"`
+	GPGKey     string `json:"gpg_key,omitempty"`
+	GPGPath    string `json:"gpg_path,omitempty"`
+
+	// KeyType is the -keytype the key was generated with, Cipher and
+	// Compression are used for every payload stored
+	KeyType     string `json:"key_type,omitempty"`
+	Cipher      string `json:"cipher,omitempty"`
+	Compression string `json:"compression,omitempty"`
+
+	// RetiredKeys are keys rotated away from by `rcrypt key rotate` which
+	// still decrypt crypts that have not been re-encrypted yet
+	RetiredKeys []ripacrypt.RetiredKey `json:"retired_keys,omitempty"`
+
+	// RekeyPending is set while the server may not know the current key yet,
+	// `rcrypt key rotate` registers it again until the server confirms it
+	RekeyPending bool `json:"rekey_pending,omitempty"`
+
+	// Optional overrides for self hosted or staging instances of RIPACrypt
+	APIURL    string `json:"api_url,omitempty"`
+	OnionURL  string `json:"onion_url,omitempty"`
+	SOCKSAddr string `json:"socks_addr,omitempty"`
+}
 
 func main() {
 
-	rand.Seed(time.Now().UnixNano())
+	// Global flags
+	// These come before the command and apply to every command, e.g.
+	// rcrypt -socks=localhost:9150 checkin -usetor -crypt=CRYPTID
+	globalFlags := flag.NewFlagSet("rcrypt", flag.ContinueOnError)
+	apiURLFlag := globalFlags.String("url", "", "Base URL of the RIPACrypt API (or "+APIURLENV+")")
+	onionURLFlag := globalFlags.String("onionurl", "", "Base URL of the RIPACrypt Tor hidden service (or "+ONIONURLENV+")")
+	socksFlag := globalFlags.String("socks", "", "host:port of the Tor SOCKS5 proxy (or "+SOCKSENV+")")
+	configFlag := globalFlags.String("config", "", "Path to rc.conf, other local state is kept alongside it (or "+CONFIGENV+")")
+	profileFlag := globalFlags.String("profile", "", "Name of the profile (account) to use (or "+PROFILEENV+")")
+	outputFlag := globalFlags.String("output", "text", "Output format, text or json (a single JSON document on stdout)")
 
 	// Register
 	// Creates a new account on the RIPACrypt platform with a public GPG key.
 	// If a public key is not provided then a public private GPG key pair is generated (the recommended default)
-	registerCommand := flag.NewFlagSet("register", flag.ExitOnError)
+	registerCommand := flag.NewFlagSet("register", flag.ContinueOnError)
 	publicKeyFlag := registerCommand.String("publickey", "", "Path to the GPG public key to register")
+	secretKeyFlag := registerCommand.String("secretkey", "", "Path to the GPG secret key (armoured or binary) to use instead of generating one")
+	gpgKeyFlag := registerCommand.String("gpgkey", "", "ID or fingerprint of a key in your GnuPG keyring to use, the secret key stays in gpg")
+	gpgPathFlag := registerCommand.String("gpgpath", "", "The gpg binary to use with -gpgkey (defaults to gpg from your PATH)")
+	keyTypeFlag := registerCommand.String("keytype", "rsa2048", "Type of key to generate, rsa2048, rsa3072, rsa4096 or ed25519")
+	cipherFlag := registerCommand.String("cipher", "aes256", "Cipher to encrypt crypts with and to prefer in a generated key, aes256 or aes128")
+	compressionFlag := registerCommand.String("compression", "none", "Compression to apply to crypts and to prefer in a generated key, none, zip or zlib")
 	useTorToRegister := registerCommand.Bool("usetor", false, "Enforce use of Tor SOCKS5 proxy")
 	username := registerCommand.String("name", "Anonymous", "Your name (we recommend against setting this)")
 	comment := registerCommand.String("comment", "", "A comment to add to your GPG key (we recommend against setting this)")
 	email := registerCommand.String("email", "", "The 'email' address for your GPG key (we recommend against setting this)")
+	noEmail := registerCommand.Bool("noemail", false, "Leave the email address out of your generated key instead of using a random one")
+	blindTime := registerCommand.Bool("blindtime", false, "Give your generated key a fixed creation time instead of the current time")
 	debugRegister := registerCommand.Bool("debug", false, "See full JSON API response")
+	noPassphrase := registerCommand.Bool("nopassphrase", false, "Store the generated private key without passphrase protection (not recommended)")
 
 	// New Crypt
 	// Stores data in a new crypt.
 	// Unless overridden bu the -isencrypted flag data will be encrypted with the GPG public key before upload
 	// The -checkinduration and -misscount flags will define how long a crypt can live before being destroyed
-	newCommand := flag.NewFlagSet("new", flag.ExitOnError)
+	newCommand := flag.NewFlagSet("new", flag.ContinueOnError)
 	dataToStoreFlag := newCommand.String("data", "", "Path to the plaintext you wish to encrypt and store in a crypt (or STDIN)")
 	preEncryptedFlag := newCommand.Bool("isencrypted", false, "Is data already encrypted?")
 	useTorForNew := newCommand.Bool("usetor", false, "Enforce use of Tor SOCKS5 proxy")
@@ -70,27 +98,39 @@ func main() {
 	checkInDurationFlag := newCommand.Int64("checkinduration", 86400, "Minimum time in seconds allowed between checkins")
 	missCountFlag := newCommand.Int64("misscount", 3, "Maximim number of check-ins allowed before the crypt is destroyed")
 	debugNewCrypt := newCommand.Bool("debug", false, "See full JSON API response")
+	sharesFlag := newCommand.Int("shares", 0, "Split the data into this many shares, each stored in its own crypt")
+	thresholdFlag := newCommand.Int("threshold", 0, "Number of shares needed to recover the data (defaults to a majority)")
+	shareDurationsFlag := newCommand.String("checkindurations", "", "Comma separated checkin duration for each share (defaults to -checkinduration)")
+	shareMissCountsFlag := newCommand.String("misscounts", "", "Comma separated miss count for each share (defaults to -misscount)")
+	chunkSizeFlag := newCommand.Int("chunksize", ripacrypt.CHUNKSIZE, "Split data larger than this many bytes across several crypts")
+	var recipientsFlag stringList
+	newCommand.Var(&recipientsFlag, "recipient", "Also encrypt to this public key file or contact (repeatable)")
 
 	// Checkin TODO
 	// Performs a "check in" which will reset the clock on a crypts self-destruction
-	checkinCommand := flag.NewFlagSet("checkin", flag.ExitOnError)
+	checkinCommand := flag.NewFlagSet("checkin", flag.ContinueOnError)
 	cryptIDFlag := checkinCommand.String("crypt", "", "ID of the crypt")
 	useTorToCheckin := checkinCommand.Bool("usetor", false, "Enforce use of Tor SOCKS5 proxy")
 	debugCheckin := checkinCommand.Bool("debug", false, "See full JSON API response")
 
 	// Get
 	// Gets the crypt and decrypts it
-	getCommand := flag.NewFlagSet("get", flag.ExitOnError)
+	getCommand := flag.NewFlagSet("get", flag.ContinueOnError)
 	cryptIDGet := getCommand.String("crypt", "", "ID of the crypt")
 	useTorToGet := getCommand.Bool("usetor", false, "Enforce use of Tor SOCKS5 proxy")
 	debugGet := getCommand.Bool("debug", false, "See full JSON API response")
 	decryptGet := getCommand.Bool("decrypt", true, "Automatically decrypt the contents of the crypt")
+	groupGet := getCommand.String("group", "", "ID of a share group to recombine instead of a single crypt")
+	outGet := getCommand.String("out", "", "Write the exact contents of the crypt to this file (or - for stdout) instead of printing them")
+	pipeGet := getCommand.String("pipe", "", "Feed the exact contents of the crypt to the stdin of this command, they never touch the disk")
+	forceGet := getCommand.Bool("force", false, "Overwrite the -out file if it already exists")
+	allowUnsignedGet := getCommand.Bool("allowunsigned", false, "Accept crypts without a signature, as stored by older versions of rcrypt")
 
 	// Challenge
 	// All write actions on RIPACrypt require the decryption of a challenge text which is sent by the server.
 	// This challenge is encrypted with the users public key.
 	// The API endpoint is publicly available so we might as well make it available to the client too.
-	challengeCommand := flag.NewFlagSet("getchallenge", flag.ExitOnError)
+	challengeCommand := flag.NewFlagSet("getchallenge", flag.ContinueOnError)
 	useTorForChallenge := challengeCommand.Bool("usetor", false, "Enforce use of Tor SOCKS5 proxy")
 	decryptChallenge := challengeCommand.Bool("decrypt", false, "Decrypt the challenge and display the cleartext")
 	debugChallenge := challengeCommand.Bool("debug", false, "See full JSON API response")
@@ -99,44 +139,231 @@ func main() {
 	// Ideally each transaction one makes with bitcoin should be to a new address
 	// to foil correlation. When adding more storage to your account (or to donate
 	// you should generate a new bitcoin address each time.
-	newBTCCommand := flag.NewFlagSet("newbtc", flag.ExitOnError)
+	newBTCCommand := flag.NewFlagSet("newbtc", flag.ContinueOnError)
 	useTorForNewBTC := newBTCCommand.Bool("usetor", false, "Enforce use of Tor SOCKS5 proxy")
 	debugNewBTC := newBTCCommand.Bool("debug", false, "See full JSON API response")
 
-	// Destroy TODO
-	// The MVP won't include an explicit destroy call
+	// Destroy
+	// Asks the server to wipe a crypt immediately rather than waiting for the
+	// deadline to pass. This cannot be undone so we ask for confirmation first.
+	destroyCommand := flag.NewFlagSet("destroy", flag.ContinueOnError)
+	cryptIDDestroy := destroyCommand.String("crypt", "", "ID of the crypt")
+	useTorToDestroy := destroyCommand.Bool("usetor", false, "Enforce use of Tor SOCKS5 proxy")
+	skipConfirmDestroy := destroyCommand.Bool("yes", false, "Do not ask for confirmation before destroying the crypt")
+	debugDestroy := destroyCommand.Bool("debug", false, "See full JSON API response")
+
+	// Daemon
+	// Runs in the foreground checking in with every crypt listed in a file well
+	// before its deadline. Send SIGHUP to reload the list and SIGTERM to stop.
+	daemonCommand := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	cryptListDaemon := daemonCommand.String("crypts", "", "Path to a file listing one crypt ID per line (default ~/.ripacrypt/crypts.list, or crypts-PROFILE.list)")
+	useTorForDaemon := daemonCommand.Bool("usetor", false, "Enforce use of Tor SOCKS5 proxy")
+	debugDaemon := daemonCommand.Bool("debug", false, "Log each crypts deadline")
+	panicDaemon := daemonCommand.Bool("panic", false, "Wipe the profile, as rcrypt panic does, as soon as a watched crypt has been destroyed")
+	panicDestroyDaemon := daemonCommand.Bool("panicdestroy", false, "As -panic, but destroy every other crypt before wiping the profile")
+
+	// Panic
+	// Overwrites and deletes the private key, crypt index and contacts of the
+	// profile, optionally destroying its crypts first
+	panicCommand := flag.NewFlagSet("panic", flag.ContinueOnError)
+	destroyPanic := panicCommand.Bool("destroy", false, "Destroy every crypt in your index before wiping the profile")
+	useTorToPanic := panicCommand.Bool("usetor", false, "Enforce use of Tor SOCKS5 proxy")
+	skipConfirmPanic := panicCommand.Bool("yes", false, "Do not ask for confirmation before wiping the profile")
+
+	// Passwd
+	// Changes (or adds) the passphrase protecting the private key in rc.conf
+	passwdCommand := flag.NewFlagSet("passwd", flag.ContinueOnError)
+	removePassphrase := passwdCommand.Bool("nopassphrase", false, "Remove passphrase protection from your private key (not recommended)")
+
+	// List
+	// Shows every crypt recorded in the local index and how long each has left
+	listCommand := flag.NewFlagSet("list", flag.ContinueOnError)
+
+	// Status
+	// Fetches a crypt from the server and shows how long it has left
+	statusCommand := flag.NewFlagSet("status", flag.ContinueOnError)
+	cryptIDStatus := statusCommand.String("crypt", "", "ID of the crypt")
+	useTorForStatus := statusCommand.Bool("usetor", false, "Enforce use of Tor SOCKS5 proxy")
+	debugStatus := statusCommand.Bool("debug", false, "See full JSON API response")
+
+	// Config
+	// Inspects the client configuration
+	configCommand := flag.NewFlagSet("config", flag.ContinueOnError)
+
+	// Profile
+	// Manages the named profiles (one per account) kept in rc.conf
+	profileCommand := flag.NewFlagSet("profile", flag.ContinueOnError)
+
+	// Contact
+	// Manages the public keys of people who can be made recipients of crypts
+	contactCommand := flag.NewFlagSet("contact", flag.ContinueOnError)
+
+	// Key
+	// Manages the key pair of the account
+	keyCommand := flag.NewFlagSet("key", flag.ContinueOnError)
+
+	// Whoami
+	// Shows the account and key the active profile uses
+	whoamiCommand := flag.NewFlagSet("whoami", flag.ContinueOnError)
+
+	// Backup
+	// Exports the profile, crypt index and contacts as an encrypted file
+	backupCommand := flag.NewFlagSet("backup", flag.ContinueOnError)
+	outBackup := backupCommand.String("out", "", "Path to write the passphrase encrypted backup to")
+	forceBackup := backupCommand.Bool("force", false, "Overwrite the -out file if it already exists")
+
+	// Restore
+	// Installs a backup as the active profile
+	restoreCommand := flag.NewFlagSet("restore", flag.ContinueOnError)
+	inRestore := restoreCommand.String("in", "", "Path of the backup written by rcrypt backup")
+	forceRestore := restoreCommand.Bool("force", false, "Replace the profile even if it is already registered")
+
+	// Export paper
+	// Prints the account as checksummed lines of text and QR codes
+	exportPaperCommand := flag.NewFlagSet("export-paper", flag.ContinueOnError)
+	outExportPaper := exportPaperCommand.String("out", "", "Path to write the paper key to instead of printing it")
+	pngExportPaper := exportPaperCommand.String("png", "", "Also write the paper key as QR codes named PREFIX-01.png, PREFIX-02.png...")
+	forceExportPaper := exportPaperCommand.Bool("force", false, "Overwrite the -out and -png files if they already exist")
+	noPassphraseExportPaper := exportPaperCommand.Bool("nopassphrase", false, "Leave an unprotected private key unprotected on paper (not recommended)")
+
+	// Import paper
+	// Rebuilds the account from the lines of a paper key
+	importPaperCommand := flag.NewFlagSet("import-paper", flag.ContinueOnError)
+	inImportPaper := importPaperCommand.String("in", "", "Path of the typed or scanned paper key (defaults to stdin)")
+	forceImportPaper := importPaperCommand.Bool("force", false, "Replace the profile even if it is already registered")
 
 	//Grab what the user wants to do
-	if len(os.Args) == 1 {
-		fmt.Println("usage: ripacrypt <command> [<args>]")
+	if globalFlagsErr := globalFlags.Parse(os.Args[1:]); globalFlagsErr != nil {
+		os.Exit(2)
+	}
+	args := globalFlags.Args()
+
+	if outputErr := setOutput(*outputFlag); outputErr != nil {
+		fmt.Println(outputErr)
+		os.Exit(2)
+	}
+
+	if len(args) == 0 {
+		defer finish()
+		fail(ERRUSAGE, "No command given", nil)
+		fmt.Println("usage: ripacrypt [-config=PATH] [-profile=NAME] [-url=URL] [-onionurl=URL] [-socks=host:port] [-output=text|json] <command> [<args>]")
 		fmt.Println("The most commonly used commands are: ")
 		fmt.Println(" register \t\tRegister a new crypto key pair")
 		fmt.Println(" new \t\t\tCreate a new crypt")
 		fmt.Println(" checkin \t\tKeep a crypt alive")
 		fmt.Println(" destroy \t\tDestroys a crypt immediately")
+		fmt.Println(" daemon \t\tKeep a list of crypts alive until stopped")
+		fmt.Println(" panic \t\t\tWipe your private key and crypt index, optionally destroying your crypts")
 		fmt.Println(" getchallenge \t\tRequest an encrypted challenge")
 		fmt.Println(" newbtc \t\tGenerate a new Bitcoin address for your account")
+		fmt.Println(" passwd \t\tChange the passphrase protecting your private key")
+		fmt.Println(" list \t\t\tList the crypts you have created")
+		fmt.Println(" status \t\tShow how long a crypt has until it is destroyed")
+		fmt.Println(" config show \t\tShow the effective API endpoints and where they came from")
+		fmt.Println(" profile \t\tList, add, remove or choose the default profile")
+		fmt.Println(" contact \t\tList, add or remove the people crypts can be shared with")
+		fmt.Println(" key import \t\tUse an existing secret key with your account")
+		fmt.Println(" key gpg \t\tLeave your secret key in GnuPG and use it via gpg")
+		fmt.Println(" key rotate \t\tReplace your key and re-encrypt your crypts to the new one")
+		fmt.Println(" whoami \t\tShow your user ID, key fingerprint and key algorithm")
+		fmt.Println(" backup \t\tWrite your account and crypt index to an encrypted file")
+		fmt.Println(" restore \t\tInstall an account from a backup")
+		fmt.Println(" export-paper \t\tPrint your account as text and QR codes for cold storage")
+		fmt.Println(" import-paper \t\tRebuild your account from a paper key")
+		return
+	}
+
+	report.Command = args[0]
+	defer finish()
+
+	configPath = resolveConfigPath(*configFlag)
+	configFile, configErr := readConfig()
+	if configErr != nil {
+		fail(ERRCONFIG, "There was an error reading your config file", configErr)
 		return
 	}
 
-	conf := readConfig()
+	activeProfile = resolveSetting("profile", *profileFlag, PROFILEENV, configFile.DefaultProfile, DEFAULTPROFILE)
+	if profileErr := validateProfileName(activeProfile.Value); profileErr != nil {
+		fail(ERRUSAGE, "Invalid profile name "+activeProfile.Value, profileErr)
+		return
+	}
+
+	// register creates the profile, anything else needs it to exist
+	conf, profileExists := configFile.Profiles[activeProfile.Value]
+	if profileExists == false && activeProfile.Source != "default" && args[0] != "register" && args[0] != "profile" && args[0] != "restore" && args[0] != "import-paper" {
+		fail(ERRCONFIG, "There is no profile named "+activeProfile.Value+" (from "+activeProfile.Source+"), see rcrypt profile list", nil)
+		return
+	}
 
-	switch os.Args[1] {
+	endpoints, endpointsErr := resolveEndpoints(conf, *apiURLFlag, *onionURLFlag, *socksFlag)
+	if endpointsErr != nil {
+		fail(ERRCONFIG, "There was an error in your endpoint configuration", endpointsErr)
+		return
+	}
+	effectiveEndpoints = endpoints
+
+	if conf.KeyBackend != "" && conf.KeyBackend != KEYBACKENDGPG {
+		fail(ERRCONFIG, "Unknown key_backend "+conf.KeyBackend+" in profile "+activeProfile.Value+", it must be empty or "+KEYBACKENDGPG, nil)
+		return
+	}
+	if _, prefErr := packetConfig("", conf.Cipher, conf.Compression); prefErr != nil {
+		fail(ERRCONFIG, "Invalid cipher or compression in profile "+activeProfile.Value, prefErr)
+		return
+	}
+
+	var parseErr error
+	switch args[0] {
 	case "register":
-		registerCommand.Parse(os.Args[2:])
+		parseErr = registerCommand.Parse(args[1:])
 	case "new":
-		newCommand.Parse(os.Args[2:])
+		parseErr = newCommand.Parse(args[1:])
 	case "checkin":
-		checkinCommand.Parse(os.Args[2:])
+		parseErr = checkinCommand.Parse(args[1:])
 	case "get":
-		getCommand.Parse(os.Args[2:])
+		parseErr = getCommand.Parse(args[1:])
 	case "getchallenge":
-		challengeCommand.Parse(os.Args[2:])
+		parseErr = challengeCommand.Parse(args[1:])
 	case "newbtc":
-		newBTCCommand.Parse(os.Args[2:])
+		parseErr = newBTCCommand.Parse(args[1:])
+	case "destroy":
+		parseErr = destroyCommand.Parse(args[1:])
+	case "daemon":
+		parseErr = daemonCommand.Parse(args[1:])
+	case "panic":
+		parseErr = panicCommand.Parse(args[1:])
+	case "passwd":
+		parseErr = passwdCommand.Parse(args[1:])
+	case "list":
+		parseErr = listCommand.Parse(args[1:])
+	case "status":
+		parseErr = statusCommand.Parse(args[1:])
+	case "config":
+		parseErr = configCommand.Parse(args[1:])
+	case "profile":
+		parseErr = profileCommand.Parse(args[1:])
+	case "contact":
+		parseErr = contactCommand.Parse(args[1:])
+	case "key":
+		parseErr = keyCommand.Parse(args[1:])
+	case "whoami":
+		parseErr = whoamiCommand.Parse(args[1:])
+	case "backup":
+		parseErr = backupCommand.Parse(args[1:])
+	case "restore":
+		parseErr = restoreCommand.Parse(args[1:])
+	case "export-paper":
+		parseErr = exportPaperCommand.Parse(args[1:])
+	case "import-paper":
+		parseErr = importPaperCommand.Parse(args[1:])
 	default:
-		fmt.Printf("%q is not valid command.\n", os.Args[1])
-		os.Exit(2)
+		fail(ERRUSAGE, fmt.Sprintf("%q is not valid command.", args[0]), nil)
+		return
+	}
+
+	if parseErr != nil {
+		fail(ERRUSAGE, "Invalid arguments for "+args[0], parseErr)
+		return
 	}
 
 	// Register -----------------------------------------------------------------
@@ -144,66 +371,107 @@ func main() {
 
 		//Check we're not about to overwrite our config!
 		if conf.UserID != 0 {
-			fmt.Println("Your config file indicates a userid is already registered. Please check ~/.ripacrypt/rc.conf")
+			fail(ERRCONFIG, "Your config file indicates a userid is already registered for profile "+activeProfile.Value+". Please check "+configPath.Value+" or register another account with -profile=NAME", nil)
 			return
 		}
 
-		var PublicKey, PrivateKey, PublicKeyFingerprint string
-		if *publicKeyFlag == "" {
-			if *debugRegister == true {
-				fmt.Println("No public key passed - generating our own one")
+		packetConf, prefErr := packetConfig(*keyTypeFlag, *cipherFlag, *compressionFlag)
+		if prefErr != nil {
+			fail(ERRUSAGE, "Invalid key type, cipher or compression", prefErr)
+			return
+		}
+
+		// They would silently leave an existing key as identifying as it was
+		if (*noEmail == true || *blindTime == true) && (*publicKeyFlag != "" || *secretKeyFlag != "" || *gpgKeyFlag != "") {
+			fail(ERRUSAGE, "-noemail and -blindtime only apply to a generated key, they cannot be used with -publickey, -secretkey or -gpgkey", nil)
+			return
+		}
+
+		var PublicKey, PrivateKey, PublicKeyFingerprint, KeyType string
+		useGPG := false
+		if *gpgKeyFlag != "" {
+			if *publicKeyFlag != "" || *secretKeyFlag != "" {
+				fail(ERRUSAGE, "-gpgkey cannot be used with -publickey or -secretkey", nil)
+				return
 			}
-			var newEmail string
 
-			if *email == "" {
-				newEmail = RandStringRunes(24) + "@clients.ripacrypt.download"
-			} else {
-				newEmail = *email
+			var gpgErr error
+			PublicKey, PublicKeyFingerprint, gpgErr = useGPGKey(*gpgKeyFlag, *gpgPathFlag, "")
+			if gpgErr != nil {
+				fail(ERRCRYPTO, "There was an error using your gpg key", gpgErr)
+				return
 			}
-			packetConf := packet.Config{DefaultHash: crypto.SHA256}
-			pgpEntity, pgpGenErr := openpgp.NewEntity(*username, *comment, newEmail, &packetConf)
-			if pgpGenErr != nil {
-				fmt.Println("There was an error generating a new GPG key for you")
-				fmt.Println(pgpGenErr)
+			fmt.Println("Using the key from gpg with fingerprint ", PublicKeyFingerprint)
+			useGPG = true
+		} else if *secretKeyFlag != "" {
+			if *publicKeyFlag != "" {
+				b, fileReadErr := ioutil.ReadFile(*publicKeyFlag)
+				if fileReadErr != nil {
+					fail(ERRLOCAL, "There was an error processing your public key", fileReadErr)
+					return
+				}
+				PublicKey = string(b)
+			}
+
+			imported, importErr := importSecretKey(*secretKeyFlag, PublicKey, *noPassphrase)
+			if importErr != nil {
+				fail(ERRCRYPTO, "There was an error importing your secret key", importErr)
 				return
 			}
+			if PublicKey == "" {
+				PublicKey = imported.PublicKey
+			}
+			PrivateKey = imported.PrivateKey
+			PublicKeyFingerprint = imported.Fingerprint
+			fmt.Println("Successfully imported your Secret Key with fingerprint ", PublicKeyFingerprint)
+		} else if *publicKeyFlag == "" {
 			if *debugRegister == true {
-				fmt.Println("Signing identities")
+				fmt.Println("No public key passed - generating our own one")
 			}
-			for _, id := range pgpEntity.Identities {
-				err := id.SelfSignature.SignUserId(id.UserId.Id, pgpEntity.PrimaryKey, pgpEntity.PrivateKey, nil)
-				if err != nil {
-					fmt.Println(err)
+			newEmail := *email
+			if *noEmail == true && newEmail != "" {
+				fail(ERRUSAGE, "Cannot use -email with -noemail", nil)
+				return
+			} else if *noEmail == false && newEmail == "" {
+				randomEmail, randomErr := newPseudonymousEmail()
+				if randomErr != nil {
+					fail(ERRCRYPTO, "There was an error generating an email address for your key", randomErr)
 					return
 				}
-
-				id.SelfSignature.PreferredHash = []uint8{8}
+				newEmail = randomEmail
+			}
+			if *blindTime == true {
+				blindKeyTime(packetConf)
 			}
-			fmt.Println(pgpEntity.PrimaryKey.KeyIdString() + " " + newEmail)
-			privBuf := new(bytes.Buffer)
-			pubBuf := new(bytes.Buffer)
-			w1, err1 := armor.Encode(pubBuf, openpgp.PublicKeyType, nil)
-			w2, err2 := armor.Encode(privBuf, openpgp.PrivateKeyType, nil)
-			if err1 != nil || err2 != nil {
-				fmt.Println(err1)
-				fmt.Println(err2)
+			pgpEntity, publicKey, privateKey, pgpGenErr := generateKey(*username, *comment, newEmail, packetConf)
+			if pgpGenErr != nil {
+				fail(ERRCRYPTO, "There was an error generating a new GPG key for you", pgpGenErr)
 				return
 			}
+			KeyType = *keyTypeFlag
+			fmt.Println(ripacrypt.KeyFingerprint(pgpEntity.PrimaryKey) + " " + newEmail)
 
-			pgpEntity.SerializePrivate(w2, nil)
-			w2.Close()
+			PublicKey = publicKey
+			PrivateKey = privateKey
+			fmt.Println(PublicKey)
 
-			pgpEntity.Serialize(w1)
-			w1.Close()
+			if *noPassphrase == false {
+				passphrase, passphraseErr := promptNewPassphrase()
+				if passphraseErr != nil {
+					fail(ERRCRYPTO, "There was an error reading the passphrase for your private key", passphraseErr)
+					return
+				}
 
-			PublicKey = pubBuf.String()
-			PrivateKey = privBuf.String()
-			fmt.Println(PublicKey)
+				PrivateKey, passphraseErr = ripacrypt.ProtectPrivateKey(PrivateKey, passphrase)
+				if passphraseErr != nil {
+					fail(ERRCRYPTO, "There was an error protecting your private key with your passphrase", passphraseErr)
+					return
+				}
+			}
 
-			fingerprint, publicKeyErr := VerifyGPGPublicKey(PublicKey)
+			fingerprint, publicKeyErr := ripacrypt.VerifyGPGPublicKey(PublicKey)
 			if publicKeyErr != nil {
-				fmt.Println("There was an error validating the generated public key")
-				fmt.Println(publicKeyErr)
+				fail(ERRCRYPTO, "There was an error validating the generated public key", publicKeyErr)
 				return
 			}
 			PublicKeyFingerprint = fingerprint
@@ -211,21 +479,20 @@ func main() {
 		} else {
 			b, fileReadErr := ioutil.ReadFile(*publicKeyFlag)
 			if fileReadErr != nil {
-
-				fmt.Println("There was an error processing your public key")
-				fmt.Println(fileReadErr)
+				fail(ERRLOCAL, "There was an error processing your public key", fileReadErr)
+				return
 			}
 
 			PublicKey = string(b)
-			fingerprint, publicKeyErr := VerifyGPGPublicKey(PublicKey)
+			fingerprint, publicKeyErr := ripacrypt.VerifyGPGPublicKey(PublicKey)
 
 			if publicKeyErr != nil {
-				fmt.Println("There was an error processing your public key")
-				fmt.Println(publicKeyErr)
+				fail(ERRCRYPTO, "There was an error processing your public key", publicKeyErr)
 				return
 			}
 			PublicKeyFingerprint = fingerprint
 			fmt.Println("Successfully parsed your Public Key with fingerprint ", PublicKeyFingerprint)
+			fmt.Println("Without its secret key crypts cannot be created or read, add it with: rcrypt key import SECRETKEY")
 		}
 
 		//Public key stuff is complete, let's continue
@@ -234,11 +501,10 @@ func main() {
 			conf.UseTor = true
 		}
 
-		apiResponse, registerErr := RIPACryptRegister(PublicKey, conf.UseTor)
+		apiResponse, registerErr := newClient(conf).Register(PublicKey)
 
 		if registerErr != nil {
-			fmt.Println("There was an error processing your registration;")
-			fmt.Println(registerErr)
+			failAPI("There was an error processing your registration;", registerErr)
 		} else {
 
 			fmt.Println("Your user id is: ", apiResponse.UserID)
@@ -248,6 +514,10 @@ func main() {
 			conf.PublicKey = PublicKey
 			conf.PrivateKey = PrivateKey
 			conf.Fingerprint = PublicKeyFingerprint
+			conf.KeyType, conf.Cipher, conf.Compression = KeyType, *cipherFlag, *compressionFlag
+			if useGPG == true {
+				conf.KeyBackend, conf.GPGKey, conf.GPGPath = KEYBACKENDGPG, PublicKeyFingerprint, *gpgPathFlag
+			}
 
 			if *debugRegister == true {
 				debugBuffer, jsonMarshalErr := json.Marshal(apiResponse)
@@ -259,60 +529,52 @@ func main() {
 				}
 			}
 
-			configFileBuffer, jsonMarshalErr := json.Marshal(conf)
-			if jsonMarshalErr != nil {
-				fmt.Println("There was an error parsing an internal data structure to write a new config file")
-				fmt.Println(jsonMarshalErr)
-				return
-			}
-
-			mkDirErr := os.Mkdir(os.Getenv("HOME")+"/.ripacrypt/", 0700)
-
-			if mkDirErr != nil {
-				if strings.Contains(mkDirErr.Error(), "file exists") == false {
-					fmt.Println("There was an error attempting to create ~/.ripacrypt/ to store your config")
-					fmt.Println(mkDirErr)
-					return
-				}
-			}
-			writeConfigFileErr := ioutil.WriteFile(os.Getenv("HOME")+"/.ripacrypt/rc.conf", configFileBuffer, 0644)
+			writeConfigFileErr := writeConfig(conf)
 
 			if writeConfigFileErr != nil {
-				fmt.Println("There was an error attempting to write your config file to disk")
-				fmt.Println(writeConfigFileErr)
+				fail(ERRLOCAL, "There was an error attempting to write your config file to disk", writeConfigFileErr)
 				return
 			}
 
+			succeed(struct {
+				UserID      uint64 `json:"user_id"`
+				BTCAddr     string `json:"btc_addr"`
+				Fingerprint string `json:"fingerprint"`
+			}{conf.UserID, conf.BTCAddr, conf.Fingerprint}, apiResponse.StatusCode)
 		}
 	}
 
 	// New Crypt ----------------------------------------------------------------
 	if newCommand.Parsed() {
-		var dataToStore string
+		var dataReader io.Reader
 
 		if *dataToStoreFlag == "" {
 			stat, _ := os.Stdin.Stat()
 			if (stat.Mode() & os.ModeCharDevice) == 0 {
 				fmt.Println("data is being piped to stdin")
-				stdInBytes, _ := ioutil.ReadAll(os.Stdin)
-				dataToStore = string(stdInBytes)
+				dataReader = os.Stdin
 			} else {
-				fmt.Println("Please supply the path to the data that is required to be stored")
+				fail(ERRUSAGE, "Please supply the path to the data that is required to be stored", nil)
 				return
 			}
 		} else {
 			//Lets read the data
-			b, err := ioutil.ReadFile(*dataToStoreFlag)
+			dataFile, err := os.Open(*dataToStoreFlag)
 			if err != nil {
-				fmt.Println("There was an error parsing our data")
-				fmt.Println(err)
+				fail(ERRLOCAL, "There was an error parsing our data", err)
 				return
 			}
-			dataToStore = string(b)
+			defer dataFile.Close()
+			dataReader = dataFile
+		}
+
+		if *chunkSizeFlag <= 0 {
+			fail(ERRUSAGE, "-chunksize must be a positive number of bytes", nil)
+			return
 		}
 
 		if conf.UserID == 0 {
-			fmt.Println("Your config file doesn't contain a userID - crypts cannot be created")
+			fail(ERRCONFIG, "Your config file doesn't contain a userID - crypts cannot be created", nil)
 			return
 		}
 
@@ -326,16 +588,120 @@ func main() {
 				fmt.Println("Connecting directly to create a new crypt")
 			}
 		}
-		//NewCrypt(dataToStore string, UserID uint64, Description string, CheckInDuration int, MissCount int, UseTor bool, IsEncrypted bool)
 
-		apiResponse, newErr := NewCrypt(dataToStore, *descriptionFlag, *checkInDurationFlag, *missCountFlag, *preEncryptedFlag, conf)
+		recipients, recipientsErr := resolveRecipients(recipientsFlag)
+		if recipientsErr != nil {
+			fail(ERRUSAGE, "There was an error finding your recipients", recipientsErr)
+			return
+		}
+		if len(recipients) > 0 && *preEncryptedFlag == true && *sharesFlag == 0 {
+			fail(ERRUSAGE, "-recipient cannot be used with -isencrypted, encrypt the data to your recipients yourself", nil)
+			return
+		}
+
+		client := newClient(conf)
+		client.ChunkSize = *chunkSizeFlag
+
+		var recipientFingerprints []string
+		for _, recipient := range recipients {
+			client.Recipients = append(client.Recipients, recipient.PublicKey)
+			recipientFingerprints = append(recipientFingerprints, recipient.Fingerprint)
+			if *debugNewCrypt == true {
+				fmt.Println("Also encrypting to " + recipient.Name + " (" + recipient.Fingerprint + ")")
+			}
+		}
+
+		if *sharesFlag > 0 {
+			if *thresholdFlag == 0 {
+				*thresholdFlag = *sharesFlag/2 + 1
+			}
+			if *preEncryptedFlag == true {
+				fmt.Println("Shares are always encrypted with your public key, even with -isencrypted")
+			}
+
+			durations, durationsErr := parseShareSettings("checkindurations", *shareDurationsFlag, *checkInDurationFlag, *sharesFlag)
+			if durationsErr != nil {
+				fail(ERRUSAGE, "There was an error in your share settings", durationsErr)
+				return
+			}
+			missCounts, missCountsErr := parseShareSettings("misscounts", *shareMissCountsFlag, *missCountFlag, *sharesFlag)
+			if missCountsErr != nil {
+				fail(ERRUSAGE, "There was an error in your share settings", missCountsErr)
+				return
+			}
+
+			dataToStore, err := ioutil.ReadAll(dataReader)
+			if err != nil {
+				fail(ERRLOCAL, "There was an error parsing our data", err)
+				return
+			}
+
+			newShareGroup(client, string(dataToStore), *thresholdFlag, *descriptionFlag, durations, missCounts, recipients)
+			return
+		}
+
+		var apiResponse ripacrypt.NewCryptAPIResponse
+		var chunks []string
+		var newErr error
+
+		if *preEncryptedFlag == true {
+			// Ciphertext we didn't produce can't be split up and still be
+			// decrypted, so it goes in a single crypt
+			dataToStore, err := ioutil.ReadAll(dataReader)
+			if err != nil {
+				fail(ERRLOCAL, "There was an error parsing our data", err)
+				return
+			}
+			apiResponse, newErr = client.NewCrypt(string(dataToStore), *descriptionFlag, *checkInDurationFlag, *missCountFlag, true)
+		} else {
+			apiResponse, chunks, newErr = client.NewStreamCrypt(dataReader, *descriptionFlag, *checkInDurationFlag, *missCountFlag)
+		}
 
 		if newErr != nil {
-			fmt.Println("There was an issue creating your crypt")
-			fmt.Println(newErr)
+			// Chunks without their manifest are useless, don't leave them
+			// lying around on the server
+			for _, chunkID := range chunks {
+				if _, destroyErr := client.Destroy(chunkID); destroyErr != nil {
+					fmt.Println("Could not destroy chunk crypt", chunkID, destroyErr)
+				}
+			}
+			failAPI("There was an issue creating your crypt", newErr)
 		} else {
 			fmt.Println("Your CryptID is: ", apiResponse.CryptPayload.CryptID)
 
+			// Remember the crypt locally, trusting our own flags for anything
+			// the server didn't echo back to us
+			crypt := apiResponse.CryptPayload
+			if crypt.Description == "" {
+				crypt.Description = *descriptionFlag
+			}
+			if crypt.CheckInDuration == 0 {
+				crypt.CheckInDuration = *checkInDurationFlag
+			}
+			if crypt.MissCount == 0 {
+				crypt.MissCount = *missCountFlag
+			}
+			if crypt.CreateTimeStamp == 0 {
+				crypt.CreateTimeStamp = time.Now().Unix()
+			}
+			recordCrypt(crypt)
+			if *preEncryptedFlag == true {
+				recordPreEncrypted(crypt.CryptID)
+			}
+
+			result := newCryptResult(crypt)
+			if len(recipientFingerprints) > 0 {
+				fmt.Println("Your recipients can also decrypt it: " + strings.Join(recipientFingerprints, ", "))
+				recordRecipients(crypt.CryptID, recipients)
+				result.Recipients = recipientFingerprints
+			}
+			if len(chunks) > 0 {
+				fmt.Printf("Your data was split across %d chunk crypts, they are checked in with alongside it\n", len(chunks))
+				recordChunks(crypt.CryptID, chunks)
+				result.Chunks = chunks
+			}
+			succeed(result, apiResponse.StatusCode)
+
 			if *debugNewCrypt == true {
 				debugBuffer, jsonMarshalErr := json.Marshal(apiResponse)
 
@@ -362,27 +728,35 @@ func main() {
 			}
 		}
 
-		apiResponse, challengeErr := GetChallenge(conf.UserID, conf.Fingerprint, conf.UseTor)
+		client := newClient(conf)
+		apiResponse, challengeErr := client.GetChallenge()
 
 		if challengeErr != nil {
-			fmt.Println("There was an issue getting the challenge")
-			fmt.Println(challengeErr)
-		} else {
-			fmt.Println("Your encrypted challenge is: ", apiResponse.Challenge)
+			failAPI("There was an issue getting the challenge", challengeErr)
+			return
 		}
+		fmt.Println("Your encrypted challenge is: ", apiResponse.Challenge)
+
+		result := struct {
+			Challenge   string `json:"challenge"`
+			ChallengeID uint64 `json:"challenge_id"`
+			Cleartext   string `json:"cleartext,omitempty"`
+		}{Challenge: apiResponse.Challenge, ChallengeID: apiResponse.ChallengeID}
 
 		if *decryptChallenge == true {
 			fmt.Println("Decrypting...")
-			cleartext, err := DecryptChallenge(apiResponse.Challenge, conf.PrivateKey)
+			cleartext, err := client.DecryptChallenge(apiResponse.Challenge)
 
 			if err != nil {
-				fmt.Println("There was an error decrypting the challenge;")
-				fmt.Println(err)
-			} else {
-				fmt.Println("The cleartext challenge is: ", cleartext)
+				fail(ERRCRYPTO, "There was an error decrypting the challenge;", err)
+				return
 			}
+			fmt.Println("The cleartext challenge is: ", cleartext)
+			result.Cleartext = cleartext
 		}
 
+		succeed(result, apiResponse.StatusCode)
+
 		if *debugChallenge == true {
 			debugBuffer, jsonMarshalErr := json.Marshal(apiResponse)
 
@@ -408,13 +782,15 @@ func main() {
 			}
 		}
 
-		apiResponse, newBTCErr := GetBTC(conf)
+		apiResponse, newBTCErr := newClient(conf).GetBTC()
 
 		if newBTCErr != nil {
-			fmt.Println("There was an issue getting a new bitcoin address")
-			fmt.Println(newBTCErr)
+			failAPI("There was an issue getting a new bitcoin address", newBTCErr)
 		} else {
 			fmt.Println("Your new bitcoin address is: ", apiResponse.BTCAddr)
+			succeed(struct {
+				BTCAddr string `json:"btc_addr"`
+			}{apiResponse.BTCAddr}, apiResponse.StatusCode)
 
 			if *debugNewBTC == true {
 				debugBuffer, jsonMarshalErr := json.Marshal(apiResponse)
@@ -432,7 +808,7 @@ func main() {
 	// Checkin ------------------------------------------------------------------
 	if checkinCommand.Parsed() {
 		if *cryptIDFlag == "" {
-			fmt.Println("Cannot checkin without specifying a crypt id")
+			fail(ERRUSAGE, "Cannot checkin without specifying a crypt id", nil)
 			fmt.Println("Use -crypt=CRYPTID")
 			return
 		}
@@ -448,13 +824,48 @@ func main() {
 			}
 		}
 
-		apiResponse, checkinErr := Checkin(conf, *cryptIDFlag)
+		client := newClient(conf)
+		apiResponse, checkinErr := client.Checkin(*cryptIDFlag)
+		if ripacrypt.KindOf(checkinErr) == ripacrypt.KindDestroyed {
+			recordDestroyed(*cryptIDFlag)
+		}
+
+		// The chunks of a chunked payload need keeping alive too. Each is
+		// checked in with even if another has failed, a destroyed chunk only
+		// loses the crypt its contents.
+		chunks := indexedChunks(*cryptIDFlag)
+		var destroyedChunks []string
+		var chunkErr error
+		for i, chunkID := range chunks {
+			if checkinErr != nil {
+				break
+			}
+			_, err := client.Checkin(chunkID)
+			switch {
+			case err == nil:
+			case ripacrypt.KindOf(err) == ripacrypt.KindDestroyed:
+				fmt.Printf("Chunk %d of %d (crypt %s) has been destroyed\n", i+1, len(chunks), chunkID)
+				destroyedChunks = append(destroyedChunks, chunkID)
+				chunkErr = err
+			case chunkErr == nil:
+				chunkErr = fmt.Errorf("chunk %d of %d (crypt %s): %w", i+1, len(chunks), chunkID, err)
+			}
+		}
 
 		if checkinErr != nil {
-			fmt.Println("There was an issue checking in with that crypt")
-			fmt.Println(checkinErr)
+			failAPI("There was an issue checking in with that crypt", checkinErr)
+		} else if len(destroyedChunks) > 0 {
+			failAPI(fmt.Sprintf("Checked in with crypt %s, but %d of its %d chunks have been destroyed so its contents are lost", *cryptIDFlag, len(destroyedChunks), len(chunks)), chunkErr)
+		} else if chunkErr != nil {
+			failAPI("There was an issue checking in with that crypt", chunkErr)
 		} else {
 			fmt.Println(apiResponse.Message)
+			recordCheckin(*cryptIDFlag, time.Now())
+
+			result := newCryptResult(apiResponse.CryptPayload)
+			result.Chunks = chunks
+			succeed(result, apiResponse.StatusCode)
+
 			if *debugCheckin == true {
 				debugBuffer, jsonMarshalErr := json.Marshal(apiResponse)
 
@@ -468,69 +879,500 @@ func main() {
 		}
 	}
 
+	// Destroy ------------------------------------------------------------------
+	if destroyCommand.Parsed() {
+		if *cryptIDDestroy == "" {
+			fail(ERRUSAGE, "Cannot destroy without specifying a crypt id", nil)
+			fmt.Println("Use -crypt=CRYPTID")
+			return
+		}
+
+		if *skipConfirmDestroy == false {
+			fmt.Println("Crypt " + *cryptIDDestroy + " will be destroyed immediately, this cannot be undone!")
+			fmt.Print("Type 'yes' to continue: ")
+
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if strings.TrimSpace(answer) != "yes" {
+				fail(ERRABORTED, "Not destroying crypt "+*cryptIDDestroy, nil)
+				return
+			}
+		}
+
+		if *useTorToDestroy == true || conf.UseTor == true {
+			if *debugDestroy == true {
+				fmt.Println("Using Tor to destroy crypt " + *cryptIDDestroy)
+			}
+			conf.UseTor = true
+		} else {
+			if *debugDestroy == true {
+				fmt.Println("Connecting directly to destroy crypt " + *cryptIDDestroy)
+			}
+		}
+
+		client := newClient(conf)
+		apiResponse, destroyErr := client.Destroy(*cryptIDDestroy)
+
+		if destroyErr != nil {
+			failAPI("There was an issue destroying that crypt", destroyErr)
+			return
+		}
+
+		fmt.Println(apiResponse.Message)
+		recordDestroyed(*cryptIDDestroy)
+
+		for _, chunkID := range indexedChunks(*cryptIDDestroy) {
+			if _, chunkErr := client.Destroy(chunkID); chunkErr != nil && ripacrypt.KindOf(chunkErr) != ripacrypt.KindDestroyed {
+				failAPI("There was an issue destroying chunk crypt "+chunkID, chunkErr)
+				return
+			}
+		}
+
+		if *debugDestroy == true {
+			debugBuffer, jsonMarshalErr := json.Marshal(apiResponse)
+
+			if jsonMarshalErr == nil {
+				fmt.Println(string(debugBuffer))
+			} else {
+				fmt.Println("There was an error transforming the api response to a JSON entity")
+			}
+		}
+
+		// Don't take the servers word for it, fetch the crypt and make sure
+		verifyResponse, verifyErr := client.GetCrypt(*cryptIDDestroy)
+
+		if verifyResponse.CryptPayload.IsDestroyed == true {
+			fmt.Println("Verified that crypt " + *cryptIDDestroy + " has been destroyed")
+			succeed(newCryptResult(verifyResponse.CryptPayload), apiResponse.StatusCode)
+		} else if verifyErr != nil {
+			failAPI("There was an issue verifying that the crypt was destroyed", verifyErr)
+		} else {
+			fail(ERRSERVER, "WARNING: The server still reports crypt "+*cryptIDDestroy+" as not destroyed", nil)
+		}
+	}
+
+	// Panic --------------------------------------------------------------------
+	if panicCommand.Parsed() {
+		if *useTorToPanic == true {
+			conf.UseTor = true
+		}
+		runPanicCommand(conf, *destroyPanic, *skipConfirmPanic)
+	}
+
+	// Config -------------------------------------------------------------------
+	if configCommand.Parsed() {
+		usage := "usage: rcrypt config show [-usetor]"
+		if configCommand.Arg(0) != "show" {
+			fail(ERRUSAGE, usage, nil)
+			return
+		}
+
+		// -usetor shows what a command given it would use
+		showFlags := flag.NewFlagSet("config show", flag.ContinueOnError)
+		useTorShow := showFlags.Bool("usetor", false, "Show the settings as a command given -usetor would see them")
+		if err := showFlags.Parse(configCommand.Args()[1:]); err != nil || showFlags.NArg() != 0 {
+			fail(ERRUSAGE, usage, err)
+			return
+		}
+		useTor := resolveUseTor(*useTorShow, conf)
+
+		fmt.Printf("config_file\t%s\t(%s)\n", configPath.Value, configPath.Source)
+		fmt.Printf("profile\t\t%s\t(%s)\n", activeProfile.Value, activeProfile.Source)
+		printEndpoints(effectiveEndpoints, useTor)
+		succeed(struct {
+			ConfigFile setting `json:"config_file"`
+			Profile    setting `json:"profile"`
+			Endpoints
+			UseTor setting `json:"usetor"`
+		}{configPath, activeProfile, effectiveEndpoints, useTor}, 0)
+	}
+
+	// Profile ------------------------------------------------------------------
+	if profileCommand.Parsed() {
+		runProfileCommand(configFile, profileCommand.Args())
+	}
+
+	// Contact ------------------------------------------------------------------
+	if contactCommand.Parsed() {
+		runContactCommand(contactCommand.Args())
+	}
+
+	// Key ----------------------------------------------------------------------
+	if keyCommand.Parsed() {
+		runKeyCommand(conf, keyCommand.Args())
+	}
+
+	// Whoami -------------------------------------------------------------------
+	if whoamiCommand.Parsed() {
+		runWhoamiCommand(conf)
+	}
+
+	// Backup -------------------------------------------------------------------
+	if backupCommand.Parsed() {
+		runBackupCommand(conf, *outBackup, *forceBackup)
+	}
+
+	// Restore ------------------------------------------------------------------
+	if restoreCommand.Parsed() {
+		runRestoreCommand(conf, *inRestore, *forceRestore)
+	}
+
+	// Export paper -------------------------------------------------------------
+	if exportPaperCommand.Parsed() {
+		runExportPaperCommand(conf, *outExportPaper, *pngExportPaper, *forceExportPaper, *noPassphraseExportPaper)
+	}
+
+	// Import paper -------------------------------------------------------------
+	if importPaperCommand.Parsed() {
+		runImportPaperCommand(conf, *inImportPaper, *forceImportPaper)
+	}
+
+	// List ---------------------------------------------------------------------
+	if listCommand.Parsed() {
+		index, indexErr := readIndex()
+		if indexErr != nil {
+			fail(ERRLOCAL, "There was an error reading your local crypt index", indexErr)
+			return
+		}
+
+		results := []CryptResult{}
+		for _, entry := range index.Crypts {
+			results = append(results, newCryptResult(entry.Crypt()))
+		}
+		succeed(results, 0)
+
+		if len(index.Crypts) == 0 {
+			fmt.Println("You have not created any crypts with this client")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "CRYPT ID\tCREATED\tREMAINING\tDESCRIPTION")
+		for _, entry := range index.Crypts {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+				entry.CryptID,
+				time.Unix(entry.Created, 0).Format("2006-01-02 15:04"),
+				timeRemaining(entry.Crypt()),
+				entry.Description,
+			)
+		}
+		w.Flush()
+
+		if len(index.Groups) > 0 {
+			fmt.Println()
+			fmt.Fprintln(w, "SHARE GROUP\tNEEDED\tALIVE\tDESCRIPTION")
+			for _, group := range index.Groups {
+				fmt.Fprintf(w, "%s\t%d\t%d of %d\t%s\n",
+					group.GroupID,
+					group.Threshold,
+					index.AliveShares(group),
+					len(group.Shares),
+					group.Description,
+				)
+			}
+			w.Flush()
+		}
+	}
+
+	// Status -------------------------------------------------------------------
+	if statusCommand.Parsed() {
+		if *cryptIDStatus == "" {
+			fail(ERRUSAGE, "Cannot show the status without specifying a crypt id", nil)
+			fmt.Println("Use -crypt=CRYPTID")
+			return
+		}
+
+		if *useTorForStatus == true || conf.UseTor == true {
+			conf.UseTor = true
+		}
+
+		apiResponse, getErr := newClient(conf).GetCrypt(*cryptIDStatus)
+
+		// A destroyed crypt still has a status worth showing
+		if getErr != nil && ripacrypt.KindOf(getErr) != ripacrypt.KindDestroyed {
+			failAPI("There was an issue retrieving that crypt", getErr)
+			return
+		}
+
+		printCryptStatus(apiResponse.CryptPayload)
+		if getErr != nil {
+			failAPI("Crypt "+*cryptIDStatus+" has been destroyed", getErr)
+			report.Result = newCryptResult(apiResponse.CryptPayload)
+		} else {
+			succeed(newCryptResult(apiResponse.CryptPayload), apiResponse.StatusCode)
+		}
+
+		index, indexErr := readIndex()
+		if indexErr == nil && index.Find(*cryptIDStatus) != nil {
+			recordCrypt(apiResponse.CryptPayload)
+		}
+
+		if *debugStatus == true {
+			debugBuffer, jsonMarshalErr := json.Marshal(apiResponse)
+
+			if jsonMarshalErr == nil {
+				fmt.Println(string(debugBuffer))
+			} else {
+				fmt.Println("There was an error transforming the api response to a JSON entity")
+			}
+		}
+	}
+
+	// Passwd -------------------------------------------------------------------
+	if passwdCommand.Parsed() {
+		if conf.KeyBackend == KEYBACKENDGPG {
+			fail(ERRCONFIG, "Your secret key is kept by gpg, change its passphrase with: gpg --edit-key "+conf.GPGKey+" passwd", nil)
+			return
+		}
+		if conf.PrivateKey == "" {
+			fail(ERRCONFIG, "Your config file doesn't contain a private key - there is nothing to protect", nil)
+			return
+		}
+
+		// Retired keys share the passphrase, ask for it once
+		var oldPassphrase []byte
+		prompt := func() ([]byte, error) {
+			if oldPassphrase == nil {
+				passphrase, err := promptPassphrase()
+				if err != nil {
+					return nil, err
+				}
+				oldPassphrase = passphrase
+			}
+			return oldPassphrase, nil
+		}
+
+		privateKey, unlockErr := ripacrypt.UnlockPrivateKey(conf.PrivateKey, prompt)
+		if unlockErr != nil {
+			fail(ERRCRYPTO, "There was an error unlocking your private key", unlockErr)
+			return
+		}
+		retiredKeys := make([]ripacrypt.RetiredKey, len(conf.RetiredKeys))
+		for i, retired := range conf.RetiredKeys {
+			retired.PrivateKey, unlockErr = ripacrypt.UnlockPrivateKey(retired.PrivateKey, prompt)
+			if unlockErr != nil {
+				fail(ERRCRYPTO, "There was an error unlocking your retired key "+retired.Fingerprint, unlockErr)
+				return
+			}
+			retiredKeys[i] = retired
+		}
+
+		if *removePassphrase == true {
+			conf.PrivateKey = privateKey
+		} else {
+			passphrase, passphraseErr := promptNewPassphrase()
+			if passphraseErr == nil && oldPassphrase != nil && bytes.Equal(passphrase, oldPassphrase) == true {
+				passphraseErr = errors.New("it is the same as your current passphrase, set " + NEWPASSPHRASEENV + " to supply a new one without a terminal")
+			}
+			if passphraseErr != nil {
+				fail(ERRCRYPTO, "There was an error reading your new passphrase", passphraseErr)
+				return
+			}
+
+			conf.PrivateKey, passphraseErr = ripacrypt.ProtectPrivateKey(privateKey, passphrase)
+			for i := range retiredKeys {
+				if passphraseErr == nil {
+					retiredKeys[i].PrivateKey, passphraseErr = ripacrypt.ProtectPrivateKey(retiredKeys[i].PrivateKey, passphrase)
+				}
+			}
+			if passphraseErr != nil {
+				fail(ERRCRYPTO, "There was an error protecting your private key with your passphrase", passphraseErr)
+				return
+			}
+		}
+		if len(retiredKeys) > 0 {
+			conf.RetiredKeys = retiredKeys
+		}
+
+		writeConfigFileErr := writeConfig(conf)
+		if writeConfigFileErr != nil {
+			fail(ERRLOCAL, "There was an error attempting to write your config file to disk", writeConfigFileErr)
+			return
+		}
+		forgetAgentPassphrase()
+
+		succeed(struct {
+			Protected bool `json:"protected"`
+		}{!*removePassphrase}, 0)
+
+		if *removePassphrase == true {
+			fmt.Println("Your private key is no longer passphrase protected")
+		} else {
+			fmt.Println("Your passphrase has been changed")
+		}
+	}
+
+	// Daemon -------------------------------------------------------------------
+	if daemonCommand.Parsed() {
+		if conf.UserID == 0 {
+			fail(ERRCONFIG, "Your config file doesn't contain a userID - cannot checkin with crypts", nil)
+			return
+		}
+
+		if *useTorForDaemon == true || conf.UseTor == true {
+			if *debugDaemon == true {
+				fmt.Println("Using Tor to checkin with crypts")
+			}
+			conf.UseTor = true
+		}
+
+		if *cryptListDaemon == "" {
+			*cryptListDaemon = profileFile("crypts", ".list")
+		}
+
+		reload := func() (*ripacrypt.Client, error) { return reloadProfile(conf.UseTor) }
+		runDaemon(newClient(conf), reload, *cryptListDaemon, *debugDaemon, *panicDaemon || *panicDestroyDaemon, *panicDestroyDaemon)
+		succeed(nil, 0)
+	}
+
 	//Get / Retrieve ----------------------------------------------------------------------
 	if getCommand.Parsed() {
-		if *cryptIDGet == "" {
-			fmt.Println("Cannot checkin without specifying a crypt id")
-			fmt.Println("Use -crypt=CRYPTID")
+		if *cryptIDGet == "" && *groupGet == "" {
+			fail(ERRUSAGE, "Cannot get a crypt without specifying a crypt id", nil)
+			fmt.Println("Use -crypt=CRYPTID or -group=GROUPID")
 			return
 		}
 
+		getTarget := "crypt " + *cryptIDGet
+		if *groupGet != "" {
+			getTarget = "share group " + *groupGet
+		}
 		if *useTorToGet == true || conf.UseTor == true {
 			if *debugGet == true {
-				fmt.Println("Using Tor to checkin with crypt " + *cryptIDFlag)
+				fmt.Println("Using Tor to get " + getTarget)
 			}
 			conf.UseTor = true
 		} else {
 			if *debugGet == true {
-				fmt.Println("Connecting directly to checkin with crypt " + *cryptIDFlag)
+				fmt.Println("Connecting directly to get " + getTarget)
 			}
 		}
 
-		apiResponse, getErr := GetCrypt(conf, *cryptIDGet)
+		if *outGet != "" && *pipeGet != "" {
+			fail(ERRUSAGE, "Use either -out or -pipe, not both", nil)
+			return
+		}
+		if *outGet == "-" && jsonOutput == true {
+			fail(ERRUSAGE, "-out=- cannot be combined with -output=json, stdout carries the report", nil)
+			return
+		}
 
-		if getErr != nil {
-			fmt.Println("There was an issue retrieving that crypt")
-			fmt.Println(getErr)
+		// Do this first so we don't fetch a crypt we have nowhere to put
+		sink, sinkErr := openSecretSink(*outGet, *pipeGet, *forceGet)
+		if sinkErr != nil {
+			fail(ERRLOCAL, "There was an error preparing the output", sinkErr)
+			return
+		}
+		if sink != nil {
+			defer sink.Abort()
+		}
+
+		client := newClient(conf)
+		client.AllowUnsigned = *allowUnsignedGet
+
+		// Crypts shared with us by a contact are signed by them
+		if book, contactsErr := readContacts(); contactsErr == nil {
+			client.Signers = book.PublicKeys()
+		} else {
+			log.Println("Cannot read your contacts", contactsPath(), contactsErr)
+		}
+
+		if *groupGet != "" {
+			getShareGroup(client, *groupGet, sink)
+			return
+		}
+
+		apiResponse, getErr := client.GetCrypt(*cryptIDGet)
+
+		if ripacrypt.KindOf(getErr) == ripacrypt.KindDestroyed {
+			failAPI("The retrieved crypt has been destroyed - there is no data to decrypt", getErr)
+			recordDestroyed(*cryptIDGet)
+		} else if getErr != nil {
+			failAPI("There was an issue retrieving that crypt", getErr)
 		} else {
 			if *debugGet == true {
 				fmt.Println(apiResponse.Message)
 			}
 
 			//Decrypt and display the data
-			if apiResponse.StatusCode == 410 && apiResponse.CryptPayload.IsDestroyed == true {
-				fmt.Println("The retrieved crypt has been destroyed - there is no data to decrypt")
-			} else {
+			result := newCryptResult(apiResponse.CryptPayload)
 
-				if *decryptGet == true {
-					plainText, decryptErr := DecryptCrypt(apiResponse.CryptPayload.CipherText, conf.PrivateKey)
+			if *decryptGet == true {
+				plainTextBuffer := new(bytes.Buffer)
+				var out io.Writer = plainTextBuffer
+				if sink != nil {
+					out = sink
+				}
 
-					if decryptErr != nil {
-						fmt.Println("There was an issue encountered trying to decrypt the crypt:")
-						fmt.Println(decryptErr)
-					} else {
-						if *debugGet == true {
-							fmt.Println("Crypt Contents:\n--------------")
-						}
+				payload, decryptErr := client.DecryptPayload(apiResponse.CryptPayload, out)
+				plainText := plainTextBuffer.String()
 
-						fmt.Println(plainText)
+				if len(payload.Chunks) > 0 {
+					recordChunks(*cryptIDGet, payload.Chunks)
+					result.Chunks = payload.Chunks
+				}
+				if decryptErr == nil {
+					reportSigner(payload.Signer, conf.Fingerprint)
+					result.Signer = payload.Signer
+				}
 
-						if *debugGet == true {
-							fmt.Println("--------------")
-						}
+				if decryptErr != nil {
+					failAPI("There was an issue encountered trying to decrypt the crypt:", decryptErr)
+					if errors.Is(decryptErr, ripacrypt.ErrUnsigned) {
+						fmt.Println("Crypts stored by older versions of rcrypt are not signed, if you trust this one use -allowunsigned")
 					}
+				} else if sink != nil {
+					if commitErr := sink.Commit(); commitErr != nil {
+						fail(ERRLOCAL, "There was an error writing the crypt contents", commitErr)
+						return
+					}
+					if sink.Path() != "" {
+						fmt.Println("The crypt contents were written to " + sink.Path())
+					}
+					succeed(result, apiResponse.StatusCode)
 				} else {
 					if *debugGet == true {
 						fmt.Println("Crypt Contents:\n--------------")
 					}
 
-					fmt.Println(apiResponse.CryptPayload.CipherText)
+					// The plaintext is part of the report, don't also
+					// leak it to stderr
+					if jsonOutput == false {
+						fmt.Println(plainText)
+					}
+					result.Plaintext = plainText
+					succeed(result, apiResponse.StatusCode)
 
 					if *debugGet == true {
 						fmt.Println("--------------")
 					}
+				}
+			} else if sink != nil {
+				_, writeErr := io.WriteString(sink, apiResponse.CryptPayload.CipherText)
+				if writeErr == nil {
+					writeErr = sink.Commit()
+				}
+				if writeErr != nil {
+					fail(ERRLOCAL, "There was an error writing the crypt contents", writeErr)
+					return
+				}
+				if sink.Path() != "" {
+					fmt.Println("The encrypted crypt contents were written to " + sink.Path())
+				}
+				succeed(result, apiResponse.StatusCode)
+			} else {
+				if *debugGet == true {
+					fmt.Println("Crypt Contents:\n--------------")
+				}
+
+				if jsonOutput == false {
+					fmt.Println(apiResponse.CryptPayload.CipherText)
+				}
+				succeed(result, apiResponse.StatusCode)
 
+				if *debugGet == true {
+					fmt.Println("--------------")
 				}
+
 			}
 			if *debugGet == true {
 				debugBuffer, jsonMarshalErr := json.Marshal(apiResponse)
@@ -547,21 +1389,62 @@ func main() {
 
 }
 
-func readConfig() CoreConf {
-	var conf CoreConf
-	filename := os.Getenv("HOME") + "/.ripacrypt/rc.conf"
+// configDir returns the directory holding rc.conf and our other local state
+func configDir() string {
+	return filepath.Dir(configPath.Value) + string(filepath.Separator)
+}
 
-	b, err := ioutil.ReadFile(filename)
+// readConfig loads every profile from rc.conf
+func readConfig() (ConfigFile, error) {
+	configFile, err := loadConfigFile()
+	if err == nil && len(configFile.Profiles) == 0 {
+		log.Println("Cannot read configuration file using defaults", configPath.Value)
+	}
 
+	if err == nil && migrateFingerprints(configFile) == true {
+		if err = writeConfigFile(configFile); err == nil {
+			log.Println("Upgraded the key IDs in", configPath.Value, "to full fingerprints")
+		}
+	}
+	return configFile, err
+}
+
+// writeConfig saves conf as the active profile in rc.conf, leaving the other
+// profiles alone
+func writeConfig(conf CoreConf) error {
+	configFile, err := loadConfigFile()
 	if err != nil {
-		log.Println("Cannot read configuration file using defaults", filename)
-		conf.UseTor = false
+		return err
+	}
+
+	configFile.Profiles[activeProfile.Value] = conf
+	return writeConfigFile(configFile)
+}
+
+// newClient builds an API client from the users configuration, connecting
+// via the Tor hidden service if requested
+func newClient(conf CoreConf) *ripacrypt.Client {
+	creds := ripacrypt.Credentials{
+		UserID:      conf.UserID,
+		Fingerprint: conf.Fingerprint,
+		PublicKey:   conf.PublicKey,
+		PrivateKey:  conf.PrivateKey,
+		RetiredKeys: conf.RetiredKeys,
+		Passphrase:  promptPassphrase,
+	}
+
+	var client *ripacrypt.Client
+	if conf.UseTor == true {
+		client = ripacrypt.NewTorClient(effectiveEndpoints.OnionURL.Value, effectiveEndpoints.SOCKS.Value, creds)
 	} else {
-		err = json.Unmarshal(b, &conf)
+		client = ripacrypt.NewClient(effectiveEndpoints.APIURL.Value, creds)
+	}
 
-		if err != nil {
-			log.Fatal("Cannot parse configuration file ", filename)
-		}
+	if conf.KeyBackend == KEYBACKENDGPG {
+		client.KeyBackend = gpgBackend(conf)
 	}
-	return conf
+
+	// Checked when the config was read
+	client.PacketConfig, _ = packetConfig("", conf.Cipher, conf.Compression)
+	return client
 }
@@ -0,0 +1,1623 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt/ripacrypttest"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// When set the test binary behaves as rcrypt itself, letting us drive the
+// CLI exactly as a user would
+const testMainEnv = "RCRYPT_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testMainEnv) == "1" {
+		os.Args = append([]string{"rcrypt"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testHome is a throwaway $HOME with an account registered on a mock server
+type testHome struct {
+	t      *testing.T
+	dir    string
+	server *ripacrypttest.Server
+	env    []string
+}
+
+// newTestHome starts a mock server and registers an account against it
+func newTestHome(t *testing.T) *testHome {
+	t.Helper()
+
+	server := ripacrypttest.NewServer()
+	t.Cleanup(server.Close)
+
+	h := &testHome{t: t, dir: t.TempDir(), server: server}
+
+	out := h.run("", "register", "-nopassphrase")
+	if strings.Contains(out, "Your user id is:") == false {
+		t.Fatalf("register failed:\n%s", out)
+	}
+	return h
+}
+
+// run invokes rcrypt with args, feeding it stdin and returning everything it
+// printed
+func (h *testHome) run(stdin string, args ...string) string {
+	h.t.Helper()
+
+	cmd := h.command(stdin, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		h.t.Fatalf("rcrypt %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// runFail is run for commands expected to fail, checking rcrypt exits with
+// exitCode
+func (h *testHome) runFail(exitCode int, stdin string, args ...string) string {
+	h.t.Helper()
+
+	cmd := h.command(stdin, args...)
+	out, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok == false || exitErr.ExitCode() != exitCode {
+		h.t.Fatalf("rcrypt %s: expected exit status %d, got %v\n%s", strings.Join(args, " "), exitCode, err, out)
+	}
+	return string(out)
+}
+
+// stdout is run for commands whose stdout alone matters, such as get
+func (h *testHome) stdout(stdin string, args ...string) string {
+	h.t.Helper()
+
+	cmd := h.command(stdin, args...)
+	out, err := cmd.Output()
+	if err != nil {
+		h.t.Fatalf("rcrypt %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+func (h *testHome) command(stdin string, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append([]string{
+		testMainEnv + "=1",
+		"HOME=" + h.dir,
+		"PATH=" + os.Getenv("PATH"),
+		APIURLENV + "=" + h.server.URL,
+	}, h.env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	return cmd
+}
+
+// config returns the default profile from rc.conf
+func (h *testHome) config() CoreConf {
+	h.t.Helper()
+
+	var configFile ConfigFile
+	b, err := ioutil.ReadFile(filepath.Join(h.dir, ".ripacrypt", "rc.conf"))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if err = json.Unmarshal(b, &configFile); err != nil {
+		h.t.Fatal(err)
+	}
+	return configFile.Profiles[DEFAULTPROFILE]
+}
+
+var cryptIDPattern = regexp.MustCompile(`Your CryptID is:\s+(\S+)`)
+
+// newCrypt stores secret in a new crypt and returns its ID
+func (h *testHome) newCrypt(secret string, args ...string) string {
+	h.t.Helper()
+
+	out := h.run(secret, append([]string{"new"}, args...)...)
+	match := cryptIDPattern.FindStringSubmatch(out)
+	if match == nil {
+		h.t.Fatalf("no crypt ID in output:\n%s", out)
+	}
+	return match[1]
+}
+
+func TestRegister(t *testing.T) {
+	h := newTestHome(t)
+
+	conf := h.config()
+	if conf.UserID == 0 || conf.BTCAddr == "" || conf.Fingerprint == "" {
+		t.Errorf("incomplete config written %+v", conf)
+	}
+	if strings.Contains(conf.PrivateKey, "PRIVATE KEY") == false {
+		t.Error("generated private key not stored")
+	}
+	if info, err := os.Stat(filepath.Join(h.dir, ".ripacrypt", "rc.conf")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("rc.conf not written 0600: %v %v", info.Mode(), err)
+	}
+
+	out := h.runFail(exitCodes[ERRCONFIG], "", "register", "-nopassphrase")
+	if strings.Contains(out, "already registered") == false {
+		t.Errorf("second registration was not refused:\n%s", out)
+	}
+}
+
+// registeredIdentity returns the user ID and creation time of the key in
+// conf
+func registeredIdentity(t *testing.T, conf CoreConf) (*packet.UserId, time.Time) {
+	t.Helper()
+
+	entityList, err := ripacrypt.ReadKeyRing(conf.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range entityList[0].Identities {
+		return id.UserId, entityList[0].PrimaryKey.CreationTime
+	}
+	t.Fatal("key has no identity")
+	return nil, time.Time{}
+}
+
+func TestRegisterIdentity(t *testing.T) {
+	h := newTestHome(t)
+
+	userID, created := registeredIdentity(t, h.config())
+	if regexp.MustCompile(`^[A-Za-z]{24}@`+regexp.QuoteMeta(IDENTITYDOMAIN)+`$`).MatchString(userID.Email) == false {
+		t.Errorf("unexpected generated email %q", userID.Email)
+	}
+	if created.Equal(blindedKeyTime) == true {
+		t.Error("key creation time blinded without -blindtime")
+	}
+
+	anon := &testHome{t: t, dir: t.TempDir(), server: h.server}
+	anon.runFail(exitCodes[ERRUSAGE], "", "register", "-nopassphrase", "-noemail", "-email=me@example.com")
+
+	// An existing key can't be anonymised after the fact
+	keyFile := filepath.Join(anon.dir, "key.asc")
+	if err := ioutil.WriteFile(keyFile, []byte(h.config().PublicKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"-noemail", "-publickey=" + keyFile}, {"-blindtime", "-secretkey=" + keyFile}, {"-blindtime", "-gpgkey=ABCD"}} {
+		out := anon.runFail(exitCodes[ERRUSAGE], "", append([]string{"register", "-nopassphrase"}, args...)...)
+		if strings.Contains(out, "only apply to a generated key") == false {
+			t.Errorf("register %s not rejected:\n%s", strings.Join(args, " "), out)
+		}
+	}
+	anon.run("", "register", "-nopassphrase", "-noemail", "-blindtime")
+
+	userID, created = registeredIdentity(t, anon.config())
+	if userID.Email != "" || userID.Id != "Anonymous" {
+		t.Errorf("email not left out of the user ID %q", userID.Id)
+	}
+	if created.Equal(blindedKeyTime) == false {
+		t.Errorf("key creation time not blinded: %v", created)
+	}
+
+	cryptID := anon.newCrypt("no metadata")
+	if out := anon.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "no metadata" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+
+	// A rotated key keeps the blinding
+	anon.run("", "key", "rotate", "-nopassphrase")
+	if _, created = registeredIdentity(t, anon.config()); created.Equal(blindedKeyTime) == false {
+		t.Errorf("rotated key creation time not blinded: %v", created)
+	}
+}
+
+func TestNewAndGet(t *testing.T) {
+	h := newTestHome(t)
+
+	cryptID := h.newCrypt("MySuperStrongPassphrase", "-description=usb stick", "-checkinduration=600", "-misscount=2")
+
+	out := h.stdout("", "get", "-crypt="+cryptID)
+	if strings.TrimSpace(out) != "MySuperStrongPassphrase" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+
+	out = h.run("", "get", "-crypt="+cryptID, "-decrypt=false")
+	if strings.Contains(out, "MySuperStrongPassphrase") == true {
+		t.Errorf("-decrypt=false still decrypted:\n%s", out)
+	}
+
+	out = h.run("", "get", "-crypt="+cryptID, "-debug")
+	if strings.Contains(out, "Connecting directly to get crypt "+cryptID) == false {
+		t.Errorf("unexpected debug output:\n%s", out)
+	}
+}
+
+func TestChunkedCrypt(t *testing.T) {
+	h := newTestHome(t)
+
+	data := make([]byte, 5000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	cryptID := h.newCrypt(string(data), "-chunksize=1024", "-checkinduration=3600", "-misscount=2")
+
+	index, err := ioutil.ReadFile(filepath.Join(h.dir, ".ripacrypt", "crypts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cryptIndex CryptIndex
+	if err = json.Unmarshal(index, &cryptIndex); err != nil {
+		t.Fatal(err)
+	}
+	entry := cryptIndex.Find(cryptID)
+	if entry == nil || len(entry.Chunks) != 5 {
+		t.Fatalf("chunks not recorded in the index: %+v", entry)
+	}
+
+	out := h.run("", "get", "-crypt="+cryptID)
+	if strings.HasSuffix(out, string(data)+"\n") == false {
+		t.Error("binary data did not survive chunking")
+	}
+
+	// Checking in keeps every chunk alive
+	h.server.Advance(90 * time.Minute)
+	h.run("", "checkin", "-crypt="+cryptID)
+	h.server.Advance(90 * time.Minute)
+	for _, chunkID := range entry.Chunks {
+		if crypt, ok := h.server.Crypt(chunkID); ok == false || crypt.IsDestroyed == true {
+			t.Errorf("chunk %s was not checked in with", chunkID)
+		}
+	}
+
+	// A destroyed chunk is reported as such, the crypt itself is still alive
+	h.run("", "destroy", "-yes", "-crypt="+entry.Chunks[2])
+	out = h.runFail(exitCodes[ERRDESTROYED], "", "checkin", "-crypt="+cryptID)
+	if strings.Contains(out, "Chunk 3 of 5 (crypt "+entry.Chunks[2]+") has been destroyed") == false || strings.Contains(out, "1 of its 5 chunks have been destroyed") == false {
+		t.Errorf("destroyed chunk not reported:\n%s", out)
+	}
+	if out = h.run("", "list"); strings.Contains(out, "destroyed") == true {
+		t.Errorf("crypt recorded as destroyed for the loss of a chunk:\n%s", out)
+	}
+
+	h.run("", "destroy", "-yes", "-crypt="+cryptID)
+	for _, chunkID := range entry.Chunks {
+		if crypt, _ := h.server.Crypt(chunkID); crypt.IsDestroyed == false {
+			t.Errorf("chunk %s was not destroyed", chunkID)
+		}
+	}
+}
+
+func TestGetOut(t *testing.T) {
+	h := newTestHome(t)
+
+	data := "line one\nline two\x00\xff"
+	cryptID := h.newCrypt(data)
+
+	outPath := filepath.Join(h.dir, "keyfile")
+	h.run("", "get", "-crypt="+cryptID, "-out="+outPath)
+	b, err := ioutil.ReadFile(outPath)
+	if err != nil || string(b) != data {
+		t.Errorf("-out wrote %q %v", b, err)
+	}
+	if info, err := os.Stat(outPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("-out file not written 0600: %v %v", info.Mode(), err)
+	}
+
+	out := h.runFail(exitCodes[ERRLOCAL], "", "get", "-crypt="+cryptID, "-out="+outPath)
+	if strings.Contains(out, "-force") == false {
+		t.Errorf("existing file was not protected:\n%s", out)
+	}
+	h.run("", "get", "-crypt="+cryptID, "-out="+outPath, "-force")
+
+	cmd := h.command("", "get", "-crypt="+cryptID, "-out=-")
+	b, err = cmd.Output()
+	if err != nil || string(b) != data {
+		t.Errorf("-out=- wrote %q %v", b, err)
+	}
+
+	cmd = h.command("", "get", "-crypt="+cryptID, "-pipe=cat")
+	b, err = cmd.Output()
+	if err != nil || string(b) != data {
+		t.Errorf("-pipe wrote %q %v", b, err)
+	}
+	h.runFail(exitCodes[ERRLOCAL], "", "get", "-crypt="+cryptID, "-pipe=exit 3")
+	h.runFail(exitCodes[ERRUSAGE], "", "get", "-crypt="+cryptID, "-pipe=cat", "-out="+outPath)
+
+	// Nothing is left behind when there is nothing to write
+	h.run("", "destroy", "-yes", "-crypt="+cryptID)
+	missingPath := filepath.Join(h.dir, "missing")
+	h.runFail(exitCodes[ERRDESTROYED], "", "get", "-crypt="+cryptID, "-out="+missingPath)
+	if _, err = os.Stat(missingPath); os.IsNotExist(err) == false {
+		t.Errorf("-out file created for a destroyed crypt: %v", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(h.dir, ".missing*")); len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestGetVerifiesSignature(t *testing.T) {
+	h := newTestHome(t)
+
+	cryptID := h.newCrypt("signed secret")
+	conf := h.config()
+
+	out := h.run("", "get", "-crypt="+cryptID)
+	if strings.Contains(out, "Good signature from your key "+conf.Fingerprint) == false {
+		t.Errorf("signer not reported:\n%s", out)
+	}
+
+	// The server swaps in something else encrypted to our public key
+	unsigned, err := ripacrypt.EncryptData("replaced", conf.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.server.SetCipherText(cryptID, unsigned)
+
+	out = h.runFail(exitCodes[ERRCRYPTO], "", "get", "-crypt="+cryptID)
+	if strings.Contains(out, "not signed") == false || strings.Contains(out, "replaced") == true {
+		t.Errorf("unsigned crypt was not refused:\n%s", out)
+	}
+
+	out = h.run("", "get", "-crypt="+cryptID, "-allowunsigned")
+	if strings.Contains(out, "WARNING") == false || strings.Contains(out, "replaced") == false {
+		t.Errorf("-allowunsigned did not warn and decrypt:\n%s", out)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	alice := newTestHome(t)
+
+	// Alice's lawyer has their own account on the same server
+	lawyer := &testHome{t: t, dir: t.TempDir(), server: alice.server}
+	lawyer.run("", "register", "-nopassphrase")
+
+	lawyerKey := filepath.Join(alice.dir, "lawyer.asc")
+	aliceKey := filepath.Join(lawyer.dir, "alice.asc")
+	if err := ioutil.WriteFile(lawyerKey, []byte(lawyer.config().PublicKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(aliceKey, []byte(alice.config().PublicKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cryptID := alice.newCrypt("for my lawyer", "-recipient="+lawyerKey)
+
+	var index CryptIndex
+	b, _ := ioutil.ReadFile(filepath.Join(alice.dir, ".ripacrypt", "crypts.json"))
+	json.Unmarshal(b, &index)
+	if entry := index.Find(cryptID); entry == nil || len(entry.Recipients) != 1 || entry.Recipients[0] != lawyer.config().Fingerprint {
+		t.Errorf("recipient not recorded in the index: %+v", entry)
+	}
+
+	// The lawyer can decrypt it, but only trusts it once Alice is a contact
+	out := lawyer.runFail(exitCodes[ERRCRYPTO], "", "get", "-crypt="+cryptID)
+	if strings.Contains(out, "for my lawyer") == true {
+		t.Errorf("data from an unknown signer was released:\n%s", out)
+	}
+	lawyer.run("", "contact", "add", "-name=alice", aliceKey)
+	out = lawyer.run("", "get", "-crypt="+cryptID)
+	if strings.Contains(out, "for my lawyer") == false || strings.Contains(out, "Good signature from contact alice") == false {
+		t.Errorf("recipient could not decrypt:\n%s", out)
+	}
+	if out = alice.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "for my lawyer" {
+		t.Errorf("owner could not decrypt:\n%s", out)
+	}
+
+	// Recipients can come from the contacts keyring too
+	alice.run("", "contact", "add", "-name=lawyer", lawyerKey)
+	out = alice.run("", "contact", "list")
+	if strings.Contains(out, "lawyer") == false || strings.Contains(out, lawyer.config().Fingerprint) == false {
+		t.Errorf("contact not listed:\n%s", out)
+	}
+	cryptID = alice.newCrypt("shared again", "-recipient=lawyer")
+	if out = lawyer.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "shared again" {
+		t.Errorf("recipient from contacts could not decrypt:\n%s", out)
+	}
+
+	alice.runFail(exitCodes[ERRUSAGE], "data", "new", "-recipient=nobody")
+	alice.run("", "contact", "remove", "lawyer")
+	alice.runFail(exitCodes[ERRUSAGE], "data", "new", "-recipient=lawyer")
+}
+
+func TestImportSecretKey(t *testing.T) {
+	server := ripacrypttest.NewServer()
+	t.Cleanup(server.Close)
+	h := &testHome{t: t, dir: t.TempDir(), server: server}
+
+	publicKey, privateKey, err := ripacrypttest.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ripacrypttest.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPath := filepath.Join(h.dir, "public.asc")
+	secretPath := filepath.Join(h.dir, "secret.asc")
+	otherPath := filepath.Join(h.dir, "other.asc")
+	ioutil.WriteFile(publicPath, []byte(publicKey), 0600)
+	ioutil.WriteFile(secretPath, []byte(privateKey), 0600)
+	ioutil.WriteFile(otherPath, []byte(otherKey), 0600)
+
+	// Registering just the public key leaves us unable to do anything
+	h.run("", "register", "-publickey="+publicPath)
+	h.runFail(exitCodes[ERRCRYPTO], "secret", "new")
+
+	out := h.runFail(exitCodes[ERRCRYPTO], "", "key", "import", "-nopassphrase", otherPath)
+	if strings.Contains(out, "does not match") == false {
+		t.Errorf("mismatched secret key was imported:\n%s", out)
+	}
+	h.run("", "key", "import", "-nopassphrase", secretPath)
+	if h.config().PrivateKey == "" {
+		t.Fatal("secret key not stored")
+	}
+	h.runFail(exitCodes[ERRCONFIG], "", "key", "import", "-nopassphrase", secretPath)
+	h.run("", "key", "import", "-nopassphrase", "-force", secretPath)
+
+	cryptID := h.newCrypt("imported")
+	if out = h.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "imported" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+
+	// register can take the secret key directly, in binary form too
+	block, err := armor.Decode(strings.NewReader(otherKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryKey, _ := ioutil.ReadAll(block.Body)
+	binaryPath := filepath.Join(h.dir, "other.gpg")
+	ioutil.WriteFile(binaryPath, binaryKey, 0600)
+
+	h.env = []string{PROFILEENV + "=imported"}
+	h.run("", "register", "-nopassphrase", "-secretkey="+binaryPath)
+	cryptID = h.newCrypt("imported again")
+	if out = h.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "imported again" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+}
+
+func TestGPGKeyBackend(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+
+	server := ripacrypttest.NewServer()
+	t.Cleanup(server.Close)
+	h := &testHome{t: t, dir: t.TempDir(), server: server}
+
+	// gpg uses $HOME/.gnupg like rcrypt uses $HOME/.ripacrypt
+	gnupgHome := filepath.Join(h.dir, ".gnupg")
+	os.Mkdir(gnupgHome, 0700)
+	t.Cleanup(func() { exec.Command("gpgconf", "--homedir", gnupgHome, "--kill", "gpg-agent").Run() })
+
+	publicKey, privateKey, err := ripacrypttest.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, otherPrivate, err := ripacrypttest.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{privateKey, otherPrivate} {
+		cmd := exec.Command("gpg", "--homedir", gnupgHome, "--batch", "--import")
+		cmd.Stdin = strings.NewReader(key)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("gpg --import: %v\n%s", err, out)
+		}
+	}
+	fingerprint, _ := ripacrypt.VerifyGPGPublicKey(publicKey)
+	otherFingerprint, _ := ripacrypt.VerifyGPGPublicKey(otherPublic)
+
+	h.runFail(exitCodes[ERRUSAGE], "", "register", "-gpgkey="+fingerprint, "-secretkey=secret.asc")
+	h.run("", "register", "-gpgkey="+fingerprint)
+	conf := h.config()
+	if conf.KeyBackend != KEYBACKENDGPG || conf.PrivateKey != "" || conf.Fingerprint != fingerprint {
+		t.Fatalf("unexpected config after registering a gpg key: %+v", conf)
+	}
+
+	cryptID := h.newCrypt("from gpg")
+	if out := h.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "from gpg" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+	h.run("", "checkin", "-crypt="+cryptID)
+	if out := h.run("", "getchallenge", "-decrypt"); strings.Contains(out, "The cleartext challenge is:") == false {
+		t.Errorf("challenge not decrypted by gpg:\n%s", out)
+	}
+	h.runFail(exitCodes[ERRCONFIG], "", "passwd")
+
+	// An account with its key in rc.conf can hand it over to gpg
+	h.env = []string{PROFILEENV + "=moved"}
+	otherPath := filepath.Join(h.dir, "other.asc")
+	ioutil.WriteFile(otherPath, []byte(otherPrivate), 0600)
+	h.run("", "register", "-nopassphrase", "-secretkey="+otherPath)
+	cryptID = h.newCrypt("moved to gpg")
+
+	h.runFail(exitCodes[ERRCRYPTO], "", "key", "gpg", "-force", fingerprint)
+	h.runFail(exitCodes[ERRCONFIG], "", "key", "gpg", otherFingerprint)
+	h.run("", "key", "gpg", "-force", otherFingerprint)
+
+	b, err := ioutil.ReadFile(filepath.Join(h.dir, ".ripacrypt", "rc.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var configFile ConfigFile
+	json.Unmarshal(b, &configFile)
+	if moved := configFile.Profiles["moved"]; moved.PrivateKey != "" || moved.KeyBackend != KEYBACKENDGPG {
+		t.Errorf("private key still in the config after key gpg: %+v", moved)
+	}
+	if out := h.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "moved to gpg" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+}
+
+func TestWhoamiAndFingerprintMigration(t *testing.T) {
+	h := newTestHome(t)
+	conf := h.config()
+	if matched, _ := regexp.MatchString("^[0-9A-F]{40}$", conf.Fingerprint); matched == false {
+		t.Fatalf("expected a full fingerprint, got %q", conf.Fingerprint)
+	}
+
+	out := h.run("", "whoami")
+	for _, want := range []string{conf.Fingerprint, "RSA 2048", fmt.Sprintf("%d", conf.UserID)} {
+		if strings.Contains(out, want) == false {
+			t.Errorf("whoami does not show %s:\n%s", want, out)
+		}
+	}
+
+	// Older versions stored (and sent the server) just the key ID
+	cryptID := h.newCrypt("before the upgrade")
+	configPath := filepath.Join(h.dir, ".ripacrypt", "rc.conf")
+	legacy := conf
+	legacy.Fingerprint = conf.Fingerprint[24:]
+	b, _ := json.Marshal(ConfigFile{Profiles: map[string]CoreConf{DEFAULTPROFILE: legacy}})
+	if err := ioutil.WriteFile(configPath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h.run("", "checkin", "-crypt="+cryptID)
+	if h.config().Fingerprint != conf.Fingerprint {
+		t.Errorf("fingerprint not migrated, got %q", h.config().Fingerprint)
+	}
+}
+
+func TestKeyTypeAndPreferences(t *testing.T) {
+	server := ripacrypttest.NewServer()
+	t.Cleanup(server.Close)
+	h := &testHome{t: t, dir: t.TempDir(), server: server}
+
+	h.runFail(exitCodes[ERRUSAGE], "", "register", "-nopassphrase", "-keytype=dsa1024")
+	h.runFail(exitCodes[ERRUSAGE], "", "register", "-nopassphrase", "-cipher=des")
+
+	h.run("", "register", "-nopassphrase", "-keytype=rsa3072", "-cipher=aes256", "-compression=zlib")
+	conf := h.config()
+	if conf.KeyType != "rsa3072" || conf.Cipher != "aes256" || conf.Compression != "zlib" {
+		t.Fatalf("choices not recorded: %+v", conf)
+	}
+	out := h.run("", "whoami")
+	for _, want := range []string{"RSA 3072", "rsa3072", "aes256", "zlib"} {
+		if strings.Contains(out, want) == false {
+			t.Errorf("whoami does not show %s:\n%s", want, out)
+		}
+	}
+
+	// The crypt itself is encrypted with the chosen cipher
+	cryptID := h.newCrypt("preferences")
+	crypt, _ := h.server.Crypt(cryptID)
+	keyRing, err := openpgp.ReadArmoredKeyRing(strings.NewReader(conf.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherText, _ := base64.StdEncoding.DecodeString(crypt.CipherText)
+	p, err := packet.Read(bytes.NewReader(cipherText))
+	encryptedKey, ok := p.(*packet.EncryptedKey)
+	if err != nil || ok == false {
+		t.Fatalf("expected an encrypted session key, got %T %v", p, err)
+	}
+	if err = encryptedKey.Decrypt(keyRing[0].Subkeys[0].PrivateKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	if encryptedKey.CipherFunc != packet.CipherAES256 {
+		t.Errorf("crypt encrypted with cipher %d, expected AES256", encryptedKey.CipherFunc)
+	}
+
+	if out = h.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "preferences" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+}
+
+func TestEd25519Key(t *testing.T) {
+	server := ripacrypttest.NewServer()
+	t.Cleanup(server.Close)
+	h := &testHome{t: t, dir: t.TempDir(), server: server}
+
+	h.run("", "register", "-nopassphrase", "-keytype=ed25519")
+	conf := h.config()
+	keyRing, err := openpgp.ReadArmoredKeyRing(strings.NewReader(conf.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyRing[0].PrimaryKey.PubKeyAlgo != packet.PubKeyAlgoEdDSA || len(keyRing[0].Subkeys) != 1 || keyRing[0].Subkeys[0].PublicKey.PubKeyAlgo != packet.PubKeyAlgoECDH {
+		t.Fatalf("expected an Ed25519 key with a Curve25519 subkey")
+	}
+	if out := h.run("", "whoami"); strings.Contains(out, "EdDSA") == false || strings.Contains(out, "ed25519") == false {
+		t.Errorf("whoami does not show the key type:\n%s", out)
+	}
+
+	cryptID := h.newCrypt("elliptic")
+	if out := h.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "elliptic" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+
+	// Rotating to RSA and back re-encrypts between the two
+	h.run("", "key", "rotate", "-nopassphrase", "-keytype=rsa2048")
+	h.run("", "key", "rotate", "-nopassphrase", "-keytype=ed25519")
+	if out := h.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "elliptic" {
+		t.Errorf("unexpected crypt contents after rotating:\n%s", out)
+	}
+}
+
+func TestKeyRotate(t *testing.T) {
+	h := newTestHome(t)
+
+	lawyer := &testHome{t: t, dir: t.TempDir(), server: h.server}
+	lawyer.run("", "register", "-nopassphrase")
+	lawyerKey := filepath.Join(h.dir, "lawyer.asc")
+	if err := ioutil.WriteFile(lawyerKey, []byte(lawyer.config().PublicKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 3000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	plainID := h.newCrypt("before the rotation")
+	chunkedID := h.newCrypt(string(data), "-chunksize=1024")
+
+	// Shared straight from the key file, never added to the contacts
+	sharedID := h.newCrypt("for my lawyer", "-recipient="+lawyerKey)
+
+	// Encrypted by the user to a key of their choosing, so left alone
+	preEncryptedID := h.newCrypt("not ours to re-encrypt", "-isencrypted")
+	destroyedID := h.newCrypt("gone")
+	h.run("", "destroy", "-yes", "-crypt="+destroyedID)
+	before, _ := h.server.Crypt(sharedID)
+	old := h.config()
+
+	// A crypt which can't be updated holds the rotation up, but the old key
+	// is kept so nothing becomes unreadable
+	h.server.FailReply("PUT", "crypt", 502)
+	out := h.runFail(exitCodes[ERRSERVER], "", "key", "rotate", "-nopassphrase")
+	if strings.Contains(out, "[1/4] "+plainID+" failed") == false || strings.Contains(out, "rcrypt key rotate again") == false {
+		t.Errorf("failure not reported:\n%s", out)
+	}
+	conf := h.config()
+	if conf.Fingerprint == old.Fingerprint || len(conf.RetiredKeys) != 1 || conf.RetiredKeys[0].Fingerprint != old.Fingerprint {
+		t.Fatalf("old key not retired: %s %+v", conf.Fingerprint, conf.RetiredKeys)
+	}
+	if out = h.run("", "whoami"); strings.Contains(out, old.Fingerprint) == false {
+		t.Errorf("whoami does not show the retired key:\n%s", out)
+	}
+	if out = h.stdout("", "get", "-crypt="+plainID); strings.TrimSpace(out) != "before the rotation" {
+		t.Errorf("unmigrated crypt unreadable:\n%s", out)
+	}
+	if after, _ := h.server.Crypt(sharedID); after.CipherText == before.CipherText {
+		t.Error("crypt was not re-encrypted")
+	}
+
+	out = h.run("", "key", "rotate", "-nopassphrase")
+	if strings.Contains(out, "Resuming") == false || strings.Contains(out, "[1/4] "+plainID+" re-encrypted") == false || strings.Contains(out, "[3/4] "+sharedID+" re-encrypted") == false || strings.Contains(out, "[4/4] "+preEncryptedID+" skipped") == false {
+		t.Errorf("rotation not resumed:\n%s", out)
+	}
+	conf = h.config()
+	if len(conf.RetiredKeys) != 0 {
+		t.Errorf("old key kept after every crypt was migrated: %+v", conf.RetiredKeys)
+	}
+
+	// Everything is readable, and the account usable, with the new key alone
+	if out = h.stdout("", "get", "-crypt="+plainID); strings.TrimSpace(out) != "before the rotation" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+	if out = h.stdout("", "get", "-out=-", "-crypt="+chunkedID); out != string(data) {
+		t.Error("chunked crypt did not survive the rotation")
+	}
+	h.run("", "checkin", "-crypt="+chunkedID)
+
+	// The lawyer needs the new key to trust the re-signed crypt
+	aliceKey := filepath.Join(lawyer.dir, "alice.asc")
+	if err := ioutil.WriteFile(aliceKey, []byte(conf.PublicKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lawyer.run("", "contact", "add", "-name=alice", aliceKey)
+	if out = lawyer.stdout("", "get", "-crypt="+sharedID); strings.TrimSpace(out) != "for my lawyer" {
+		t.Errorf("recipient could not decrypt after the rotation:\n%s", out)
+	}
+
+	h.runFail(exitCodes[ERRUSAGE], "", "key", "rotate", "-keytype=dsa1024")
+}
+
+func TestKeyRotateForgottenCrypt(t *testing.T) {
+	h := newTestHome(t)
+	keptID := h.newCrypt("kept")
+	forgottenID := h.newCrypt("purged by the server")
+	h.server.Forget(forgottenID)
+
+	// A crypt the server no longer knows has nothing left to migrate
+	out := h.run("", "key", "rotate", "-nopassphrase")
+	if strings.Contains(out, forgottenID+" has been destroyed") == false || strings.Contains(out, keptID+" re-encrypted") == false {
+		t.Errorf("forgotten crypt not treated as destroyed:\n%s", out)
+	}
+	if conf := h.config(); len(conf.RetiredKeys) != 0 {
+		t.Errorf("rotation held up by a forgotten crypt: %+v", conf.RetiredKeys)
+	}
+}
+
+func TestKeyRotateRekeyFailure(t *testing.T) {
+	h := newTestHome(t)
+	cryptID := h.newCrypt("rotate me")
+	old := h.config()
+
+	// A refusal means the server still has the old key, so it is kept
+	h.server.Disable("POST", "rekey")
+	out := h.runFail(exitCodes[ERRSERVER], "", "key", "rotate", "-nopassphrase")
+	if strings.Contains(out, "does not support rotating keys") == false {
+		t.Errorf("refusal not reported:\n%s", out)
+	}
+	if conf := h.config(); conf.Fingerprint != old.Fingerprint || len(conf.RetiredKeys) != 0 || conf.RekeyPending == true {
+		t.Fatalf("refused rotation not rolled back: %s %+v", conf.Fingerprint, conf.RetiredKeys)
+	}
+
+	// The server switches keys but the reply is lost, the new key must survive
+	h = newTestHome(t)
+	cryptID = h.newCrypt("rotate me")
+	old = h.config()
+	h.server.FailReply("POST", "rekey", 502)
+	out = h.runFail(exitCodes[ERRSERVER], "", "key", "rotate", "-nopassphrase")
+	if strings.Contains(out, "rcrypt key rotate again") == false {
+		t.Errorf("failure not reported:\n%s", out)
+	}
+	conf := h.config()
+	if conf.Fingerprint == old.Fingerprint || conf.RekeyPending == false || len(conf.RetiredKeys) != 1 {
+		t.Fatalf("new key not kept pending: %s %+v", conf.Fingerprint, conf.RetiredKeys)
+	}
+	if out = h.run("", "whoami"); strings.Contains(out, "not yet confirmed") == false {
+		t.Errorf("whoami does not show the pending key:\n%s", out)
+	}
+
+	// Challenges are now encrypted to the new key
+	h.run("", "checkin", "-crypt="+cryptID)
+
+	out = h.run("", "key", "rotate", "-nopassphrase")
+	if strings.Contains(out, "Registered your new key") == false || strings.Contains(out, cryptID+" re-encrypted") == false {
+		t.Errorf("rotation not resumed:\n%s", out)
+	}
+	if conf = h.config(); conf.RekeyPending == true || len(conf.RetiredKeys) != 0 {
+		t.Errorf("rotation not finished: %+v", conf)
+	}
+	if out = h.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "rotate me" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	h := newTestHome(t)
+	h.env = []string{PASSPHRASEENV + "=correct horse"}
+
+	cryptID := h.newCrypt("survives the laptop")
+	contactKey := filepath.Join(h.dir, "contact.asc")
+	if err := ioutil.WriteFile(contactKey, []byte(h.config().PublicKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h.run("", "contact", "add", "-name=me", contactKey)
+
+	backupPath := filepath.Join(h.dir, "rcrypt.backup")
+	h.run("", "backup", "-out="+backupPath)
+	b, err := ioutil.ReadFile(backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(string(b), "-----BEGIN PGP MESSAGE-----") == false || strings.Contains(string(b), cryptID) == true {
+		t.Errorf("backup is not an encrypted OpenPGP message:\n%s", b)
+	}
+	h.runFail(exitCodes[ERRLOCAL], "", "backup", "-out="+backupPath)
+
+	// A new machine
+	other := &testHome{t: t, dir: t.TempDir(), server: h.server, env: h.env}
+	other.run("", "restore", "-in="+backupPath)
+	if conf := other.config(); conf.UserID != h.config().UserID || conf.PrivateKey != h.config().PrivateKey {
+		t.Errorf("account not restored: %+v", conf)
+	}
+	if out := other.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "survives the laptop" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+	if out := other.run("", "list"); strings.Contains(out, cryptID) == false {
+		t.Errorf("crypt index not restored:\n%s", out)
+	}
+	if out := other.run("", "contact", "list"); strings.Contains(out, "me") == false {
+		t.Errorf("contacts not restored:\n%s", out)
+	}
+	other.run("", "checkin", "-crypt="+cryptID)
+
+	// A registered profile is only replaced when forced, and never with a
+	// backup that can't be decrypted
+	other.runFail(exitCodes[ERRCONFIG], "", "restore", "-in="+backupPath)
+	other.env = []string{PASSPHRASEENV + "=wrong"}
+	other.runFail(exitCodes[ERRCRYPTO], "", "restore", "-force", "-in="+backupPath)
+	other.env = h.env
+	other.run("", "restore", "-force", "-in="+backupPath)
+}
+
+func TestPaperKey(t *testing.T) {
+	h := newTestHome(t)
+	cryptID := h.newCrypt("on paper")
+
+	out := h.stdout("", "export-paper", "-nopassphrase")
+	if strings.Contains(out, "RIPACRYPT PAPER KEY V1") == false || strings.Contains(out, "NOT passphrase protected") == false {
+		t.Errorf("unexpected paper key:\n%s", out)
+	}
+
+	// Protect the key so the paper copy is protected too
+	conf := h.config()
+	protected, err := ripacrypt.ProtectPrivateKey(conf.PrivateKey, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.PrivateKey = protected
+	b, _ := json.Marshal(ConfigFile{Profiles: map[string]CoreConf{DEFAULTPROFILE: conf}})
+	if err = ioutil.WriteFile(filepath.Join(h.dir, ".ripacrypt", "rc.conf"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	h.env = []string{PASSPHRASEENV + "=hunter2"}
+
+	paperPath := filepath.Join(h.dir, "paper.txt")
+	qrPrefix := filepath.Join(h.dir, "paper")
+	h.run("", "export-paper", "-out="+paperPath, "-png="+qrPrefix)
+	b, err = ioutil.ReadFile(paperPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paper := string(b)
+	if strings.Contains(paper, "protected by your passphrase") == false {
+		t.Errorf("paper key not protected:\n%s", paper)
+	}
+	qrCodes, _ := filepath.Glob(qrPrefix + "-*.png")
+	if len(qrCodes) == 0 {
+		t.Fatal("no QR codes written")
+	}
+	for _, qrCode := range qrCodes {
+		f, err := os.Open(qrCode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = png.Decode(f); err != nil {
+			t.Errorf("%s is not a PNG: %v", qrCode, err)
+		}
+		f.Close()
+	}
+
+	other := &testHome{t: t, dir: t.TempDir(), server: h.server, env: h.env}
+	other.run("", "import-paper", "-in="+paperPath)
+	if restored := other.config(); restored.UserID != conf.UserID || restored.Fingerprint != conf.Fingerprint || restored.PublicKey == "" || ripacrypt.IsPrivateKeyProtected(restored.PrivateKey) == false {
+		t.Errorf("account not restored: %+v", restored)
+	}
+	if out = other.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "on paper" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+
+	// A typing mistake is pinned to its line
+	lines := strings.Split(paper, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "002: ") {
+			lines[i] = line[:5] + "ZZZZ" + line[9:]
+		}
+	}
+	if strings.Join(lines, "\n") == paper {
+		t.Fatal("no line 002 to alter")
+	}
+	out = other.runFail(exitCodes[ERRCONFIG], strings.Join(lines, "\n"), "import-paper", "-force")
+	if strings.Contains(out, "line 002") == false {
+		t.Errorf("typo not reported:\n%s", out)
+	}
+
+	// Scanned QR codes come out as one line of words each
+	var words []string
+	for _, line := range strings.Split(paper, "\n") {
+		if strings.HasPrefix(line, "#") == false {
+			words = append(words, strings.Fields(line)...)
+		}
+	}
+	other.run(strings.ToLower(strings.Join(words, " ")), "import-paper", "-force")
+
+	// The old key of an unfinished rotation wouldn't be on the paper
+	h.server.FailReply("PUT", "crypt", 502)
+	h.runFail(exitCodes[ERRSERVER], "", "key", "rotate")
+	out = h.runFail(exitCodes[ERRCONFIG], "", "export-paper", "-out="+paperPath, "-force")
+	if strings.Contains(out, "rotation hasn't finished") == false {
+		t.Errorf("export during a rotation not refused:\n%s", out)
+	}
+}
+
+func TestListAndStatus(t *testing.T) {
+	h := newTestHome(t)
+
+	out := h.run("", "list")
+	if strings.Contains(out, "not created any crypts") == false {
+		t.Errorf("unexpected output for an empty index:\n%s", out)
+	}
+
+	cryptID := h.newCrypt("secret", "-description=usb stick", "-checkinduration=600", "-misscount=2")
+
+	out = h.run("", "list")
+	if strings.Contains(out, cryptID) == false || strings.Contains(out, "usb stick") == false {
+		t.Errorf("crypt missing from list:\n%s", out)
+	}
+
+	out = h.run("", "status", "-crypt="+cryptID)
+	if strings.Contains(out, "usb stick") == false || strings.Contains(out, "Time remaining:") == false {
+		t.Errorf("unexpected status output:\n%s", out)
+	}
+}
+
+func TestCheckin(t *testing.T) {
+	h := newTestHome(t)
+
+	cryptID := h.newCrypt("secret", "-checkinduration=60", "-misscount=2")
+	h.server.Advance(90 * time.Second)
+
+	out := h.run("", "checkin", "-crypt="+cryptID)
+	if strings.Contains(out, "checked in") == false {
+		t.Fatalf("unexpected checkin output:\n%s", out)
+	}
+
+	h.server.Advance(90 * time.Second)
+	if crypt, _ := h.server.Crypt(cryptID); crypt.IsDestroyed == true {
+		t.Error("crypt destroyed despite checking in")
+	}
+}
+
+func TestGetDestroyedByDeadline(t *testing.T) {
+	h := newTestHome(t)
+
+	cryptID := h.newCrypt("secret", "-checkinduration=60", "-misscount=1")
+	h.server.Advance(61 * time.Second)
+
+	out := h.runFail(exitCodes[ERRDESTROYED], "", "get", "-crypt="+cryptID)
+	if strings.Contains(out, "has been destroyed") == false {
+		t.Errorf("unexpected output for a destroyed crypt:\n%s", out)
+	}
+
+	out = h.runFail(exitCodes[ERRDESTROYED], "", "checkin", "-crypt="+cryptID)
+	if strings.Contains(out, "has been destroyed") == false {
+		t.Errorf("unexpected checkin output for a destroyed crypt:\n%s", out)
+	}
+
+	h.runFail(exitCodes[ERRNOTFOUND], "", "checkin", "-crypt=doesnotexist")
+}
+
+func TestDestroy(t *testing.T) {
+	h := newTestHome(t)
+
+	cryptID := h.newCrypt("secret")
+
+	out := h.runFail(exitCodes[ERRABORTED], "no\n", "destroy", "-crypt="+cryptID)
+	if strings.Contains(out, "Not destroying") == false {
+		t.Fatalf("destroy went ahead without confirmation:\n%s", out)
+	}
+
+	out = h.run("", "destroy", "-crypt="+cryptID, "-yes")
+	if strings.Contains(out, "Verified that crypt") == false {
+		t.Errorf("unexpected destroy output:\n%s", out)
+	}
+
+	out = h.run("", "list")
+	if strings.Contains(out, "destroyed") == false {
+		t.Errorf("destroyed crypt not marked in the index:\n%s", out)
+	}
+}
+
+func TestGetChallenge(t *testing.T) {
+	h := newTestHome(t)
+
+	out := h.run("", "getchallenge", "-decrypt")
+	if strings.Contains(out, "The cleartext challenge is:") == false {
+		t.Errorf("unexpected getchallenge output:\n%s", out)
+	}
+}
+
+func TestNewBTC(t *testing.T) {
+	h := newTestHome(t)
+
+	out := h.run("", "newbtc")
+	if strings.Contains(out, "Your new bitcoin address is:  1mock") == false {
+		t.Errorf("unexpected newbtc output:\n%s", out)
+	}
+}
+
+func TestPassphraseFromEnvironment(t *testing.T) {
+	h := newTestHome(t)
+
+	// Protect the key as if we had registered interactively, writing the
+	// config in the layout used before profiles existed
+	conf := h.config()
+	protected, err := ripacrypt.ProtectPrivateKey(conf.PrivateKey, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.PrivateKey = protected
+	b, _ := json.Marshal(conf)
+	if err = ioutil.WriteFile(filepath.Join(h.dir, ".ripacrypt", "rc.conf"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h.env = []string{PASSPHRASEENV + "=hunter2"}
+	cryptID := h.newCrypt("secret")
+
+	out := h.stdout("", "get", "-crypt="+cryptID)
+	if strings.TrimSpace(out) != "secret" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+
+	// Changing the passphrase unattended needs the new one spelled out
+	out = h.runFail(exitCodes[ERRCRYPTO], "", "passwd")
+	if strings.Contains(out, NEWPASSPHRASEENV) == false {
+		t.Errorf("passwd with an unchanged passphrase not explained:\n%s", out)
+	}
+	h.env = append(h.env, NEWPASSPHRASEENV+"=correct horse")
+	h.run("", "passwd")
+	h.env = []string{PASSPHRASEENV + "=correct horse"}
+	if out = h.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "secret" {
+		t.Errorf("unexpected crypt contents after passwd:\n%s", out)
+	}
+
+	// The new key from a rotation is protected with the same passphrase
+	h.run("", "key", "rotate")
+	if ripacrypt.IsPrivateKeyProtected(h.config().PrivateKey) == false {
+		t.Error("rotated key not protected")
+	}
+	if out = h.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "secret" {
+		t.Errorf("unexpected crypt contents after rotating:\n%s", out)
+	}
+
+	h.run("", "passwd", "-nopassphrase")
+	if ripacrypt.IsPrivateKeyProtected(h.config().PrivateKey) == true {
+		t.Error("passwd -nopassphrase left the key protected")
+	}
+
+	// Registering unattended
+	other := &testHome{t: t, dir: t.TempDir(), server: h.server, env: []string{PASSPHRASEENV + "=hunter2"}}
+	other.run("", "register")
+	if ripacrypt.IsPrivateKeyProtected(other.config().PrivateKey) == false {
+		t.Error("key registered with " + PASSPHRASEENV + " not protected")
+	}
+	other.run("", "getchallenge", "-decrypt")
+}
+
+func TestAgentPassphrase(t *testing.T) {
+	h := newTestHome(t)
+	cryptID := h.newCrypt("secret")
+
+	conf := h.config()
+	protected, err := ripacrypt.ProtectPrivateKey(conf.PrivateKey, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.PrivateKey = protected
+	b, _ := json.Marshal(ConfigFile{Profiles: map[string]CoreConf{DEFAULTPROFILE: conf}})
+	if err = ioutil.WriteFile(filepath.Join(h.dir, ".ripacrypt", "rc.conf"), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stand in for gpg-connect-agent which logs the commands it is sent and
+	// answers GET_PASSPHRASE with whatever is in agent.passphrase
+	agentDir := t.TempDir()
+	logPath := filepath.Join(agentDir, "agent.log")
+	passphrasePath := filepath.Join(agentDir, "agent.passphrase")
+	script := "#!/bin/sh\nread command\necho \"$command\" >>" + logPath + "\ncase \"$command\" in\nGET_PASSPHRASE*) echo \"OK $(cat " + passphrasePath + ")\" ;;\n*) echo OK ;;\nesac\n"
+	if err = ioutil.WriteFile(filepath.Join(agentDir, "gpg-connect-agent"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	h.env = []string{PASSPHRASEAGENTENV + "=1", "PATH=" + agentDir + string(os.PathListSeparator) + os.Getenv("PATH")}
+
+	ioutil.WriteFile(passphrasePath, []byte(hex.EncodeToString([]byte("hunter2"))), 0600)
+	if out := h.stdout("", "get", "-crypt="+cryptID); strings.TrimSpace(out) != "secret" {
+		t.Errorf("unexpected crypt contents:\n%s", out)
+	}
+	agentLog, _ := ioutil.ReadFile(logPath)
+	if strings.HasPrefix(string(agentLog), "GET_PASSPHRASE rcrypt:"+DEFAULTPROFILE+" X ") == false {
+		t.Errorf("unexpected gpg-agent commands:\n%s", agentLog)
+	}
+
+	// A wrong passphrase isn't left in the agent's cache
+	ioutil.WriteFile(passphrasePath, []byte(hex.EncodeToString([]byte("wrong"))), 0600)
+	h.runFail(exitCodes[ERRCRYPTO], "", "get", "-crypt="+cryptID)
+	agentLog, _ = ioutil.ReadFile(logPath)
+	if strings.HasSuffix(string(agentLog), "CLEAR_PASSPHRASE rcrypt:"+DEFAULTPROFILE+"\n") == false {
+		t.Errorf("wrong passphrase not cleared from gpg-agent:\n%s", agentLog)
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	h := newTestHome(t)
+
+	cryptID := h.newCrypt("secret", "-checkinduration=2", "-misscount=3")
+	listPath := filepath.Join(h.dir, "crypts.list")
+	if err := ioutil.WriteFile(listPath, []byte("# test crypts\n"+cryptID+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	logPath := filepath.Join(h.dir, "daemon.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+
+	cmd := h.command("", "daemon", "-crypts="+listPath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		b, _ := ioutil.ReadFile(logPath)
+		if strings.Contains(string(b), "Checked in with crypt "+cryptID) {
+			break
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			t.Fatalf("daemon never checked in:\n%s", b)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("daemon did not exit cleanly: %v", err)
+	}
+
+	if crypt, _ := h.server.Crypt(cryptID); crypt.LastCheckIn == 0 {
+		t.Error("server never saw the daemons checkin")
+	}
+}
+
+func TestPanic(t *testing.T) {
+	h := newTestHome(t)
+
+	cryptID := h.newCrypt("secret")
+	h.run("", "-profile=other", "register", "-nopassphrase")
+
+	configPath := filepath.Join(h.dir, ".ripacrypt", "rc.conf")
+	indexPath := filepath.Join(h.dir, ".ripacrypt", "crypts.json")
+
+	// What get -out saved goes with the profile
+	savedPath := filepath.Join(h.dir, "secret.txt")
+	h.run("", "get", "-crypt="+cryptID, "-out="+savedPath)
+
+	out := h.runFail(exitCodes[ERRABORTED], "no\n", "panic")
+	if strings.Contains(out, "Not wiping profile") == false {
+		t.Fatalf("panic went ahead without confirmation:\n%s", out)
+	}
+
+	out = h.run("", "panic", "-destroy", "-yes")
+	if strings.Contains(out, "Destroyed crypt "+cryptID) == false || strings.Contains(out, "Wiped "+indexPath) == false {
+		t.Errorf("unexpected panic output:\n%s", out)
+	}
+	if crypt, _ := h.server.Crypt(cryptID); crypt.IsDestroyed == false {
+		t.Error("panic -destroy left the crypt alive")
+	}
+	if _, err := os.Stat(indexPath); os.IsNotExist(err) == false {
+		t.Errorf("crypt index survived the panic: %v", err)
+	}
+	if _, err := os.Stat(savedPath); os.IsNotExist(err) == false || strings.Contains(out, "Wiped "+savedPath) == false {
+		t.Errorf("get -out file survived the panic: %v\n%s", err, out)
+	}
+
+	// The other profile is left alone
+	b, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var configFile ConfigFile
+	if err = json.Unmarshal(b, &configFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := configFile.Profiles[DEFAULTPROFILE]; exists == true {
+		t.Error("the wiped profile is still in rc.conf")
+	}
+	if configFile.Profiles["other"].PrivateKey == "" {
+		t.Error("the other profile was lost")
+	}
+
+	h.run("", "-profile=other", "panic", "-yes")
+	if _, err = os.Stat(configPath); os.IsNotExist(err) == false {
+		t.Errorf("rc.conf survived wiping the last profile: %v", err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(h.dir, ".ripacrypt", "*")); len(leftovers) != 0 {
+		t.Errorf("files left behind: %v", leftovers)
+	}
+}
+
+func TestDaemonAfterRotate(t *testing.T) {
+	h := newTestHome(t)
+
+	cryptID := h.newCrypt("secret", "-checkinduration=2", "-misscount=3")
+	listPath := filepath.Join(h.dir, "crypts.list")
+	if err := ioutil.WriteFile(listPath, []byte(cryptID+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	logPath := filepath.Join(h.dir, "daemon.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+
+	cmd := h.command("", "daemon", "-crypts="+listPath)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	waitFor := func(after, message string) {
+		t.Helper()
+		deadline := time.Now().Add(20 * time.Second)
+		for {
+			b, _ := ioutil.ReadFile(logPath)
+			daemonLog := string(b)
+			if i := strings.Index(daemonLog, after); i != -1 && strings.Contains(daemonLog[i:], message) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("daemon never logged %q after %q:\n%s", message, after, daemonLog)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	waitFor("", "Checked in with crypt "+cryptID)
+
+	// The old key can't answer challenges once the server has the new one
+	out := h.run("", "key", "rotate", "-nopassphrase")
+	if strings.Contains(out, "SIGHUP") == false {
+		t.Errorf("rotate does not mention reloading the daemon:\n%s", out)
+	}
+	cmd.Process.Signal(syscall.SIGHUP)
+	waitFor("reloading profile", "Checked in with crypt "+cryptID)
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("daemon did not exit cleanly: %v", err)
+	}
+}
+
+func TestDaemonPanic(t *testing.T) {
+	h := newTestHome(t)
+
+	watchedID := h.newCrypt("secret", "-checkinduration=2", "-misscount=3")
+	otherID := h.newCrypt("other secret")
+	listPath := filepath.Join(h.dir, "crypts.list")
+	if err := ioutil.WriteFile(listPath, []byte(watchedID+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	logPath := filepath.Join(h.dir, "daemon.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+
+	cmd := h.command("", "daemon", "-crypts="+listPath, "-panicdestroy")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		b, _ := ioutil.ReadFile(logPath)
+		if strings.Contains(string(b), "Next checkin with crypt "+watchedID) {
+			break
+		}
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			t.Fatalf("daemon never fetched the crypt:\n%s", b)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	h.run("", "destroy", "-yes", "-crypt="+watchedID)
+
+	select {
+	case err = <-exited:
+		if err != nil {
+			t.Errorf("daemon did not exit cleanly: %v", err)
+		}
+	case <-time.After(20 * time.Second):
+		cmd.Process.Kill()
+		b, _ := ioutil.ReadFile(logPath)
+		t.Fatalf("daemon never wiped the profile:\n%s", b)
+	}
+
+	if crypt, _ := h.server.Crypt(otherID); crypt.IsDestroyed == false {
+		t.Error("-panicdestroy left the other crypt alive")
+	}
+	if _, err = os.Stat(filepath.Join(h.dir, ".ripacrypt", "rc.conf")); os.IsNotExist(err) == false {
+		t.Errorf("rc.conf survived the panic: %v", err)
+	}
+	if _, err = os.Stat(listPath); os.IsNotExist(err) == false {
+		t.Errorf("crypt list survived the panic: %v", err)
+	}
+}
+
+func TestConfigShow(t *testing.T) {
+	h := newTestHome(t)
+
+	out := h.run("", "config", "show")
+	if strings.Contains(out, h.server.URL+"\t(environment "+APIURLENV+")") == false {
+		t.Errorf("API URL not taken from the environment:\n%s", out)
+	}
+	if strings.Contains(out, ripacrypt.TORSOCKS+"\t(default)") == false {
+		t.Errorf("SOCKS address not defaulted:\n%s", out)
+	}
+	if strings.Contains(out, "usetor\t\tfalse\t(default)") == false {
+		t.Errorf("Tor not reported as off by default:\n%s", out)
+	}
+	if out = h.run("", "config", "show", "-usetor"); strings.Contains(out, "usetor\t\ttrue\t(flag -usetor)") == false {
+		t.Errorf("Tor not reported as taken from the flag:\n%s", out)
+	}
+	h.run("", "profile", "add", "-usetor", "tor")
+	if out = h.run("", "-profile=tor", "config", "show"); strings.Contains(out, "usetor\t\ttrue\t(config file)") == false {
+		t.Errorf("Tor not reported as taken from the config file:\n%s", out)
+	}
+
+	out = h.run("", "-url=http://localhost:1/1", "-socks=localhost:9150", "config", "show")
+	if strings.Contains(out, "http://localhost:1/1/\t(flag -url)") == false {
+		t.Errorf("API URL not taken from the flag:\n%s", out)
+	}
+	if strings.Contains(out, "localhost:9150\t(flag -socks)") == false {
+		t.Errorf("SOCKS address not taken from the flag:\n%s", out)
+	}
+
+	out = h.runFail(exitCodes[ERRCONFIG], "", "-socks=localhost", "config", "show")
+	if strings.Contains(out, "invalid SOCKS address from flag -socks") == false {
+		t.Errorf("invalid SOCKS address accepted:\n%s", out)
+	}
+}
+
+// runJSON invokes rcrypt with -output=json and decodes the report it writes
+// to stdout, returning it along with the exit code
+func (h *testHome) runJSON(args ...string) (Report, int) {
+	h.t.Helper()
+
+	cmd := h.command("", append([]string{"-output=json"}, args...)...)
+	out, err := cmd.Output()
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		h.t.Fatal(err)
+	}
+
+	var report Report
+	decoder := json.NewDecoder(strings.NewReader(string(out)))
+	if err = decoder.Decode(&report); err != nil {
+		h.t.Fatalf("stdout is not a JSON document: %v\n%s", err, out)
+	}
+	if decoder.More() == true {
+		h.t.Fatalf("more than one JSON document on stdout:\n%s", out)
+	}
+	return report, exitCode
+}
+
+func TestJSONOutput(t *testing.T) {
+	h := newTestHome(t)
+
+	cryptID := h.newCrypt("secret", "-description=usb stick")
+
+	report, _ := h.runJSON("get", "-crypt="+cryptID)
+	result, _ := report.Result.(map[string]interface{})
+	if report.Success == false || report.StatusCode != 200 || result["plaintext"] != "secret" || result["crypt_id"] != cryptID {
+		t.Errorf("unexpected report for get %+v", report)
+	}
+
+	report, _ = h.runJSON("list")
+	if crypts, _ := report.Result.([]interface{}); report.Success == false || len(crypts) != 1 {
+		t.Errorf("unexpected report for list %+v", report)
+	}
+
+	report, exitCode := h.runJSON("status", "-crypt=doesnotexist")
+	if report.Success == true || report.ErrorCode != ERRNOTFOUND || report.StatusCode != 404 || report.Error == "" {
+		t.Errorf("unexpected report for a missing crypt %+v", report)
+	}
+	if exitCode != exitCodes[ERRNOTFOUND] {
+		t.Errorf("exited %d for a missing crypt", exitCode)
+	}
+
+	report, exitCode = h.runJSON("nosuchcommand")
+	if report.ErrorCode != ERRUSAGE || exitCode != 2 {
+		t.Errorf("unexpected report for an unknown command %+v (exit %d)", report, exitCode)
+	}
+}
+
+var (
+	groupIDPattern = regexp.MustCompile(`Your share group ID is:\s+(\S+)`)
+	shareIDPattern = regexp.MustCompile(`Share \d+ of \d+ CryptID is:\s+(\S+)`)
+)
+
+func TestShareGroup(t *testing.T) {
+	h := newTestHome(t)
+
+	// The first share is destroyed long before the others
+	out := h.run("MySuperStrongPassphrase", "new", "-shares=3", "-threshold=2", "-description=usb stick",
+		"-checkindurations=60,600,600", "-misscounts=1,1,1")
+	groupMatch := groupIDPattern.FindStringSubmatch(out)
+	shareMatches := shareIDPattern.FindAllStringSubmatch(out, -1)
+	if groupMatch == nil || len(shareMatches) != 3 {
+		t.Fatalf("unexpected output splitting into shares:\n%s", out)
+	}
+	groupID := groupMatch[1]
+
+	for _, match := range shareMatches {
+		crypt, ok := h.server.Crypt(match[1])
+		if ok == false || strings.Contains(crypt.CipherText, "ripacrypt-share") == true {
+			t.Errorf("share %s not stored encrypted", match[1])
+		}
+	}
+
+	// A share on its own says nothing about the secret, not even its hash
+	sum := sha256.Sum256([]byte("MySuperStrongPassphrase"))
+	out = h.stdout("", "get", "-crypt="+shareMatches[2][1])
+	if strings.HasPrefix(out, shareMagic) == false || strings.Contains(out, hex.EncodeToString(sum[:])) == true {
+		t.Errorf("share leaks the checksum of the secret:\n%s", out)
+	}
+
+	h.server.Advance(61 * time.Second)
+
+	out = h.run("", "get", "-group="+groupID)
+	if strings.HasSuffix(out, "MySuperStrongPassphrase\n") == false || strings.Contains(out, "has been destroyed") == false {
+		t.Errorf("unexpected output recombining shares:\n%s", out)
+	}
+
+	out = h.run("", "list")
+	if strings.Contains(out, groupID) == false || strings.Contains(out, "2 of 3") == false {
+		t.Errorf("share group missing from list:\n%s", out)
+	}
+
+	h.run("", "destroy", "-yes", "-crypt="+shareMatches[1][1])
+	out = h.runFail(exitCodes[ERRDESTROYED], "", "get", "-group="+groupID)
+	if strings.Contains(out, "Only 1 of the 2 shares") == false {
+		t.Errorf("unexpected output with too few shares:\n%s", out)
+	}
+
+	h.runFail(exitCodes[ERRUSAGE], "secret", "new", "-shares=3", "-threshold=2", "-misscounts=1,2")
+}
+
+func TestProfiles(t *testing.T) {
+	h := newTestHome(t)
+
+	defaultCrypt := h.newCrypt("default secret")
+
+	out := h.run("", "-profile=work", "register", "-nopassphrase")
+	if strings.Contains(out, "Your user id is:") == false {
+		t.Fatalf("registering a second profile failed:\n%s", out)
+	}
+	out = h.run("work secret", "-profile=work", "new", "-description=work")
+	match := cryptIDPattern.FindStringSubmatch(out)
+	if match == nil {
+		t.Fatalf("no crypt ID in output:\n%s", out)
+	}
+	workCrypt := match[1]
+
+	out = h.stdout("", "-profile=work", "get", "-crypt="+workCrypt)
+	if strings.TrimSpace(out) != "work secret" {
+		t.Errorf("unexpected crypt contents for the work profile:\n%s", out)
+	}
+
+	// Each profile has its own index
+	out = h.run("", "list")
+	if strings.Contains(out, defaultCrypt) == false || strings.Contains(out, workCrypt) == true {
+		t.Errorf("unexpected list for the default profile:\n%s", out)
+	}
+
+	out = h.run("", "profile", "list")
+	if strings.Contains(out, "default (default)") == false || strings.Contains(out, "work") == false {
+		t.Errorf("unexpected profile list:\n%s", out)
+	}
+
+	h.run("", "profile", "default", "work")
+	out = h.run("", "list")
+	if strings.Contains(out, workCrypt) == false {
+		t.Errorf("default profile not switched:\n%s", out)
+	}
+
+	h.run("", "profile", "add", "staging", "-onionurl=http://staging.onion/1")
+	out = h.run("", "-profile=staging", "config", "show")
+	if strings.Contains(out, "http://staging.onion/1/\t(config file)") == false {
+		t.Errorf("profile endpoint not used:\n%s", out)
+	}
+
+	h.runFail(exitCodes[ERRABORTED], "no\n", "profile", "remove", "work")
+	h.run("", "profile", "remove", "-yes", "work")
+	h.runFail(exitCodes[ERRCONFIG], "", "-profile=work", "list")
+	h.runFail(exitCodes[ERRUSAGE], "", "-profile=../work", "list")
+
+	// With the default profile removed we fall back to the original account
+	if conf := h.config(); conf.UserID == 0 {
+		t.Error("default profile lost")
+	}
+	out = h.run("", "list")
+	if strings.Contains(out, defaultCrypt) == false {
+		t.Errorf("unexpected list after removing the default profile:\n%s", out)
+	}
+}
+
+func TestConfigPermissions(t *testing.T) {
+	h := newTestHome(t)
+
+	configPath := filepath.Join(h.dir, ".ripacrypt", "rc.conf")
+	if err := os.Chmod(configPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := h.runFail(exitCodes[ERRCONFIG], "", "list")
+	if strings.Contains(out, "chmod 600 "+configPath) == false {
+		t.Errorf("world readable config not refused:\n%s", out)
+	}
+}
+
+func TestConfigLocation(t *testing.T) {
+	server := ripacrypttest.NewServer()
+	t.Cleanup(server.Close)
+
+	// Nothing in $HOME/.ripacrypt so XDG_CONFIG_HOME is honoured
+	h := &testHome{t: t, dir: t.TempDir(), server: server}
+	xdg := t.TempDir()
+	h.env = []string{"XDG_CONFIG_HOME=" + xdg}
+
+	h.run("", "register", "-nopassphrase")
+	out := h.runFail(exitCodes[ERRCONFIG], "", "register", "-nopassphrase")
+	if strings.Contains(out, filepath.Join(xdg, "ripacrypt", "rc.conf")) == false {
+		t.Errorf("already registered error does not name the config in use:\n%s", out)
+	}
+	h.newCrypt("secret")
+	for _, name := range []string{"rc.conf", "crypts.json"} {
+		if info, err := os.Stat(filepath.Join(xdg, "ripacrypt", name)); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s not written 0600 under XDG_CONFIG_HOME: %v", name, err)
+		}
+	}
+
+	// RIPACRYPT_CONFIG beats XDG_CONFIG_HOME and -config beats both
+	elsewhere := filepath.Join(t.TempDir(), "other.conf")
+	h.env = append(h.env, CONFIGENV+"="+elsewhere)
+	out = h.run("", "config", "show")
+	if strings.Contains(out, elsewhere+"\t(environment "+CONFIGENV+")") == false {
+		t.Errorf("%s not honoured:\n%s", CONFIGENV, out)
+	}
+
+	flagPath := filepath.Join(xdg, "ripacrypt", "rc.conf")
+	out = h.run("", "-config="+flagPath, "list")
+	if strings.Contains(out, "CRYPT ID") == false {
+		t.Errorf("-config not honoured:\n%s", out)
+	}
+}
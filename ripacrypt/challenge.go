@@ -0,0 +1,109 @@
+package ripacrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"io/ioutil"
+	"strings"
+)
+
+// ClientChallengeRequest describes the JSON required for an API request.
+type ClientChallengeRequest struct {
+	UserID      uint64 `json:"user_id"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// ChallengeAPIResponse describes the JSON returned from the API.
+type ChallengeAPIResponse struct {
+	Challenge   string `json:"challenge"`
+	ChallengeID uint64 `json:"challenge_id"`
+	UserID      uint64 `json:"user_id"`
+	StatusCode  int    `json:"status_code"`
+	Success     bool   `json:"success"`
+	Message     string `json:"status_message"`
+	Version     int64  `json:"version"`
+}
+
+// GetChallenge will fetch a challenge nonce from the server. If the server
+// doesn't know the current fingerprint each of the RetiredKeys is tried, as
+// midway through a rotation the server may not have switched keys yet.
+func (c *Client) GetChallenge() (ChallengeAPIResponse, error) {
+	apiResponse, err := c.getChallenge(c.Credentials.Fingerprint)
+	for _, retired := range c.Credentials.RetiredKeys {
+		if KindOf(err) != KindAuth {
+			break
+		}
+		apiResponse, err = c.getChallenge(retired.Fingerprint)
+	}
+	return apiResponse, err
+}
+
+// getChallenge fetches a challenge nonce for the key with fingerprint
+func (c *Client) getChallenge(fingerprint string) (ChallengeAPIResponse, error) {
+	var apiResponse ChallengeAPIResponse
+
+	err := c.do("POST", "challenge/", ClientChallengeRequest{
+		UserID:      c.Credentials.UserID,
+		Fingerprint: fingerprint,
+	}, &apiResponse)
+
+	return apiResponse, err
+}
+
+// solveChallenge requests a challenge nonce and decrypts it with the clients
+// private key, returning the cleartext and the ID the server knows it by.
+func (c *Client) solveChallenge() (string, uint64, error) {
+	challengeAPIResponse, challengeErr := c.GetChallenge()
+	if challengeErr != nil {
+		return "", 0, challengeErr
+	}
+
+	decryptedChallenge, decryptErr := c.DecryptChallenge(challengeAPIResponse.Challenge)
+	if decryptErr != nil {
+		return "", 0, decryptErr
+	}
+
+	return decryptedChallenge, challengeAPIResponse.ChallengeID, nil
+}
+
+// DecryptChallenge decrypts a challenge nonce with the clients secret key,
+// whether that is Credentials.PrivateKey or held by its KeyBackend
+func (c *Client) DecryptChallenge(challenge string) (string, error) {
+	buf := new(bytes.Buffer)
+	if _, err := c.decryptStream(buf, strings.NewReader(challenge), ""); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// DecryptChallenge will take an encrypted challenge nonce and a private key then decrypt the challenge and return the plaintext.
+// If the private key is passphrase protected prompt is called to unlock it.
+func DecryptChallenge(challenge, privatekey string, prompt PassphraseFunc) (string, error) {
+
+	privatekey, err := UnlockPrivateKey(privatekey, prompt)
+	if err != nil {
+		return "", cryptoError(err)
+	}
+
+	keyBuffer := bytes.NewBufferString(privatekey)
+	entityList, err := openpgp.ReadArmoredKeyRing(keyBuffer)
+	if err != nil {
+		return "", cryptoError(err)
+	}
+	dec, err := base64.StdEncoding.DecodeString(challenge)
+	if err != nil {
+		return "", cryptoError(err)
+	}
+	md, err := openpgp.ReadMessage(bytes.NewBuffer(dec), entityList, nil, nil)
+	if err != nil {
+		return "", cryptoError(err)
+	}
+	bytes, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return "", cryptoError(err)
+	}
+	decStr := string(bytes)
+
+	return decStr, nil
+}
@@ -0,0 +1,28 @@
+package ripacrypt
+
+// ClientCheckinRequest describes the JSON payload sent to the server to
+// "check in" with a crypt
+type ClientCheckinRequest struct {
+	UserID      uint64 `json:"user_id"`
+	Challenge   string `json:"challenge"`
+	ChallengeID uint64 `json:"challenge_id"`
+}
+
+// Checkin takes a cryptID, requests a challenge nonce, decrypts it then sends
+// a HTTP POST to the /1/crypt/CRYPTID/ endpoint to reset the deadline for a
+// crypt
+func (c *Client) Checkin(cryptID string) (NewCryptAPIResponse, error) {
+	decryptedChallenge, challengeID, challengeErr := c.solveChallenge()
+	if challengeErr != nil {
+		return NewCryptAPIResponse{}, challengeErr
+	}
+
+	var apiResponse NewCryptAPIResponse
+	err := c.do("POST", "crypt/"+cryptID+"/", ClientCheckinRequest{
+		UserID:      c.Credentials.UserID,
+		Challenge:   decryptedChallenge,
+		ChallengeID: challengeID,
+	}, &apiResponse)
+
+	return apiResponse, err
+}
@@ -0,0 +1,249 @@
+// Package ripacrypt is a client for the RIPACrypt API which remotely stores
+// secrets that are destroyed if a deadline is reached without a checkin.
+package ripacrypt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/btcsuite/go-socks/socks"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// RIPACRYPTURL is the base URL for all queries
+	RIPACRYPTURL = "https://ripacrypt.download/1/"
+
+	//HSURL is the base URL for the Tor Hidden Service instance
+	HSURL = "http://rcryptrz2t2gpxq7.onion/1/"
+
+	// CLIENTVERSION is sent to the server with every request
+	CLIENTVERSION = "1.0.0"
+
+	// TORSOCKS defines the SOCKS5 host we use if a user wants to use Tor
+	TORSOCKS = "localhost:9050"
+
+	// REQUESTTIMEOUT bounds every request, reply included, so a hung server
+	// or circuit can't stall a caller such as the daemon forever. It allows
+	// for a full chunk over a slow Tor circuit.
+	REQUESTTIMEOUT = 2 * time.Minute
+)
+
+// Credentials describes the account details needed to answer challenges
+type Credentials struct {
+	UserID      uint64
+	Fingerprint string
+	PublicKey   string
+	PrivateKey  string
+
+	// Passphrase is called the first time a protected PrivateKey is needed
+	Passphrase PassphraseFunc
+
+	// RetiredKeys are keys the account has rotated away from, protected with
+	// the same passphrase as PrivateKey
+	RetiredKeys []RetiredKey
+}
+
+// Client talks to a single RIPACrypt API instance on behalf of one account
+type Client struct {
+	// BaseURL is the API root and must end with a trailing slash
+	BaseURL string
+
+	// HTTPClient is used for every request, set its Transport to route
+	// traffic through a proxy. NewClient gives it a Timeout of REQUESTTIMEOUT.
+	HTTPClient *http.Client
+
+	Credentials Credentials
+
+	// Version is sent to the server in the X-CLIENT-VER header
+	Version string
+
+	// ChunkSize is the most plaintext NewStreamCrypt stores in one crypt,
+	// zero means CHUNKSIZE
+	ChunkSize int
+
+	// AllowUnsigned lets DecryptPayload accept payloads without a signature,
+	// such as those stored by older clients
+	AllowUnsigned bool
+
+	// Recipients are armoured public keys which, along with our own, can
+	// decrypt the payloads we store
+	Recipients []string
+
+	// Signers are armoured public keys, besides our own, whose signatures
+	// DecryptPayload trusts (e.g. someone who named us as a recipient)
+	Signers []string
+
+	// PacketConfig sets the cipher and compression of the payloads we store,
+	// nil means the library defaults. The cipher is only used if every
+	// recipients key lists it among its preferences.
+	PacketConfig *packet.Config
+
+	// KeyBackend, if set, does everything which needs the accounts secret
+	// key in place of Credentials.PrivateKey, e.g. GPG keeps it in GnuPG
+	KeyBackend KeyBackend
+
+	// unlockedKey caches the private key once it has been unlocked so long
+	// running users (e.g. the daemon) only need the passphrase once, likewise
+	// unlockedRetired for the RetiredKeys
+	unlockedKey     string
+	unlockedRetired []string
+}
+
+// NewClient returns a Client which connects directly to the API at baseURL
+func NewClient(baseURL string, creds Credentials) *Client {
+	return &Client{
+		BaseURL:     baseURL,
+		HTTPClient:  &http.Client{Timeout: REQUESTTIMEOUT},
+		Credentials: creds,
+		Version:     CLIENTVERSION,
+	}
+}
+
+// NewTorClient returns a Client which routes every request through the SOCKS5
+// proxy at socksAddr (usually a local Tor daemon)
+func NewTorClient(baseURL, socksAddr string, creds Credentials) *Client {
+	c := NewClient(baseURL, creds)
+	proxy := &socks.Proxy{Addr: socksAddr, TorIsolation: true}
+	c.HTTPClient.Transport = &http.Transport{
+		Dial: proxy.Dial,
+	}
+	return c
+}
+
+// UnlockPrivateKey returns the clients armoured private key, asking for the
+// passphrase via Credentials.Passphrase the first time if it is protected
+func (c *Client) UnlockPrivateKey() (string, error) {
+	if c.unlockedKey != "" {
+		return c.unlockedKey, nil
+	}
+
+	// The retired keys share the passphrase, so only ask for it once
+	var passphrase []byte
+	prompt := func() ([]byte, error) {
+		if passphrase != nil {
+			return passphrase, nil
+		}
+		if c.Credentials.Passphrase == nil {
+			return nil, errors.New("private key is passphrase protected but no passphrase was supplied")
+		}
+		var err error
+		passphrase, err = c.Credentials.Passphrase()
+		return passphrase, err
+	}
+
+	privateKey, err := UnlockPrivateKey(c.Credentials.PrivateKey, prompt)
+	if err != nil {
+		return "", cryptoError(err)
+	}
+
+	var retiredKeys []string
+	for _, retired := range c.Credentials.RetiredKeys {
+		retiredKey, err := UnlockPrivateKey(retired.PrivateKey, prompt)
+		if err != nil {
+			return "", &Error{Kind: KindCrypto, Message: "unlocking retired key " + retired.Fingerprint + ": " + err.Error(), Err: err}
+		}
+		retiredKeys = append(retiredKeys, retiredKey)
+	}
+
+	c.unlockedKey = privateKey
+	c.unlockedRetired = retiredKeys
+	return privateKey, nil
+}
+
+// decryptStream is DecryptStream with the clients own secret key, wherever
+// that is kept
+func (c *Client) decryptStream(w io.Writer, r io.Reader, signerKeys string) (string, error) {
+	if c.KeyBackend != nil {
+		return c.KeyBackend.DecryptStream(w, r, signerKeys)
+	}
+
+	privateKey, err := c.UnlockPrivateKey()
+	if err != nil {
+		return "", err
+	}
+	privateKeys := strings.Join(append([]string{privateKey}, c.unlockedRetired...), "\n")
+	return DecryptStream(w, r, privateKeys, nil, signerKeys)
+}
+
+// cryptExists reports whether the server still knows cryptID, destroyed or
+// not, so a 404 from an optional crypt endpoint can be told apart from a
+// missing crypt
+func (c *Client) cryptExists(cryptID string) bool {
+	_, err := c.GetCrypt(cryptID)
+	return err == nil || KindOf(err) == KindDestroyed
+}
+
+// do sends payload (if any) as JSON to path relative to the BaseURL and
+// decodes the JSON reply into apiResponse
+func (c *Client) do(method, path string, payload interface{}, apiResponse interface{}) error {
+	var reqBody io.Reader
+
+	if payload != nil {
+		jsonBuf, jsonErr := json.Marshal(payload)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		reqBody = bytes.NewBuffer(jsonBuf)
+	}
+
+	req, httpReqErr := http.NewRequest(method, c.BaseURL+path, reqBody)
+	if httpReqErr != nil {
+		return &Error{Kind: KindNetwork, Err: httpReqErr}
+	}
+
+	req.Header.Set("X-CLIENT-VER", c.Version)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, httpErr := c.HTTPClient.Do(req)
+	if httpErr != nil {
+		return &Error{Kind: KindNetwork, Err: httpErr}
+	}
+
+	defer resp.Body.Close()
+
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return &Error{Kind: KindNetwork, StatusCode: resp.StatusCode, Err: readErr}
+	}
+
+	// Every reply carries these whatever else is in it
+	var status struct {
+		StatusCode int    `json:"status_code"`
+		Success    bool   `json:"success"`
+		Message    string `json:"status_message"`
+	}
+
+	jsonErr := json.Unmarshal(body, &status)
+	if jsonErr == nil {
+		jsonErr = json.Unmarshal(body, apiResponse)
+	}
+	if jsonErr != nil {
+		if resp.StatusCode >= 400 {
+			return apiError(resp.StatusCode, "")
+		}
+		return &Error{Kind: KindServer, StatusCode: resp.StatusCode, Message: "malformed reply from the server", Err: jsonErr}
+	}
+
+	// Trust the status in the body if a proxy has mangled the HTTP one
+	statusCode := resp.StatusCode
+	if statusCode < 400 && status.StatusCode >= 400 {
+		statusCode = status.StatusCode
+	}
+	if statusCode >= 400 {
+		return apiError(statusCode, status.Message)
+	}
+
+	if status.Success == false {
+		if status.Message == "" {
+			status.Message = "the server reported a failure"
+		}
+		return &Error{Kind: KindServer, StatusCode: statusCode, Message: status.Message}
+	}
+	return nil
+}
@@ -0,0 +1,777 @@
+package ripacrypt_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt/ripacrypttest"
+	"github.com/ProtonMail/go-crypto/ocb"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClient starts a mock server and registers a fresh account with it
+func newTestClient(t *testing.T) (*ripacrypt.Client, *ripacrypttest.Server) {
+	t.Helper()
+
+	server := ripacrypttest.NewServer()
+	t.Cleanup(server.Close)
+
+	publicKey, privateKey, err := ripacrypttest.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint, err := ripacrypt.VerifyGPGPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := ripacrypt.NewClient(server.URL, ripacrypt.Credentials{
+		Fingerprint: fingerprint,
+		PublicKey:   publicKey,
+		PrivateKey:  privateKey,
+	})
+
+	apiResponse, err := client.Register(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiResponse.Success == false || apiResponse.UserID == 0 || apiResponse.BTCAddr == "" {
+		t.Fatalf("unexpected registration response %+v", apiResponse)
+	}
+
+	client.Credentials.UserID = apiResponse.UserID
+	return client, server
+}
+
+func TestGetChallenge(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	apiResponse, err := client.GetChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleartext, err := ripacrypt.DecryptChallenge(apiResponse.Challenge, client.Credentials.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cleartext == "" {
+		t.Error("decrypted challenge is empty")
+	}
+}
+
+func TestGetChallengeUnknownFingerprint(t *testing.T) {
+	client, _ := newTestClient(t)
+	client.Credentials.Fingerprint = "0000000000000000"
+
+	apiResponse, err := client.GetChallenge()
+	if ripacrypt.KindOf(err) != ripacrypt.KindAuth {
+		t.Errorf("expected an auth error, got %v", err)
+	}
+	if apiResponse.Success == true {
+		t.Error("challenge issued for the wrong fingerprint")
+	}
+}
+
+func TestNewCryptRoundTrip(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	newResponse, err := client.NewCrypt("correct horse battery staple", "laptop disk", 3600, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getResponse, err := client.GetCrypt(newResponse.CryptPayload.CryptID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crypt := getResponse.CryptPayload
+	if crypt.Description != "laptop disk" || crypt.CheckInDuration != 3600 || crypt.MissCount != 2 {
+		t.Errorf("crypt settings not stored %+v", crypt)
+	}
+
+	plainText, err := ripacrypt.DecryptCrypt(crypt.CipherText, client.Credentials.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plainText != "correct horse battery staple" {
+		t.Errorf("got %q back from the crypt", plainText)
+	}
+}
+
+func TestCheckinResetsDeadline(t *testing.T) {
+	client, server := newTestClient(t)
+
+	newResponse, err := client.NewCrypt("secret", "", 60, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cryptID := newResponse.CryptPayload.CryptID
+
+	server.Advance(90 * time.Second)
+
+	checkinResponse, err := client.Checkin(cryptID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkinResponse.Success == false {
+		t.Fatalf("checkin failed: %s", checkinResponse.Message)
+	}
+
+	// Without the checkin this would be past the deadline
+	server.Advance(90 * time.Second)
+
+	getResponse, err := client.GetCrypt(cryptID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getResponse.CryptPayload.IsDestroyed == true {
+		t.Error("crypt destroyed despite checking in")
+	}
+}
+
+func TestDeadlineDestroysCrypt(t *testing.T) {
+	client, server := newTestClient(t)
+
+	newResponse, err := client.NewCrypt("secret", "", 60, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cryptID := newResponse.CryptPayload.CryptID
+
+	server.Advance(121 * time.Second)
+
+	getResponse, err := client.GetCrypt(cryptID)
+	if ripacrypt.KindOf(err) != ripacrypt.KindDestroyed || ripacrypt.StatusCodeOf(err) != 410 {
+		t.Errorf("expected a destroyed error, got %v", err)
+	}
+	if getResponse.StatusCode != 410 || getResponse.CryptPayload.IsDestroyed == false {
+		t.Errorf("crypt survived its deadline %+v", getResponse)
+	}
+	if getResponse.CryptPayload.CipherText != "" {
+		t.Error("destroyed crypt still has ciphertext")
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	newResponse, err := client.NewCrypt("secret", "", 3600, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cryptID := newResponse.CryptPayload.CryptID
+
+	if _, err = client.Destroy(cryptID); err != nil {
+		t.Fatal(err)
+	}
+
+	getResponse, err := client.GetCrypt(cryptID)
+	if ripacrypt.KindOf(err) != ripacrypt.KindDestroyed || getResponse.CryptPayload.IsDestroyed == false {
+		t.Errorf("crypt not destroyed: %v", err)
+	}
+
+	if _, err = client.Destroy(cryptID); ripacrypt.KindOf(err) != ripacrypt.KindDestroyed {
+		t.Errorf("expected a destroyed error destroying a destroyed crypt, got %v", err)
+	}
+}
+
+func TestDestroyUnsupported(t *testing.T) {
+	client, server := newTestClient(t)
+	server.Disable("DELETE", "crypt")
+
+	newResponse, err := client.NewCrypt("secret", "", 3600, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Destroy(newResponse.CryptPayload.CryptID)
+	if errors.Is(err, ripacrypt.ErrUnsupported) == false || strings.Contains(err.Error(), "destroying crypts") == false {
+		t.Errorf("expected an unsupported error, got %v", err)
+	}
+
+	// A crypt which doesn't exist is still reported as such
+	if _, err = client.Destroy("missing"); ripacrypt.KindOf(err) != ripacrypt.KindNotFound {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestStreamChunks(t *testing.T) {
+	client, _ := newTestClient(t)
+	client.ChunkSize = 100
+
+	data := make([]byte, 1000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	newResponse, chunks, err := client.NewStreamCrypt(bytes.NewReader(data), "video", 3600, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 10 {
+		t.Fatalf("expected 10 chunks, got %d", len(chunks))
+	}
+
+	out := new(bytes.Buffer)
+	if _, _, err = client.GetStream(newResponse.CryptPayload.CryptID, out); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(out.Bytes(), data) == false {
+		t.Error("reassembled chunks do not match the original data")
+	}
+
+	// Losing any chunk loses the data
+	if _, err = client.Destroy(chunks[4]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.GetStream(newResponse.CryptPayload.CryptID, new(bytes.Buffer)); ripacrypt.KindOf(err) != ripacrypt.KindDestroyed {
+		t.Errorf("expected a destroyed error for a missing chunk, got %v", err)
+	}
+
+	// Payloads smaller than a chunk aren't split
+	newResponse, chunks, err = client.NewStreamCrypt(bytes.NewReader(data[:50]), "", 3600, 3)
+	if err != nil || len(chunks) != 0 {
+		t.Fatalf("small payload was chunked: %v %v", chunks, err)
+	}
+	out.Reset()
+	if _, _, err = client.GetStream(newResponse.CryptPayload.CryptID, out); err != nil || bytes.Equal(out.Bytes(), data[:50]) == false {
+		t.Errorf("small payload did not round trip: %v", err)
+	}
+}
+
+func TestSignedPayloads(t *testing.T) {
+	client, server := newTestClient(t)
+
+	newResponse, err := client.NewCrypt("secret", "", 3600, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cryptID := newResponse.CryptPayload.CryptID
+	original, _ := server.Crypt(cryptID)
+
+	_, payload, err := client.GetStream(cryptID, new(bytes.Buffer))
+	if err != nil || payload.Signer != client.Credentials.Fingerprint {
+		t.Fatalf("expected a signature by %s, got %q %v", client.Credentials.Fingerprint, payload.Signer, err)
+	}
+
+	// Encrypted to us but not signed, as an older client (or the server)
+	// could have done
+	unsigned, err := ripacrypt.EncryptData("unsigned", client.Credentials.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetCipherText(cryptID, unsigned)
+	if _, _, err = client.GetStream(cryptID, new(bytes.Buffer)); errors.Is(err, ripacrypt.ErrUnsigned) == false || ripacrypt.KindOf(err) != ripacrypt.KindCrypto {
+		t.Errorf("expected an unsigned error, got %v", err)
+	}
+
+	client.AllowUnsigned = true
+	out := new(bytes.Buffer)
+	if _, payload, err = client.GetStream(cryptID, out); err != nil || payload.Signer != "" || out.String() != "unsigned" {
+		t.Errorf("unsigned payload refused with AllowUnsigned: %q %v", out, err)
+	}
+	client.AllowUnsigned = false
+
+	// Signed, but by someone else
+	_, otherKey, err := ripacrypttest.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := new(bytes.Buffer)
+	if err = ripacrypt.EncryptStream(forged, strings.NewReader("forged"), client.Credentials.PublicKey, otherKey); err != nil {
+		t.Fatal(err)
+	}
+	server.SetCipherText(cryptID, forged.String())
+	if _, _, err = client.GetStream(cryptID, new(bytes.Buffer)); ripacrypt.KindOf(err) != ripacrypt.KindCrypto {
+		t.Errorf("expected a crypto error for a forged signature, got %v", err)
+	}
+
+	// Tampered with in transit or at rest
+	cipherText, err := base64.StdEncoding.DecodeString(original.CipherText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherText[len(cipherText)-10] ^= 0xff
+	server.SetCipherText(cryptID, base64.StdEncoding.EncodeToString(cipherText))
+	if _, _, err = client.GetStream(cryptID, new(bytes.Buffer)); ripacrypt.KindOf(err) != ripacrypt.KindCrypto {
+		t.Errorf("expected a crypto error for tampered ciphertext, got %v", err)
+	}
+}
+
+func TestRekeyAndReencrypt(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	newResponse, _, err := client.NewStreamCrypt(strings.NewReader("old key"), "", 3600, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cryptID := newResponse.CryptPayload.CryptID
+
+	publicKey, privateKey, err := ripacrypttest.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Rekey(publicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old key is retired, still decrypting until the crypt is migrated
+	fingerprint, _ := ripacrypt.VerifyGPGPublicKey(publicKey)
+	old := client.Credentials
+	client = ripacrypt.NewClient(client.BaseURL, ripacrypt.Credentials{
+		UserID:      old.UserID,
+		Fingerprint: fingerprint,
+		PublicKey:   publicKey,
+		PrivateKey:  privateKey,
+		RetiredKeys: []ripacrypt.RetiredKey{{Fingerprint: old.Fingerprint, PublicKey: old.PublicKey, PrivateKey: old.PrivateKey}},
+	})
+	if _, err = client.Reencrypt(cryptID); err != nil {
+		t.Fatal(err)
+	}
+
+	creds := client.Credentials
+	creds.RetiredKeys = nil
+	out := new(bytes.Buffer)
+	if _, _, err = ripacrypt.NewClient(client.BaseURL, creds).GetStream(cryptID, out); err != nil || out.String() != "old key" {
+		t.Errorf("crypt not readable with the new key alone: %q %v", out, err)
+	}
+}
+
+func TestRekeyUnsupported(t *testing.T) {
+	client, server := newTestClient(t)
+	server.Disable("POST", "rekey")
+	server.Disable("PUT", "crypt")
+
+	publicKey, _, err := ripacrypttest.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Rekey(publicKey); errors.Is(err, ripacrypt.ErrUnsupported) == false {
+		t.Errorf("expected an unsupported error from Rekey, got %v", err)
+	}
+
+	newResponse, err := client.NewCrypt("secret", "", 3600, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Reencrypt(newResponse.CryptPayload.CryptID); errors.Is(err, ripacrypt.ErrUnsupported) == false {
+		t.Errorf("expected an unsupported error from Reencrypt, got %v", err)
+	}
+}
+
+func TestReadKeyRing(t *testing.T) {
+	first, _, err := ripacrypttest.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := ripacrypttest.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entityList, err := ripacrypt.ReadKeyRing(first + "\n" + second)
+	if err != nil || len(entityList) != 2 {
+		t.Fatalf("expected 2 keys, got %d %v", len(entityList), err)
+	}
+
+	binary := new(bytes.Buffer)
+	if err = entityList[1].Serialize(binary); err != nil {
+		t.Fatal(err)
+	}
+	entityList, err = ripacrypt.ReadKeyRing(binary.String())
+	if err != nil || len(entityList) != 1 {
+		t.Errorf("expected 1 binary key, got %d %v", len(entityList), err)
+	}
+
+	if _, err = ripacrypt.ReadKeyRing("not a key"); err == nil {
+		t.Error("read a key ring from garbage")
+	}
+}
+
+// newGPGHome imports privateKey into a throwaway GnuPG home, skipping the
+// test if gpg is not installed
+func newGPGHome(t *testing.T, privateKey string) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+
+	home, err := ioutil.TempDir("", "gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run()
+		os.RemoveAll(home)
+	})
+
+	cmd := exec.Command("gpg", "--homedir", home, "--batch", "--import")
+	cmd.Stdin = strings.NewReader(privateKey)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gpg --import: %v\n%s", err, out)
+	}
+	return home
+}
+
+func TestGPGBackend(t *testing.T) {
+	client, server := newTestClient(t)
+	privateKey := client.Credentials.PrivateKey
+
+	// From here on only gpg has the secret key
+	client.Credentials.PrivateKey = ""
+	client.KeyBackend = ripacrypt.GPG{Key: client.Credentials.Fingerprint, Home: newGPGHome(t, privateKey)}
+	if err := ripacrypt.CheckKeyBackend(client.KeyBackend, client.Credentials.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	newResponse, err := client.NewCrypt("kept by gpg", "", 3600, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cryptID := newResponse.CryptPayload.CryptID
+
+	out := new(bytes.Buffer)
+	_, payload, err := client.GetStream(cryptID, out)
+	if err != nil || out.String() != "kept by gpg" || payload.Signer != client.Credentials.Fingerprint {
+		t.Fatalf("unexpected payload %q signed by %q: %v", out, payload.Signer, err)
+	}
+
+	// The challenge is answered by gpg too
+	if _, err = client.Checkin(cryptID); err != nil {
+		t.Fatal(err)
+	}
+
+	// What gpg signed and encrypted reads just the same with the key itself
+	crypt, _ := server.Crypt(cryptID)
+	out.Reset()
+	signer, err := ripacrypt.DecryptStream(out, strings.NewReader(crypt.CipherText), privateKey, nil, client.Credentials.PublicKey)
+	if err != nil || out.String() != "kept by gpg" || signer != client.Credentials.Fingerprint {
+		t.Errorf("gpg payload did not decrypt with the private key: %q %q %v", out, signer, err)
+	}
+
+	// Tampering is still noticed when gpg does the decrypting
+	cipherText, err := base64.StdEncoding.DecodeString(crypt.CipherText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherText[len(cipherText)-10] ^= 0xff
+	server.SetCipherText(cryptID, base64.StdEncoding.EncodeToString(cipherText))
+	if _, _, err = client.GetStream(cryptID, new(bytes.Buffer)); ripacrypt.KindOf(err) != ripacrypt.KindCrypto {
+		t.Errorf("expected a crypto error for tampered ciphertext, got %v", err)
+	}
+}
+
+func TestOrderRSAPrimes(t *testing.T) {
+	entity, err := openpgp.NewEntity("Test", "", "test@clients.ripacrypt.invalid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure there is something to put right
+	rsaKey := entity.PrivateKey.PrivateKey.(*rsa.PrivateKey)
+	if rsaKey.Primes[1].Cmp(rsaKey.Primes[0]) < 0 {
+		rsaKey.Primes[0], rsaKey.Primes[1] = rsaKey.Primes[1], rsaKey.Primes[0]
+		rsaKey.Precomputed = rsa.PrecomputedValues{}
+		rsaKey.Precompute()
+	}
+
+	ripacrypt.OrderRSAPrimes(entity)
+
+	buf := new(bytes.Buffer)
+	if err = entity.SerializePrivate(buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	entityList, err := openpgp.ReadKeyRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// go-crypto reads the primes back in the order they were written
+	for _, key := range []*packet.PrivateKey{entityList[0].PrivateKey, entityList[0].Subkeys[0].PrivateKey} {
+		primes := key.PrivateKey.(*rsa.PrivateKey).Primes
+		if primes[0].Cmp(primes[1]) > 0 {
+			t.Errorf("key %X written with p > q", key.Fingerprint)
+		}
+	}
+}
+
+// aeadMessage signs plaintext with entity and encrypts it to entity in an
+// OCB AEAD packet, as GnuPG 2.3 and later do for keys which prefer AEAD.
+// go-crypto reads these but never writes them.
+func aeadMessage(t *testing.T, entity *openpgp.Entity, plaintext string) []byte {
+	t.Helper()
+
+	signed := new(bytes.Buffer)
+	w, err := openpgp.Sign(signed, entity, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, plaintext)
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sessionKey := make([]byte, 32)
+	iv := make([]byte, 15)
+	rand.Read(sessionKey)
+	rand.Read(iv)
+
+	message := new(bytes.Buffer)
+	if err = packet.SerializeEncryptedKey(message, entity.Subkeys[0].PublicKey, packet.CipherAES256, sessionKey, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := ocb.NewOCB(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Version, cipher, AEAD mode and a 4 KiB chunk size, so the whole message
+	// is a single chunk followed by the final tag
+	header := []byte{1, byte(packet.CipherAES256), byte(packet.AEADModeOCB), 6}
+	nonce := func(index uint64) []byte {
+		n := append([]byte{}, iv...)
+		for i := 0; i < 8; i++ {
+			n[7+i] ^= byte(index >> uint(56-8*i))
+		}
+		return n
+	}
+	adata := func(values ...uint64) []byte {
+		a := append([]byte{0xc0 | 20}, header...)
+		for _, v := range values {
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, v)
+			a = append(a, b...)
+		}
+		return a
+	}
+
+	body := append(append([]byte{}, header...), iv...)
+	body = aead.Seal(body, nonce(0), signed.Bytes(), adata(0))
+	body = aead.Seal(body, nonce(1), nil, adata(1, uint64(signed.Len())))
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(body)))
+	message.Write([]byte{0xc0 | 20, 0xff})
+	message.Write(length)
+	message.Write(body)
+	return message.Bytes()
+}
+
+// fakeGPG writes a stand in for gpg which reports the session key entity
+// would recover from message, for messages the installed gpg may be too old
+// to read
+func fakeGPG(t *testing.T, entity *openpgp.Entity, message []byte) string {
+	t.Helper()
+
+	p, err := packet.Read(bytes.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedKey, ok := p.(*packet.EncryptedKey)
+	if ok == false {
+		t.Fatalf("message starts with %T, not an encrypted session key", p)
+	}
+	if err = encryptedKey.Decrypt(entity.Subkeys[0].PrivateKey, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "gpg")
+	script := fmt.Sprintf("#!/bin/sh\ncat >/dev/null\necho '[GNUPG:] SESSION_KEY %d:%X' >&3\n", encryptedKey.CipherFunc, encryptedKey.Key)
+	if err = ioutil.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGPGBackendAEAD(t *testing.T) {
+	// A key which prefers AEAD gets version 2 SEIPD packets from go-crypto
+	// and the older AEAD packet from GnuPG
+	config := &packet.Config{AEADConfig: &packet.AEADConfig{}}
+	entity, err := openpgp.NewEntity("Test", "", "aead@clients.ripacrypt.invalid", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ripacrypt.ArmorPublicKey(entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seipd := new(bytes.Buffer)
+	w, err := openpgp.Encrypt(seipd, openpgp.EntityList{entity}, entity, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "sealed in SEIPDv2")
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := map[string][]byte{
+		"sealed in SEIPDv2": seipd.Bytes(),
+		"sealed with OCB":   aeadMessage(t, entity, "sealed with OCB"),
+	}
+	for plaintext, message := range messages {
+		backend := ripacrypt.GPG{Path: fakeGPG(t, entity, message)}
+
+		out := new(bytes.Buffer)
+		signer, err := backend.DecryptStream(out, strings.NewReader(base64.StdEncoding.EncodeToString(message)), publicKey)
+		if err != nil || out.String() != plaintext || signer != ripacrypt.KeyFingerprint(entity.PrimaryKey) {
+			t.Errorf("unexpected payload %q signed by %q: %v", out, signer, err)
+		}
+
+		// The final tag catches tampering
+		tampered := append([]byte{}, message...)
+		tampered[len(tampered)-10] ^= 0xff
+		_, err = backend.DecryptStream(new(bytes.Buffer), strings.NewReader(base64.StdEncoding.EncodeToString(tampered)), publicKey)
+		if ripacrypt.KindOf(err) != ripacrypt.KindCrypto {
+			t.Errorf("expected a crypto error for tampered %q, got %v", plaintext, err)
+		}
+	}
+}
+
+func TestGetBTC(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	first, err := client.GetBTC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.GetBTC()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Success == false || first.BTCAddr == "" || first.BTCAddr == second.BTCAddr {
+		t.Errorf("expected two distinct bitcoin addresses, got %q and %q", first.BTCAddr, second.BTCAddr)
+	}
+}
+
+func TestProtectedPrivateKey(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	protected, err := ripacrypt.ProtectPrivateKey(client.Credentials.PrivateKey, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ripacrypt.IsPrivateKeyProtected(protected) == false {
+		t.Fatal("protected key not recognised")
+	}
+
+	prompts := 0
+	client = ripacrypt.NewClient(client.BaseURL, ripacrypt.Credentials{
+		UserID:      client.Credentials.UserID,
+		Fingerprint: client.Credentials.Fingerprint,
+		PublicKey:   client.Credentials.PublicKey,
+		PrivateKey:  protected,
+		Passphrase: func() ([]byte, error) {
+			prompts++
+			return []byte("hunter2"), nil
+		},
+	})
+
+	if _, err = client.NewCrypt("secret", "", 3600, 3, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.GetBTC(); err != nil {
+		t.Fatal(err)
+	}
+	if prompts != 1 {
+		t.Errorf("asked for the passphrase %d times, expected once", prompts)
+	}
+
+	_, err = ripacrypt.UnlockPrivateKey(protected, func() ([]byte, error) {
+		return []byte("wrong"), nil
+	})
+	if err != ripacrypt.ErrBadPassphrase {
+		t.Errorf("expected ErrBadPassphrase, got %v", err)
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	if _, err := client.GetCrypt("doesnotexist"); ripacrypt.KindOf(err) != ripacrypt.KindNotFound {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if _, err := client.Checkin("doesnotexist"); ripacrypt.KindOf(err) != ripacrypt.KindNotFound {
+		t.Errorf("expected a not found error checking in, got %v", err)
+	}
+
+	creds := client.Credentials
+	creds.PrivateKey = "not a key"
+	client = ripacrypt.NewClient(client.BaseURL, creds)
+	if _, err := client.GetBTC(); ripacrypt.KindOf(err) != ripacrypt.KindCrypto {
+		t.Errorf("expected a crypto error, got %v", err)
+	}
+
+	// Nothing listens on port 1
+	client.BaseURL = "http://127.0.0.1:1/1/"
+	if _, err := client.GetCrypt("doesnotexist"); ripacrypt.KindOf(err) != ripacrypt.KindNetwork {
+		t.Errorf("expected a network error, got %v", err)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	replies := map[string]ripacrypt.ErrorKind{
+		"<html>502 Bad Gateway</html>":                   ripacrypt.KindServer,
+		`{"status_code": 200, "success": false}`:         ripacrypt.KindServer,
+		`{"status_code": 403, "status_message": "nope"}`: ripacrypt.KindAuth,
+	}
+
+	for reply, kind := range replies {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(reply))
+		}))
+
+		client := ripacrypt.NewClient(server.URL+"/1/", ripacrypt.Credentials{})
+		if _, err := client.GetCrypt("abc"); ripacrypt.KindOf(err) != kind {
+			t.Errorf("reply %q: expected a %s error, got %v", reply, kind, err)
+		}
+		server.Close()
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	client := ripacrypt.NewClient(server.URL+"/1/", ripacrypt.Credentials{})
+	if client.HTTPClient.Timeout != ripacrypt.REQUESTTIMEOUT {
+		t.Errorf("expected a timeout of %s, got %s", ripacrypt.REQUESTTIMEOUT, client.HTTPClient.Timeout)
+	}
+
+	client.HTTPClient.Timeout = 100 * time.Millisecond
+	if _, err := client.GetCrypt("abc"); ripacrypt.KindOf(err) != ripacrypt.KindNetwork {
+		t.Errorf("expected a network error from a hung server, got %v", err)
+	}
+}
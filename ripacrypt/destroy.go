@@ -0,0 +1,31 @@
+package ripacrypt
+
+// ClientDestroyRequest describes the JSON payload sent to the server to
+// destroy a crypt immediately
+type ClientDestroyRequest struct {
+	UserID      uint64 `json:"user_id"`
+	Challenge   string `json:"challenge"`
+	ChallengeID uint64 `json:"challenge_id"`
+}
+
+// Destroy takes a cryptID, requests a challenge nonce, decrypts it then sends
+// a HTTP DELETE to the /1/crypt/CRYPTID/ endpoint asking the server to wipe the
+// crypt without waiting for its deadline.
+//
+// The endpoint is not part of every RIPACrypt server, if it is missing the
+// error wraps ErrUnsupported.
+func (c *Client) Destroy(cryptID string) (NewCryptAPIResponse, error) {
+	decryptedChallenge, challengeID, challengeErr := c.solveChallenge()
+	if challengeErr != nil {
+		return NewCryptAPIResponse{}, challengeErr
+	}
+
+	var apiResponse NewCryptAPIResponse
+	err := c.do("DELETE", "crypt/"+cryptID+"/", ClientDestroyRequest{
+		UserID:      c.Credentials.UserID,
+		Challenge:   decryptedChallenge,
+		ChallengeID: challengeID,
+	}, &apiResponse)
+
+	return apiResponse, unsupportedError(err, "destroying crypts", func() bool { return c.cryptExists(cryptID) })
+}
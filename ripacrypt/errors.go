@@ -0,0 +1,151 @@
+package ripacrypt
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrUnsupported is wrapped by the error returned when the server lacks an
+// optional endpoint, such as destroying or rekeying, which not every
+// RIPACrypt server implements
+var ErrUnsupported = errors.New("the server does not support this request")
+
+// ErrorKind classifies why a call failed so callers can react (and exit)
+// differently to, say, a flaky network and a crypt that has been destroyed
+type ErrorKind int
+
+const (
+	// KindNetwork means the server could not be reached or its reply read
+	KindNetwork ErrorKind = iota + 1
+
+	// KindAuth means the server refused us, usually a failed challenge or an
+	// unknown user ID / fingerprint
+	KindAuth
+
+	// KindNotFound means the crypt (or endpoint) does not exist
+	KindNotFound
+
+	// KindDestroyed means the crypt has been destroyed
+	KindDestroyed
+
+	// KindServer means the server failed or sent a reply we don't understand
+	KindServer
+
+	// KindCrypto means a local OpenPGP operation failed, e.g. a bad key or
+	// passphrase
+	KindCrypto
+)
+
+// String returns a short name for the kind
+func (k ErrorKind) String() string {
+	switch k {
+	case KindNetwork:
+		return "network"
+	case KindAuth:
+		return "auth"
+	case KindNotFound:
+		return "not found"
+	case KindDestroyed:
+		return "destroyed"
+	case KindServer:
+		return "server"
+	case KindCrypto:
+		return "crypto"
+	}
+	return "unknown"
+}
+
+// Error is returned by every Client method and the package level crypto
+// helpers when something goes wrong
+type Error struct {
+	Kind ErrorKind
+
+	// StatusCode is the HTTP status code of the reply, if there was one
+	StatusCode int
+
+	// Message is the status_message from the API, if there was one
+	Message string
+
+	// Err is the underlying error, if any
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Kind.String() + " error"
+}
+
+// Unwrap allows errors.Is to see e.g. ErrBadPassphrase
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// KindOf returns the ErrorKind of err, or 0 if it is not an *Error
+func KindOf(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return 0
+}
+
+// StatusCodeOf returns the HTTP status code recorded in err, or 0
+func StatusCodeOf(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// apiError classifies a failed API reply by its status code
+func apiError(statusCode int, message string) *Error {
+	if message == "" {
+		message = http.StatusText(statusCode)
+	}
+
+	kind := KindServer
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		kind = KindAuth
+	case http.StatusNotFound:
+		kind = KindNotFound
+	case http.StatusGone:
+		kind = KindDestroyed
+	}
+	return &Error{Kind: kind, StatusCode: statusCode, Message: message}
+}
+
+// cryptoError marks err as a local crypto failure, leaving nil and already
+// classified errors alone
+func cryptoError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Kind: KindCrypto, Err: err}
+}
+
+// unsupportedError turns a 404 or 405 from an optional endpoint into an
+// ErrUnsupported naming what the server can't do, other errors are returned
+// unchanged. exists reports whether the resource the endpoint acts on is
+// there, so a 404 which only means e.g. "no such crypt" is left alone; it is
+// nil for endpoints which don't act on one.
+func unsupportedError(err error, what string, exists func() bool) error {
+	statusCode := StatusCodeOf(err)
+	switch {
+	case statusCode == http.StatusMethodNotAllowed:
+	case statusCode == http.StatusNotFound && (exists == nil || exists()):
+	default:
+		return err
+	}
+	return &Error{Kind: KindServer, StatusCode: statusCode, Message: "the server does not support " + what, Err: ErrUnsupported}
+}
@@ -0,0 +1,27 @@
+package ripacrypt
+
+import (
+	"bytes"
+	"strings"
+)
+
+// GetCrypt takes a cryptID and retrieves the crypt. A destroyed crypt is
+// returned along with an error of KindDestroyed.
+func (c *Client) GetCrypt(cryptID string) (NewCryptAPIResponse, error) {
+	var apiResponse NewCryptAPIResponse
+
+	err := c.do("GET", "crypt/"+cryptID+"/", nil, &apiResponse)
+	return apiResponse, err
+}
+
+// DecryptCrypt takes the base64 encoded ciphertext of a crypt and an armoured
+// private key and returns the plaintext. If the private key is passphrase
+// protected prompt is called to unlock it. Any signature is not checked, use
+// Client.DecryptPayload for that.
+func DecryptCrypt(crypt, privatekey string, prompt PassphraseFunc) (string, error) {
+	buf := new(bytes.Buffer)
+	if _, err := DecryptStream(buf, strings.NewReader(crypt), privatekey, prompt, ""); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
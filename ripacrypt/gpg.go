@@ -0,0 +1,243 @@
+package ripacrypt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// KeyBackend does everything which needs the accounts secret key, so that a
+// Client can work without ever holding it
+type KeyBackend interface {
+	// EncryptStream is EncryptStream, signed with the accounts key
+	EncryptStream(w io.Writer, r io.Reader, publicKeys string) error
+
+	// DecryptStream is DecryptStream, decrypting with the accounts key
+	DecryptStream(w io.Writer, r io.Reader, signerKeys string) (string, error)
+}
+
+// GPG is a KeyBackend which leaves the secret key in GnuPG. The gpg binary is
+// run for every operation, so gpg-agent (and its pinentry) deals with the
+// passphrase and the key material never leaves it.
+type GPG struct {
+	// Path is the gpg binary, empty means gpg from $PATH
+	Path string
+
+	// Key is the fingerprint (or anything else gpg accepts with -u) of the
+	// accounts key in the GnuPG keyring
+	Key string
+
+	// Home overrides GNUPGHOME if set
+	Home string
+}
+
+// run runs gpg with args, feeding it stdin and writing its output to stdout,
+// and returns the lines it wrote to its status fd
+func (g GPG) run(stdin io.Reader, stdout io.Writer, args ...string) ([]string, error) {
+	path := g.Path
+	if path == "" {
+		path = "gpg"
+	}
+
+	statusRead, statusWrite, err := os.Pipe()
+	if err != nil {
+		return nil, cryptoError(err)
+	}
+	defer statusRead.Close()
+
+	baseArgs := []string{"--batch", "--yes", "--no-greeting", "--status-fd", "3"}
+	if g.Home != "" {
+		baseArgs = append(baseArgs, "--homedir", g.Home)
+	}
+
+	cmd := exec.Command(path, append(baseArgs, args...)...)
+	stderr := new(bytes.Buffer)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.ExtraFiles = []*os.File{statusWrite}
+
+	if err = cmd.Start(); err != nil {
+		statusWrite.Close()
+		return nil, cryptoError(err)
+	}
+	statusWrite.Close()
+
+	var status []string
+	scanner := bufio.NewScanner(statusRead)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "[GNUPG:] ") {
+			status = append(status, strings.TrimPrefix(line, "[GNUPG:] "))
+		}
+	}
+
+	if err = cmd.Wait(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return status, &Error{Kind: KindCrypto, Message: "gpg failed: " + message, Err: err}
+	}
+	return status, nil
+}
+
+// ExportPublicKey returns the armoured public key of Key from the GnuPG
+// keyring
+func (g GPG) ExportPublicKey() (string, error) {
+	if g.Key == "" {
+		return "", cryptoError(errors.New("no gpg key has been chosen"))
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := g.run(nil, out, "--armor", "--export", g.Key); err != nil {
+		return "", err
+	}
+
+	entityList, err := ReadKeyRing(out.String())
+	if err != nil {
+		return "", cryptoError(fmt.Errorf("gpg has no usable public key for %s: %v", g.Key, err))
+	}
+	if len(entityList) != 1 {
+		return "", cryptoError(fmt.Errorf("%s matches %d keys in gpg, use its full fingerprint", g.Key, len(entityList)))
+	}
+	return ArmorPublicKey(entityList[0])
+}
+
+// EncryptStream has gpg sign everything read from r with Key and encrypt it
+// to publicKeys, writing the base64 encoded ciphertext to w
+func (g GPG) EncryptStream(w io.Writer, r io.Reader, publicKeys string) error {
+	entityList, err := ReadKeyRing(publicKeys)
+	if err != nil {
+		return cryptoError(err)
+	}
+
+	// The recipients need not be in the GnuPG keyring, so hand them over as
+	// files
+	dir, err := ioutil.TempDir("", "rcrypt-gpg")
+	if err != nil {
+		return cryptoError(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"--sign", "--encrypt", "--local-user", g.Key, "--personal-cipher-preferences", "AES256 AES192 AES", "--personal-digest-preferences", "SHA256"}
+	for i, entity := range entityList {
+		keyFile := filepath.Join(dir, strconv.Itoa(i)+".gpg")
+		f, err := os.Create(keyFile)
+		if err != nil {
+			return cryptoError(err)
+		}
+		err = entity.Serialize(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return cryptoError(err)
+		}
+		args = append(args, "--recipient-file", keyFile)
+	}
+
+	encoder := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err = g.run(r, encoder, append(args, "--output", "-")...); err != nil {
+		return err
+	}
+	return cryptoError(encoder.Close())
+}
+
+// encryptedData is a packet holding the encrypted message, SEIPD (version 1
+// or 2) or the AEAD packet GnuPG 2.3 and later use for keys which prefer it
+type encryptedData interface {
+	Decrypt(c packet.CipherFunction, key []byte) (io.ReadCloser, error)
+}
+
+// DecryptStream has gpg recover the session key of the base64 encoded
+// ciphertext read from r, then decrypts and verifies it like DecryptStream.
+// Signatures are checked here rather than by gpg so signerKeys need not be in
+// the GnuPG keyring.
+func (g GPG) DecryptStream(w io.Writer, r io.Reader, signerKeys string) (string, error) {
+	var signers openpgp.EntityList
+	var err error
+	if signerKeys != "" {
+		if signers, err = ReadKeyRing(signerKeys); err != nil {
+			return "", cryptoError(err)
+		}
+	}
+
+	// The message is read twice, once by gpg and once here, but a crypt holds
+	// at most a chunk
+	cipherText, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, r))
+	if err != nil {
+		return "", cryptoError(err)
+	}
+
+	status, err := g.run(bytes.NewReader(cipherText), ioutil.Discard, "--decrypt", "--skip-verify", "--show-session-key", "--output", "-")
+	if err != nil {
+		return "", err
+	}
+
+	var cipherFunc packet.CipherFunction
+	var sessionKey []byte
+	for _, line := range status {
+		if strings.HasPrefix(line, "SESSION_KEY ") == false {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(line, "SESSION_KEY "), ":", 2)
+		algo, algoErr := strconv.Atoi(parts[0])
+		if algoErr != nil || len(parts) != 2 {
+			return "", cryptoError(errors.New("gpg reported a malformed session key"))
+		}
+		cipherFunc = packet.CipherFunction(algo)
+		if sessionKey, err = hex.DecodeString(parts[1]); err != nil {
+			return "", cryptoError(err)
+		}
+	}
+	if sessionKey == nil {
+		return "", cryptoError(errors.New("gpg did not report the session key"))
+	}
+
+	packets := packet.NewReader(bytes.NewReader(cipherText))
+	for {
+		p, err := packets.Next()
+		if err != nil {
+			return "", cryptoError(err)
+		}
+
+		switch p.(type) {
+		case *packet.EncryptedKey:
+			continue
+		case *packet.SymmetricallyEncrypted, *packet.AEADEncrypted:
+			// An AEAD packet names its own cipher, so cipherFunc goes unused
+			decrypted, err := p.(encryptedData).Decrypt(cipherFunc, sessionKey)
+			if err != nil {
+				return "", cryptoError(err)
+			}
+
+			md, err := openpgp.ReadMessage(decrypted, signers, nil, nil)
+			if err != nil {
+				decrypted.Close()
+				return "", cryptoError(err)
+			}
+			signer, err := readVerified(w, md, signers, signerKeys != "")
+
+			// Closing checks the MDC or final AEAD tag, which nothing else
+			// may have read up to
+			if closeErr := decrypted.Close(); err == nil && closeErr != nil {
+				return "", cryptoError(closeErr)
+			}
+			return signer, err
+		default:
+			return "", cryptoError(errors.New("the payload is not an encrypted message"))
+		}
+	}
+}
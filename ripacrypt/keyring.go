@@ -0,0 +1,265 @@
+package ripacrypt
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"strings"
+)
+
+// ReadKeyRing parses every key in keys, which may hold several armoured key
+// blocks one after the other or a single binary keyring
+func ReadKeyRing(keys string) (openpgp.EntityList, error) {
+	if strings.Contains(keys, "-----BEGIN PGP") == false {
+		return openpgp.ReadKeyRing(strings.NewReader(keys))
+	}
+
+	// armor.Decode reads ahead, so each block has to be handed over alone
+	var entityList openpgp.EntityList
+	for rest := keys; strings.Contains(rest, "-----BEGIN PGP"); {
+		rest = rest[strings.Index(rest, "-----BEGIN PGP"):]
+
+		end := strings.Index(rest, "-----END PGP")
+		if end == -1 {
+			return nil, errors.New("unterminated armoured key block")
+		}
+		if lineEnd := strings.Index(rest[end:], "\n"); lineEnd != -1 {
+			end += lineEnd + 1
+		} else {
+			end = len(rest)
+		}
+
+		block, err := armor.Decode(strings.NewReader(rest[:end]))
+		if err != nil {
+			return nil, err
+		}
+		if block.Type != openpgp.PublicKeyType && block.Type != openpgp.PrivateKeyType {
+			return nil, errors.New("unexpected " + block.Type + " block in key ring")
+		}
+
+		entities, err := openpgp.ReadKeyRing(block.Body)
+		if err != nil {
+			return nil, err
+		}
+		entityList = append(entityList, entities...)
+		rest = rest[end:]
+	}
+
+	if len(entityList) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return entityList, nil
+}
+
+// KeyFingerprint returns the full 40 hex digit fingerprint of a v4 key. It is
+// used everywhere a key is named, the 16 digit key ID being too easy to
+// collide.
+func KeyFingerprint(key *packet.PublicKey) string {
+	return fmt.Sprintf("%X", key.Fingerprint)
+}
+
+// KeyAlgorithm describes the algorithm and size of key, e.g. "RSA 2048"
+func KeyAlgorithm(key *packet.PublicKey) string {
+	var name string
+	switch key.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		name = "RSA"
+	case packet.PubKeyAlgoDSA:
+		name = "DSA"
+	case packet.PubKeyAlgoElGamal:
+		name = "ElGamal"
+	case packet.PubKeyAlgoECDSA:
+		name = "ECDSA"
+	case packet.PubKeyAlgoECDH:
+		name = "ECDH"
+	case packet.PubKeyAlgoEdDSA:
+		name = "EdDSA"
+	default:
+		return fmt.Sprintf("algorithm %d", key.PubKeyAlgo)
+	}
+
+	bits, err := key.BitLength()
+	if err != nil {
+		return name
+	}
+	return fmt.Sprintf("%s %d", name, bits)
+}
+
+// ArmorPublicKey returns just the armoured public half of entity, whatever
+// form it was read from
+func ArmorPublicKey(entity *openpgp.Entity) (string, error) {
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	if err = entity.Serialize(w); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// OrderRSAPrimes makes the RSA keys of a freshly generated entity serialize
+// with p < q, as RFC 4880 requires. Go leaves the primes in any order and
+// GnuPG now and then gets the secret key operations of a key with p > q
+// wrong, so a key which may end up in gpg must be ordered before it is first
+// serialized.
+func OrderRSAPrimes(entity *openpgp.Entity) {
+	keys := []*packet.PrivateKey{entity.PrivateKey}
+	for _, subkey := range entity.Subkeys {
+		keys = append(keys, subkey.PrivateKey)
+	}
+
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		rsaKey, ok := key.PrivateKey.(*rsa.PrivateKey)
+		if ok == false || len(rsaKey.Primes) != 2 {
+			continue
+		}
+
+		// The second prime is written out as p
+		if rsaKey.Primes[1].Cmp(rsaKey.Primes[0]) > 0 {
+			rsaKey.Primes[0], rsaKey.Primes[1] = rsaKey.Primes[1], rsaKey.Primes[0]
+			rsaKey.Precomputed = rsa.PrecomputedValues{}
+			rsaKey.Precompute()
+		}
+	}
+}
+
+// ErrKeyMismatch is returned when a secret key does not belong to the public
+// key it is being imported for
+var ErrKeyMismatch = errors.New("the secret key does not match the public key")
+
+// ImportedKey is a secret key made ready for use by ImportSecretKey
+type ImportedKey struct {
+	// PublicKey and PrivateKey are armoured, the private key unprotected
+	PublicKey   string
+	PrivateKey  string
+	Fingerprint string
+
+	// Passphrase is the one the key was protected with, if it was
+	Passphrase []byte
+}
+
+// ImportSecretKey reads an armoured or binary secret key (e.g. from gpg
+// --export-secret-keys), calling prompt for its passphrase if it is
+// protected. If publicKey is set the secret key must belong to it. The key is
+// checked by signing and encrypting a message to itself before it is
+// returned.
+func ImportSecretKey(secretKey, publicKey string, prompt PassphraseFunc) (ImportedKey, error) {
+	var imported ImportedKey
+
+	entityList, err := ReadKeyRing(secretKey)
+	if err != nil {
+		return imported, cryptoError(err)
+	}
+	if len(entityList) != 1 {
+		return imported, cryptoError(fmt.Errorf("expected exactly one secret key, found %d", len(entityList)))
+	}
+	entity := entityList[0]
+	if entity.PrivateKey == nil {
+		return imported, cryptoError(errors.New("no secret key found, only a public key"))
+	}
+
+	if publicKey != "" {
+		publicList, err := ReadKeyRing(publicKey)
+		if err != nil {
+			return imported, cryptoError(err)
+		}
+		if bytes.Equal(publicList[0].PrimaryKey.Fingerprint, entity.PrimaryKey.Fingerprint) == false {
+			return imported, cryptoError(ErrKeyMismatch)
+		}
+	}
+
+	privateKeys := []*packet.PrivateKey{entity.PrivateKey}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey == nil {
+			return imported, cryptoError(errors.New("the secret key is missing the secret part of subkey " + subkey.PublicKey.KeyIdString()))
+		}
+		privateKeys = append(privateKeys, subkey.PrivateKey)
+	}
+
+	for _, privateKey := range privateKeys {
+		if privateKey.Encrypted == false {
+			continue
+		}
+		if imported.Passphrase == nil {
+			if prompt == nil {
+				return imported, cryptoError(errors.New("the secret key is passphrase protected but no passphrase was supplied"))
+			}
+			if imported.Passphrase, err = prompt(); err != nil {
+				return imported, cryptoError(err)
+			}
+		}
+		if err = privateKey.Decrypt(imported.Passphrase); err != nil {
+			return imported, &Error{Kind: KindCrypto, Err: ErrBadPassphrase}
+		}
+	}
+
+	privBuf := new(bytes.Buffer)
+	w, err := armor.Encode(privBuf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return imported, cryptoError(err)
+	}
+	if err = entity.SerializePrivate(w, nil); err != nil {
+		return imported, cryptoError(err)
+	}
+	if err = w.Close(); err != nil {
+		return imported, cryptoError(err)
+	}
+
+	imported.PrivateKey = privBuf.String()
+	imported.Fingerprint = KeyFingerprint(entity.PrimaryKey)
+	if imported.PublicKey, err = ArmorPublicKey(entity); err != nil {
+		return imported, cryptoError(err)
+	}
+
+	return imported, CheckKeyPair(imported.PublicKey, imported.PrivateKey)
+}
+
+// CheckKeyPair makes sure an unlocked armoured private key can sign, and
+// decrypt messages encrypted to, publicKey
+func CheckKeyPair(publicKey, privateKey string) error {
+	ciphertext := new(bytes.Buffer)
+	if err := EncryptStream(ciphertext, strings.NewReader("ripacrypt"), publicKey, privateKey); err != nil {
+		return err
+	}
+
+	plaintext := new(bytes.Buffer)
+	signer, err := DecryptStream(plaintext, ciphertext, privateKey, nil, publicKey)
+	if err != nil {
+		return err
+	}
+	if signer == "" || plaintext.String() != "ripacrypt" {
+		return cryptoError(ErrKeyMismatch)
+	}
+	return nil
+}
+
+// CheckKeyBackend makes sure backend can sign, and decrypt messages encrypted
+// to, publicKey
+func CheckKeyBackend(backend KeyBackend, publicKey string) error {
+	ciphertext := new(bytes.Buffer)
+	if err := backend.EncryptStream(ciphertext, strings.NewReader("ripacrypt"), publicKey); err != nil {
+		return err
+	}
+
+	plaintext := new(bytes.Buffer)
+	signer, err := backend.DecryptStream(plaintext, ciphertext, publicKey)
+	if err != nil {
+		return err
+	}
+	if signer == "" || plaintext.String() != "ripacrypt" {
+		return cryptoError(ErrKeyMismatch)
+	}
+	return nil
+}
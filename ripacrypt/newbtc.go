@@ -0,0 +1,33 @@
+package ripacrypt
+
+// ClientBTCRequest describes the JSON payload required for requesting a new bitcoin address
+type ClientBTCRequest struct {
+	UserID      uint64 `json:"user_id"`
+	Challenge   string `json:"challenge"`
+	ChallengeID uint64 `json:"challenge_id"`
+}
+
+// GetBTC will generate a new bitcoin address for your account (server side)
+// this should be done after every transaction to ensure your anonymity
+//
+// WARNING WARNING WARNING WARNING WARNING WARNING WARNING WARNING WARNING
+//
+// Previous addresses are not retained so if you have sent some BTC ensure your
+// account balance is updated before changing the address!
+//
+// WARNING WARNING WARNING WARNING WARNING WARNING WARNING WARNING WARNING
+func (c *Client) GetBTC() (APIRegisterResponse, error) {
+	decryptedChallenge, challengeID, challengeErr := c.solveChallenge()
+	if challengeErr != nil {
+		return APIRegisterResponse{}, challengeErr
+	}
+
+	var apiResponse APIRegisterResponse
+	err := c.do("POST", "newbtc/", ClientBTCRequest{
+		UserID:      c.Credentials.UserID,
+		Challenge:   decryptedChallenge,
+		ChallengeID: challengeID,
+	}, &apiResponse)
+
+	return apiResponse, err
+}
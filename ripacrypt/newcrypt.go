@@ -0,0 +1,107 @@
+package ripacrypt
+
+import (
+	"bytes"
+	"strings"
+	"time"
+)
+
+// NewCryptAPIResponse describes the JSON that the API will return to us
+type NewCryptAPIResponse struct {
+	StatusCode int    `json:"status_code"`
+	Success    bool   `json:"success"`
+	Message    string `json:"status_message"`
+	Version    int64  `json:"version"`
+
+	CryptPayload Crypt `json:"crypt"`
+}
+
+// Crypt describes the structure of a crypt and the JSON layout embedded within
+// the API response NewCryptAPIResponse
+type Crypt struct {
+	UserID          uint64 `json:"-"`
+	CryptID         string `json:"crypt_id"`
+	CipherText      string `json:"ciphertext"`
+	CreateTimeStamp int64  `json:"crypt_timestamp"`
+	Description     string `json:"crypt_description"`
+	IsDestroyed     bool   `json:"is_crypt_destroyed"`
+	LastCheckIn     int64  `json:"last_checkin"`
+	CheckInDuration int64  `json:"check_in_duration"`
+	MissCount       int64  `json:"miss_count"`
+}
+
+// LastAlive returns the time of the last checkin with the crypt, falling back
+// to its creation time if it has never been checked in with
+func (c Crypt) LastAlive() time.Time {
+	if c.LastCheckIn == 0 {
+		return time.Unix(c.CreateTimeStamp, 0)
+	}
+	return time.Unix(c.LastCheckIn, 0)
+}
+
+// Deadline returns the time at which the crypt will be destroyed unless it is
+// checked in with, i.e. once MissCount checkin durations have been missed
+func (c Crypt) Deadline() time.Time {
+	return c.LastAlive().Add(time.Duration(c.CheckInDuration*c.MissCount) * time.Second)
+}
+
+// ClientCryptRequest describes the JSON payload that needs to tbe send to the
+// API to generate a new Crypt
+type ClientCryptRequest struct {
+	UserID          uint64 `json:"user_id"`
+	CryptContent    string `json:"crypt_content"`
+	Challenge       string `json:"challenge"`
+	ChallengeID     uint64 `json:"challenge_id"`
+	Description     string `json:"description"`
+	CheckInDuration int64  `json:"checkin_duration"`
+	MissCount       int64  `json:"miss_count"`
+}
+
+// NewCrypt takes a series of arguments (most notably the secret to store) and
+// then encrypts the secret (if not already encrypted), substitutes sensible
+// defaults for missing values and then sends an API request to get a challenge
+// nonce, decrypts it and then submits the entire payload to the /1/crypt/new/
+// endpoint to create a new crypt
+func (c *Client) NewCrypt(dataToStore string, Description string, CheckInDuration int64, MissCount int64, IsEncrypted bool) (NewCryptAPIResponse, error) {
+	var encryptedData string
+
+	if IsEncrypted == false {
+		buf := new(bytes.Buffer)
+		if encryptErr := c.EncryptPayload(buf, strings.NewReader(dataToStore)); encryptErr != nil {
+			return NewCryptAPIResponse{}, encryptErr
+		}
+		encryptedData = buf.String()
+	} else {
+		encryptedData = dataToStore
+	}
+
+	decryptedChallenge, challengeID, challengeErr := c.solveChallenge()
+	if challengeErr != nil {
+		return NewCryptAPIResponse{}, challengeErr
+	}
+
+	var apiResponse NewCryptAPIResponse
+	err := c.do("POST", "crypt/new/", ClientCryptRequest{UserID: c.Credentials.UserID,
+		Description:     Description,
+		CryptContent:    encryptedData,
+		Challenge:       decryptedChallenge,
+		ChallengeID:     challengeID,
+		CheckInDuration: CheckInDuration,
+		MissCount:       MissCount,
+	}, &apiResponse)
+
+	return apiResponse, err
+}
+
+// EncryptData simply takes a plaintext string and a public key armoured
+// string and returns an armoured, encrypted version of the plaintext.
+// This is the 'end-to-end' nature of RIPACrypt - our servers never see a
+// users private key so can never decrypt their data. The result is not
+// signed, Client.NewCrypt signs what it stores.
+func EncryptData(clearText, publicKey string) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := EncryptStream(buf, strings.NewReader(clearText), publicKey, ""); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
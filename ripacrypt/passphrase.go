@@ -0,0 +1,123 @@
+package ripacrypt
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"io/ioutil"
+	"strings"
+)
+
+// protectedKeyType is the armor block type of a passphrase protected private
+// key, which is simply the armoured private key symmetrically encrypted as an
+// OpenPGP message (so `gpg -d` can recover it if this client is unavailable)
+const protectedKeyType = "PGP MESSAGE"
+
+// ErrBadPassphrase is returned when a passphrase fails to unlock a message
+var ErrBadPassphrase = errors.New("incorrect passphrase")
+
+// PassphraseFunc is called whenever a passphrase is needed to unlock a
+// protected private key
+type PassphraseFunc func() ([]byte, error)
+
+// symmetricConfig makes the passphrase as expensive as possible to brute force
+var symmetricConfig = packet.Config{
+	DefaultCipher: packet.CipherAES256,
+	S2KCount:      65011712,
+}
+
+// SymmetricallyEncrypt encrypts data under passphrase and returns an armoured
+// OpenPGP message
+func SymmetricallyEncrypt(data, passphrase []byte) (string, error) {
+	buf := new(bytes.Buffer)
+	armorWriter, err := armor.Encode(buf, protectedKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+
+	w, err := openpgp.SymmetricallyEncrypt(armorWriter, passphrase, nil, &symmetricConfig)
+	if err != nil {
+		return "", err
+	}
+	if _, err = w.Write(data); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	if err = armorWriter.Close(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// SymmetricallyDecrypt reverses SymmetricallyEncrypt, returning
+// ErrBadPassphrase if passphrase does not unlock the message
+func SymmetricallyDecrypt(message string, passphrase []byte) ([]byte, error) {
+	block, err := armor.Decode(strings.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+
+	// ReadMessage keeps asking until it gets the right passphrase, so only
+	// offer ours once
+	tried := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if tried == true {
+			return nil, ErrBadPassphrase
+		}
+		tried = true
+		return passphrase, nil
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, nil, prompt, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
+
+// IsPrivateKeyProtected reports whether privateKey is passphrase protected
+func IsPrivateKeyProtected(privateKey string) bool {
+	block, err := armor.Decode(strings.NewReader(privateKey))
+	if err != nil {
+		return false
+	}
+	return block.Type == protectedKeyType
+}
+
+// ProtectPrivateKey encrypts an armoured private key under passphrase so it
+// can be safely stored on disk
+func ProtectPrivateKey(privateKey string, passphrase []byte) (string, error) {
+	if IsPrivateKeyProtected(privateKey) == true {
+		return "", errors.New("private key is already passphrase protected")
+	}
+	return SymmetricallyEncrypt([]byte(privateKey), passphrase)
+}
+
+// UnlockPrivateKey returns the armoured private key, calling prompt for the
+// passphrase if privateKey is protected. Unprotected keys are returned as is.
+func UnlockPrivateKey(privateKey string, prompt PassphraseFunc) (string, error) {
+	if IsPrivateKeyProtected(privateKey) == false {
+		return privateKey, nil
+	}
+
+	if prompt == nil {
+		return "", errors.New("private key is passphrase protected but no passphrase was supplied")
+	}
+
+	passphrase, err := prompt()
+	if err != nil {
+		return "", err
+	}
+
+	unlocked, err := SymmetricallyDecrypt(privateKey, passphrase)
+	if err != nil {
+		return "", err
+	}
+	return string(unlocked), nil
+}
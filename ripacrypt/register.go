@@ -0,0 +1,48 @@
+package ripacrypt
+
+import (
+	"bytes"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+//ClientRegisterRequest describes the JSON payload used to register a new
+// account
+type ClientRegisterRequest struct {
+	PublicKey string `json:"public_key"`
+}
+
+// APIRegisterResponse describes the JSON reply from the API detailing the new
+// user account e.g. their userid and Bitcoin address
+type APIRegisterResponse struct {
+	StatusCode int    `json:"status_code"`
+	Success    bool   `json:"success"`
+	Message    string `json:"status_message"`
+	Version    int64  `json:"version"`
+
+	BTCAddr string `json:"btc_addr"`
+	UserID  uint64 `json:"user_id"`
+}
+
+// Register takes a PublicKey string and submits it to the RIPACrypt API to
+// register a new account. Each account receives a unique bitcoin address that
+// can be used to expand storage space, for donations or notifcation credits
+// (future plans).
+func (c *Client) Register(PublicKey string) (APIRegisterResponse, error) {
+	var apiResponse APIRegisterResponse
+
+	err := c.do("POST", "register/", ClientRegisterRequest{PublicKey: PublicKey}, &apiResponse)
+	return apiResponse, err
+}
+
+// VerifyGPGPublicKey simply takes an armoured  GPG key and attemts to parse it
+// if successful we return its full fingerprint
+func VerifyGPGPublicKey(PublicKey string) (string, error) {
+
+	keyBuffer := bytes.NewBufferString(PublicKey)
+	entityList, armorErr := openpgp.ReadArmoredKeyRing(keyBuffer)
+
+	if armorErr != nil {
+		return "", armorErr
+	}
+	return KeyFingerprint(entityList[0].PrimaryKey), nil
+}
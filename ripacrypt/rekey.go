@@ -0,0 +1,103 @@
+package ripacrypt
+
+import (
+	"bytes"
+)
+
+// RetiredKey is a key the account has rotated away from. It still decrypts,
+// and is trusted to have signed, crypts until they have all been re-encrypted
+// to the new key.
+type RetiredKey struct {
+	Fingerprint string `json:"fingerprint"`
+	PublicKey   string `json:"public_key"`
+	PrivateKey  string `json:"private_key"`
+}
+
+// ClientRekeyRequest describes the JSON payload which replaces the public key
+// of an account
+type ClientRekeyRequest struct {
+	UserID      uint64 `json:"user_id"`
+	Challenge   string `json:"challenge"`
+	ChallengeID uint64 `json:"challenge_id"`
+	PublicKey   string `json:"public_key"`
+}
+
+// ClientUpdateRequest describes the JSON payload which replaces the contents
+// of a crypt
+type ClientUpdateRequest struct {
+	UserID       uint64 `json:"user_id"`
+	Challenge    string `json:"challenge"`
+	ChallengeID  uint64 `json:"challenge_id"`
+	CryptContent string `json:"crypt_content"`
+}
+
+// Rekey registers newPublicKey in place of the accounts current key, proving
+// possession of the current key by answering a challenge with it. From then
+// on challenges are encrypted to the new key, so Credentials must be updated
+// before the client is used again.
+//
+// The /1/rekey/ endpoint is not part of every RIPACrypt server, if it is
+// missing the error wraps ErrUnsupported.
+func (c *Client) Rekey(newPublicKey string) (APIRegisterResponse, error) {
+	var apiResponse APIRegisterResponse
+
+	decryptedChallenge, challengeID, challengeErr := c.solveChallenge()
+	if challengeErr != nil {
+		return apiResponse, challengeErr
+	}
+
+	err := c.do("POST", "rekey/", ClientRekeyRequest{
+		UserID:      c.Credentials.UserID,
+		Challenge:   decryptedChallenge,
+		ChallengeID: challengeID,
+		PublicKey:   newPublicKey,
+	}, &apiResponse)
+
+	return apiResponse, unsupportedError(err, "rotating keys", nil)
+}
+
+// UpdateCrypt sends a HTTP PUT to the /1/crypt/CRYPTID/ endpoint replacing the
+// ciphertext of a crypt, which keeps its ID and deadline.
+//
+// The endpoint is not part of every RIPACrypt server, if it is missing the
+// error wraps ErrUnsupported.
+func (c *Client) UpdateCrypt(cryptID, cipherText string) (NewCryptAPIResponse, error) {
+	decryptedChallenge, challengeID, challengeErr := c.solveChallenge()
+	if challengeErr != nil {
+		return NewCryptAPIResponse{}, challengeErr
+	}
+
+	var apiResponse NewCryptAPIResponse
+	err := c.do("PUT", "crypt/"+cryptID+"/", ClientUpdateRequest{
+		UserID:       c.Credentials.UserID,
+		Challenge:    decryptedChallenge,
+		ChallengeID:  challengeID,
+		CryptContent: cipherText,
+	}, &apiResponse)
+
+	return apiResponse, unsupportedError(err, "updating crypts", func() bool { return c.cryptExists(cryptID) })
+}
+
+// Reencrypt fetches a crypt, checks its signature like DecryptPayload and
+// stores its contents again encrypted to the clients current key and
+// Recipients. The manifest and chunks of a chunked payload are separate
+// crypts, each is re-encrypted on its own.
+func (c *Client) Reencrypt(cryptID string) (NewCryptAPIResponse, error) {
+	apiResponse, err := c.GetCrypt(cryptID)
+	if err != nil {
+		return apiResponse, err
+	}
+
+	// A crypt holds at most a chunk
+	plaintext := new(bytes.Buffer)
+	if _, err = c.decryptVerified(plaintext, apiResponse.CryptPayload.CipherText); err != nil {
+		return apiResponse, err
+	}
+
+	cipherText := new(bytes.Buffer)
+	if err = c.EncryptPayload(cipherText, plaintext); err != nil {
+		return apiResponse, err
+	}
+
+	return c.UpdateCrypt(cryptID, cipherText.String())
+}
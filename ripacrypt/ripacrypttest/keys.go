@@ -0,0 +1,51 @@
+package ripacrypttest
+
+import (
+	"bytes"
+	"crypto"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// GenerateKeyPair creates a throwaway armoured key pair for tests
+func GenerateKeyPair() (publicKey, privateKey string, err error) {
+	packetConf := packet.Config{DefaultHash: crypto.SHA256}
+	entity, err := openpgp.NewEntity("Test", "", "test@clients.ripacrypt.invalid", &packetConf)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Match the keys rcrypt register generates
+	ripacrypt.OrderRSAPrimes(entity)
+	for _, id := range entity.Identities {
+		err = id.SelfSignature.SignUserId(id.UserId.Id, entity.PrimaryKey, entity.PrivateKey, nil)
+		if err != nil {
+			return "", "", err
+		}
+		id.SelfSignature.PreferredHash = []uint8{8}
+	}
+
+	pubBuf := new(bytes.Buffer)
+	w, err := armor.Encode(pubBuf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", "", err
+	}
+	if err = entity.Serialize(w); err != nil {
+		return "", "", err
+	}
+	w.Close()
+
+	privBuf := new(bytes.Buffer)
+	w, err = armor.Encode(privBuf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return "", "", err
+	}
+	if err = entity.SerializePrivate(w, nil); err != nil {
+		return "", "", err
+	}
+	w.Close()
+
+	return pubBuf.String(), privBuf.String(), nil
+}
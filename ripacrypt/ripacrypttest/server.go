@@ -0,0 +1,519 @@
+// Package ripacrypttest provides an in-process RIPACrypt API server for tests
+// and offline development.
+//
+// It implements every endpoint the client uses, encrypts real OpenPGP
+// challenges to each users public key and destroys crypts once their deadline
+// has passed, but keeps everything in memory.
+package ripacrypttest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/BrassHornCommunications/RIPACrypt/ripacrypt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIVERSION is reported in the version field of every response
+const APIVERSION = 1
+
+// user is a registered account
+type user struct {
+	id          uint64
+	btcAddr     string
+	fingerprint string
+	keyRing     openpgp.EntityList
+}
+
+// challenge is an outstanding challenge nonce waiting to be answered
+type challenge struct {
+	userID uint64
+	nonce  string
+}
+
+// Server is a mock RIPACrypt API. The zero value is not usable, create one
+// with NewServer or NewHandler.
+type Server struct {
+	// URL is the base URL of the API (with trailing slash) when started via
+	// NewServer, suitable for ripacrypt.NewClient
+	URL string
+
+	mu         sync.Mutex
+	httpServer *httptest.Server
+	users      map[uint64]*user
+	challenges map[uint64]challenge
+	crypts     map[string]*ripacrypt.Crypt
+	lastUserID uint64
+	lastChalID uint64
+
+	// disabled are the endpoints, as "METHOD name", Disable has removed
+	disabled map[string]bool
+
+	// lost are the endpoints whose next reply FailReply replaces
+	lost map[string]int
+
+	// offset is how far Advance has moved the clock forward
+	offset time.Duration
+}
+
+// NewHandler returns a mock server that is not listening anywhere, serve it
+// yourself e.g. with http.ListenAndServe(addr, http.StripPrefix("/1", s))
+func NewHandler() *Server {
+	return &Server{
+		users:      make(map[uint64]*user),
+		challenges: make(map[uint64]challenge),
+		crypts:     make(map[string]*ripacrypt.Crypt),
+		disabled:   make(map[string]bool),
+		lost:       make(map[string]int),
+	}
+}
+
+// NewServer starts a mock server on a local port. Call Close when finished.
+func NewServer() *Server {
+	s := NewHandler()
+	s.httpServer = httptest.NewServer(http.StripPrefix("/1", s))
+	s.URL = s.httpServer.URL + "/1/"
+	return s
+}
+
+// Close shuts down a server started with NewServer
+func (s *Server) Close() {
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+// Advance moves the servers clock forward by d, destroying any crypts whose
+// deadline it passes without having to wait
+func (s *Server) Advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.offset += d
+}
+
+// Disable makes the server answer 404 to an endpoint, named by its method and
+// first path element e.g. ("DELETE", "crypt") or ("POST", "rekey"), like a
+// server which doesn't implement it
+func (s *Server) Disable(method, endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.disabled[method+" "+endpoint] = true
+}
+
+// FailReply makes the next request to an endpoint, named as for Disable,
+// succeed but reply with statusCode instead, like a server which acted on the
+// request before failing or a reply lost on the way back
+func (s *Server) FailReply(method, endpoint string, statusCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lost[method+" "+endpoint] = statusCode
+}
+
+// Forget removes a crypt entirely, like a server which purges destroyed
+// crypts and answers 404 for them
+func (s *Server) Forget(cryptID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.crypts, cryptID)
+}
+
+// now returns the servers idea of the current time
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+// Crypt returns a copy of the servers view of a crypt, applying any pending
+// destruction first
+func (s *Server) Crypt(cryptID string) (ripacrypt.Crypt, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	crypt, ok := s.crypts[cryptID]
+	if ok == false {
+		return ripacrypt.Crypt{}, false
+	}
+	s.expire(crypt)
+	return *crypt, true
+}
+
+// SetCipherText replaces the stored contents of a crypt, as a malicious or
+// compromised server might
+func (s *Server) SetCipherText(cryptID, cipherText string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	crypt, ok := s.crypts[cryptID]
+	if ok == true {
+		crypt.CipherText = cipherText
+	}
+	return ok
+}
+
+// ServeHTTP routes API requests, paths are relative to the /1/ API root
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+
+	if statusCode, ok := s.lost[r.Method+" "+parts[0]]; ok == true {
+		delete(s.lost, r.Method+" "+parts[0])
+		s.route(httptest.NewRecorder(), r, path, parts)
+		s.reply(w, statusCode, &ripacrypt.NewCryptAPIResponse{Message: http.StatusText(statusCode)})
+		return
+	}
+	s.route(w, r, path, parts)
+}
+
+// route dispatches a request to its endpoint
+func (s *Server) route(w http.ResponseWriter, r *http.Request, path string, parts []string) {
+	switch {
+	case s.disabled[r.Method+" "+parts[0]]:
+		s.reply(w, http.StatusNotFound, &ripacrypt.NewCryptAPIResponse{Message: "unknown endpoint"})
+	case path == "register" && r.Method == "POST":
+		s.register(w, r)
+	case path == "challenge" && r.Method == "POST":
+		s.challenge(w, r)
+	case path == "newbtc" && r.Method == "POST":
+		s.newBTC(w, r)
+	case path == "rekey" && r.Method == "POST":
+		s.rekey(w, r)
+	case path == "crypt/new" && r.Method == "POST":
+		s.newCrypt(w, r)
+	case len(parts) == 2 && parts[0] == "crypt" && r.Method == "GET":
+		s.getCrypt(w, parts[1])
+	case len(parts) == 2 && parts[0] == "crypt" && r.Method == "POST":
+		s.checkin(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "crypt" && r.Method == "PUT":
+		s.update(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "crypt" && r.Method == "DELETE":
+		s.destroy(w, r, parts[1])
+	default:
+		s.reply(w, http.StatusNotFound, &ripacrypt.NewCryptAPIResponse{Message: "unknown endpoint"})
+	}
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	var req ripacrypt.ClientRegisterRequest
+	if json.NewDecoder(r.Body).Decode(&req) != nil {
+		s.reply(w, http.StatusBadRequest, &ripacrypt.APIRegisterResponse{Message: "malformed request"})
+		return
+	}
+
+	keyRing, err := openpgp.ReadArmoredKeyRing(strings.NewReader(req.PublicKey))
+	if err != nil || len(keyRing) == 0 {
+		s.reply(w, http.StatusBadRequest, &ripacrypt.APIRegisterResponse{Message: "invalid public key"})
+		return
+	}
+
+	fingerprint, _ := ripacrypt.VerifyGPGPublicKey(req.PublicKey)
+
+	s.lastUserID++
+	u := &user{
+		id:          s.lastUserID,
+		btcAddr:     "1mock" + randomHex(14),
+		fingerprint: fingerprint,
+		keyRing:     keyRing,
+	}
+	s.users[u.id] = u
+
+	s.reply(w, http.StatusOK, &ripacrypt.APIRegisterResponse{
+		Success: true,
+		Message: "registered",
+		UserID:  u.id,
+		BTCAddr: u.btcAddr,
+	})
+}
+
+func (s *Server) challenge(w http.ResponseWriter, r *http.Request) {
+	var req ripacrypt.ClientChallengeRequest
+	if json.NewDecoder(r.Body).Decode(&req) != nil {
+		s.reply(w, http.StatusBadRequest, &ripacrypt.ChallengeAPIResponse{Message: "malformed request"})
+		return
+	}
+
+	u, ok := s.users[req.UserID]
+	if ok == false || u.fingerprint != req.Fingerprint {
+		s.reply(w, http.StatusForbidden, &ripacrypt.ChallengeAPIResponse{Message: "unknown user or fingerprint"})
+		return
+	}
+
+	nonce := randomHex(32)
+	buf := new(bytes.Buffer)
+	pw, err := openpgp.Encrypt(buf, u.keyRing, nil, nil, nil)
+	if err == nil {
+		_, err = pw.Write([]byte(nonce))
+	}
+	if err == nil {
+		err = pw.Close()
+	}
+	if err != nil {
+		s.reply(w, http.StatusInternalServerError, &ripacrypt.ChallengeAPIResponse{Message: err.Error()})
+		return
+	}
+
+	s.lastChalID++
+	s.challenges[s.lastChalID] = challenge{userID: u.id, nonce: nonce}
+
+	s.reply(w, http.StatusOK, &ripacrypt.ChallengeAPIResponse{
+		Success:     true,
+		Message:     "challenge issued",
+		Challenge:   base64.StdEncoding.EncodeToString(buf.Bytes()),
+		ChallengeID: s.lastChalID,
+		UserID:      u.id,
+	})
+}
+
+// solved checks (and uses up) a challenge answer
+func (s *Server) solved(userID uint64, answer string, challengeID uint64) bool {
+	c, ok := s.challenges[challengeID]
+	delete(s.challenges, challengeID)
+
+	return ok && c.userID == userID && c.nonce == answer
+}
+
+func (s *Server) newBTC(w http.ResponseWriter, r *http.Request) {
+	var req ripacrypt.ClientBTCRequest
+	if json.NewDecoder(r.Body).Decode(&req) != nil {
+		s.reply(w, http.StatusBadRequest, &ripacrypt.APIRegisterResponse{Message: "malformed request"})
+		return
+	}
+
+	if s.solved(req.UserID, req.Challenge, req.ChallengeID) == false {
+		s.reply(w, http.StatusForbidden, &ripacrypt.APIRegisterResponse{Message: "challenge failed"})
+		return
+	}
+
+	u := s.users[req.UserID]
+	u.btcAddr = "1mock" + randomHex(14)
+
+	s.reply(w, http.StatusOK, &ripacrypt.APIRegisterResponse{
+		Success: true,
+		Message: "new bitcoin address generated",
+		UserID:  u.id,
+		BTCAddr: u.btcAddr,
+	})
+}
+
+func (s *Server) rekey(w http.ResponseWriter, r *http.Request) {
+	var req ripacrypt.ClientRekeyRequest
+	if json.NewDecoder(r.Body).Decode(&req) != nil {
+		s.reply(w, http.StatusBadRequest, &ripacrypt.APIRegisterResponse{Message: "malformed request"})
+		return
+	}
+
+	// The answer proves possession of the key being replaced
+	if s.solved(req.UserID, req.Challenge, req.ChallengeID) == false {
+		s.reply(w, http.StatusForbidden, &ripacrypt.APIRegisterResponse{Message: "challenge failed"})
+		return
+	}
+
+	keyRing, err := openpgp.ReadArmoredKeyRing(strings.NewReader(req.PublicKey))
+	if err != nil || len(keyRing) == 0 {
+		s.reply(w, http.StatusBadRequest, &ripacrypt.APIRegisterResponse{Message: "invalid public key"})
+		return
+	}
+
+	u := s.users[req.UserID]
+	u.fingerprint, _ = ripacrypt.VerifyGPGPublicKey(req.PublicKey)
+	u.keyRing = keyRing
+
+	s.reply(w, http.StatusOK, &ripacrypt.APIRegisterResponse{
+		Success: true,
+		Message: "public key replaced",
+		UserID:  u.id,
+		BTCAddr: u.btcAddr,
+	})
+}
+
+func (s *Server) newCrypt(w http.ResponseWriter, r *http.Request) {
+	var req ripacrypt.ClientCryptRequest
+	if json.NewDecoder(r.Body).Decode(&req) != nil {
+		s.reply(w, http.StatusBadRequest, &ripacrypt.NewCryptAPIResponse{Message: "malformed request"})
+		return
+	}
+
+	if s.solved(req.UserID, req.Challenge, req.ChallengeID) == false {
+		s.reply(w, http.StatusForbidden, &ripacrypt.NewCryptAPIResponse{Message: "challenge failed"})
+		return
+	}
+
+	if req.CheckInDuration <= 0 {
+		req.CheckInDuration = 86400
+	}
+	if req.MissCount <= 0 {
+		req.MissCount = 3
+	}
+
+	crypt := &ripacrypt.Crypt{
+		UserID:          req.UserID,
+		CryptID:         randomHex(16),
+		CipherText:      req.CryptContent,
+		CreateTimeStamp: s.now().Unix(),
+		Description:     req.Description,
+		CheckInDuration: req.CheckInDuration,
+		MissCount:       req.MissCount,
+	}
+	s.crypts[crypt.CryptID] = crypt
+
+	s.reply(w, http.StatusOK, &ripacrypt.NewCryptAPIResponse{
+		Success:      true,
+		Message:      "crypt created",
+		CryptPayload: *crypt,
+	})
+}
+
+// expire destroys a crypt if its deadline has passed
+func (s *Server) expire(crypt *ripacrypt.Crypt) {
+	if crypt.IsDestroyed == false && s.now().After(crypt.Deadline()) {
+		crypt.IsDestroyed = true
+		crypt.CipherText = ""
+	}
+}
+
+// lookup finds a crypt and replies with an error if it is missing or gone
+func (s *Server) lookup(w http.ResponseWriter, cryptID string) (*ripacrypt.Crypt, bool) {
+	crypt, ok := s.crypts[cryptID]
+	if ok == false {
+		s.reply(w, http.StatusNotFound, &ripacrypt.NewCryptAPIResponse{Message: "crypt not found"})
+		return nil, false
+	}
+
+	s.expire(crypt)
+	if crypt.IsDestroyed == true {
+		s.reply(w, http.StatusGone, &ripacrypt.NewCryptAPIResponse{
+			Message:      "crypt has been destroyed",
+			CryptPayload: *crypt,
+		})
+		return nil, false
+	}
+
+	return crypt, true
+}
+
+func (s *Server) getCrypt(w http.ResponseWriter, cryptID string) {
+	crypt, ok := s.lookup(w, cryptID)
+	if ok == false {
+		return
+	}
+
+	s.reply(w, http.StatusOK, &ripacrypt.NewCryptAPIResponse{
+		Success:      true,
+		Message:      "crypt retrieved",
+		CryptPayload: *crypt,
+	})
+}
+
+func (s *Server) checkin(w http.ResponseWriter, r *http.Request, cryptID string) {
+	var req ripacrypt.ClientCheckinRequest
+	if json.NewDecoder(r.Body).Decode(&req) != nil {
+		s.reply(w, http.StatusBadRequest, &ripacrypt.NewCryptAPIResponse{Message: "malformed request"})
+		return
+	}
+
+	crypt, ok := s.lookup(w, cryptID)
+	if ok == false {
+		return
+	}
+
+	if crypt.UserID != req.UserID || s.solved(req.UserID, req.Challenge, req.ChallengeID) == false {
+		s.reply(w, http.StatusForbidden, &ripacrypt.NewCryptAPIResponse{Message: "challenge failed"})
+		return
+	}
+
+	crypt.LastCheckIn = s.now().Unix()
+
+	s.reply(w, http.StatusOK, &ripacrypt.NewCryptAPIResponse{
+		Success:      true,
+		Message:      "checked in",
+		CryptPayload: *crypt,
+	})
+}
+
+func (s *Server) update(w http.ResponseWriter, r *http.Request, cryptID string) {
+	var req ripacrypt.ClientUpdateRequest
+	if json.NewDecoder(r.Body).Decode(&req) != nil {
+		s.reply(w, http.StatusBadRequest, &ripacrypt.NewCryptAPIResponse{Message: "malformed request"})
+		return
+	}
+
+	crypt, ok := s.lookup(w, cryptID)
+	if ok == false {
+		return
+	}
+
+	if crypt.UserID != req.UserID || s.solved(req.UserID, req.Challenge, req.ChallengeID) == false {
+		s.reply(w, http.StatusForbidden, &ripacrypt.NewCryptAPIResponse{Message: "challenge failed"})
+		return
+	}
+
+	crypt.CipherText = req.CryptContent
+
+	s.reply(w, http.StatusOK, &ripacrypt.NewCryptAPIResponse{
+		Success:      true,
+		Message:      "crypt updated",
+		CryptPayload: *crypt,
+	})
+}
+
+func (s *Server) destroy(w http.ResponseWriter, r *http.Request, cryptID string) {
+	var req ripacrypt.ClientDestroyRequest
+	if json.NewDecoder(r.Body).Decode(&req) != nil {
+		s.reply(w, http.StatusBadRequest, &ripacrypt.NewCryptAPIResponse{Message: "malformed request"})
+		return
+	}
+
+	crypt, ok := s.lookup(w, cryptID)
+	if ok == false {
+		return
+	}
+
+	if crypt.UserID != req.UserID || s.solved(req.UserID, req.Challenge, req.ChallengeID) == false {
+		s.reply(w, http.StatusForbidden, &ripacrypt.NewCryptAPIResponse{Message: "challenge failed"})
+		return
+	}
+
+	crypt.IsDestroyed = true
+	crypt.CipherText = ""
+
+	s.reply(w, http.StatusOK, &ripacrypt.NewCryptAPIResponse{
+		Success:      true,
+		Message:      "crypt destroyed",
+		CryptPayload: *crypt,
+	})
+}
+
+// reply fills in the common status fields and writes the JSON response
+func (s *Server) reply(w http.ResponseWriter, statusCode int, response interface{}) {
+	switch r := response.(type) {
+	case *ripacrypt.APIRegisterResponse:
+		r.StatusCode, r.Version = statusCode, APIVERSION
+	case *ripacrypt.ChallengeAPIResponse:
+		r.StatusCode, r.Version = statusCode, APIVERSION
+	case *ripacrypt.NewCryptAPIResponse:
+		r.StatusCode, r.Version = statusCode, APIVERSION
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(response)
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
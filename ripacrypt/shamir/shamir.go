@@ -0,0 +1,151 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8) so a secret
+// can be spread across several crypts, any threshold of which recover it.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// expTable and logTable hold powers of the generator 3 in GF(2^8) (using the
+// AES polynomial) and their discrete logarithms, for fast multiplication
+var (
+	expTable [255]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+
+		// x *= 3, i.e. x ^ (x * 2) reduced by the AES polynomial
+		doubled := x << 1
+		if x&0x80 != 0 {
+			doubled ^= 0x1b
+		}
+		x ^= doubled
+	}
+}
+
+// mul multiplies a and b in GF(2^8)
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+// div divides a by b in GF(2^8), b must not be 0
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
+
+// evaluate returns the polynomial with coefficients coeffs (lowest first) at x
+func evaluate(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// interpolate returns the value at 0 of the polynomial passing through the
+// points (xs[i], ys[i])
+func interpolate(xs, ys []byte) byte {
+	var y byte
+	for i := range xs {
+		basis := byte(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			// Subtraction is addition (xor) in GF(2^8)
+			basis = mul(basis, div(xs[j], xs[i]^xs[j]))
+		}
+		y ^= mul(ys[i], basis)
+	}
+	return y
+}
+
+// Split divides secret into parts shares, any threshold of which can be
+// passed to Combine to recover it. Fewer than threshold shares reveal nothing
+// about the secret. Each share is one byte longer than the secret.
+func Split(secret []byte, parts, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	if threshold < 2 {
+		return nil, errors.New("the threshold must be at least 2")
+	}
+	if parts < threshold {
+		return nil, errors.New("the number of shares cannot be less than the threshold")
+	}
+	if parts > 255 {
+		return nil, errors.New("cannot create more than 255 shares")
+	}
+
+	// The x coordinate of each share is stored in its last byte
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coeffs := make([]byte, threshold)
+	for idx, b := range secret {
+		coeffs[0] = b
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+
+		for i := range shares {
+			shares[i][idx] = evaluate(coeffs, byte(i+1))
+		}
+	}
+
+	return shares, nil
+}
+
+// Combine recovers the secret from shares created by Split. Passing fewer
+// than the threshold number of shares silently produces garbage.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are needed")
+	}
+
+	length := len(shares[0])
+	if length < 2 {
+		return nil, errors.New("shares are too short")
+	}
+
+	xs := make([]byte, len(shares))
+	seen := make(map[byte]bool)
+	for i, share := range shares {
+		if len(share) != length {
+			return nil, errors.New("shares are not all the same length")
+		}
+
+		x := share[length-1]
+		if x == 0 || seen[x] == true {
+			return nil, errors.New("duplicate or corrupt share")
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	secret := make([]byte, length-1)
+	ys := make([]byte, len(shares))
+	for idx := range secret {
+		for i, share := range shares {
+			ys[i] = share[idx]
+		}
+		secret[idx] = interpolate(xs, ys)
+	}
+
+	return secret, nil
+}
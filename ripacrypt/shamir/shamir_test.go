@@ -0,0 +1,67 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("correct horse battery staple\x00\xff")
+
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("expected 5 shares, got %d", len(shares))
+	}
+
+	// Every combination of three shares recovers the secret
+	for a := 0; a < 5; a++ {
+		for b := a + 1; b < 5; b++ {
+			for c := b + 1; c < 5; c++ {
+				recovered, err := Combine([][]byte{shares[c], shares[a], shares[b]})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Equal(recovered, secret) == false {
+					t.Errorf("shares %d, %d and %d recovered %q", a, b, c, recovered)
+				}
+			}
+		}
+	}
+
+	recovered, err := Combine(shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(recovered, secret) == false {
+		t.Errorf("all shares recovered %q", recovered)
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	if _, err := Split([]byte("secret"), 2, 3); err == nil {
+		t.Error("split with fewer shares than the threshold")
+	}
+	if _, err := Split([]byte("secret"), 3, 1); err == nil {
+		t.Error("split with a threshold of 1")
+	}
+	if _, err := Split(nil, 3, 2); err == nil {
+		t.Error("split an empty secret")
+	}
+}
+
+func TestCombineInvalid(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Combine([][]byte{shares[0], shares[0]}); err == nil {
+		t.Error("combined a duplicated share")
+	}
+	if _, err = Combine([][]byte{shares[0], shares[1][1:]}); err == nil {
+		t.Error("combined shares of different lengths")
+	}
+}
@@ -0,0 +1,356 @@
+package ripacrypt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"io"
+	"strings"
+)
+
+// CHUNKSIZE is the most plaintext NewStreamCrypt stores in a single crypt,
+// larger payloads are split across several
+const CHUNKSIZE = 512 * 1024
+
+// chunkManifestMagic identifies the manifest of a chunked payload
+const chunkManifestMagic = "ripacrypt-chunks-v1"
+
+// ChunkManifest is stored, encrypted like any other payload, in the crypt a
+// chunked payload is known by. It lists the crypts holding the data in order.
+type ChunkManifest struct {
+	Magic  string   `json:"magic"`
+	Size   int64    `json:"size"`
+	SHA256 string   `json:"sha256"`
+	Chunks []string `json:"chunks"`
+}
+
+// ErrUnsigned is returned when a payload carries no signature, as stored by
+// clients from before payloads were signed
+var ErrUnsigned = errors.New("the payload is not signed")
+
+// Payload describes the contents of a crypt written by DecryptPayload
+type Payload struct {
+	// Signer is the fingerprint of the key which signed the payload, empty
+	// if it is unsigned
+	Signer string
+
+	// Chunks lists the crypts a chunked payload was reassembled from
+	Chunks []string
+}
+
+// EncryptStream encrypts everything read from r to publicKeys and writes the
+// base64 encoded ciphertext to w, without holding the payload in memory.
+// publicKeys may hold several armoured keys, any of which can decrypt the
+// result. If signingKey (an unlocked armoured private key) is set the payload
+// is signed with it.
+func EncryptStream(w io.Writer, r io.Reader, publicKeys, signingKey string) error {
+	return encryptStream(w, r, publicKeys, signingKey, nil)
+}
+
+// encryptStream is EncryptStream using the cipher and compression chosen in
+// config, which may be nil for the defaults
+func encryptStream(w io.Writer, r io.Reader, publicKeys, signingKey string, config *packet.Config) error {
+	entityList, err := ReadKeyRing(publicKeys)
+	if err != nil {
+		return cryptoError(err)
+	}
+
+	var signer *openpgp.Entity
+	if signingKey != "" {
+		signerList, err := openpgp.ReadArmoredKeyRing(strings.NewReader(signingKey))
+		if err != nil {
+			return cryptoError(err)
+		}
+		signer = signerList[0]
+	}
+
+	encoder := base64.NewEncoder(base64.StdEncoding, w)
+	packetConf := packet.Config{DefaultHash: crypto.SHA256}
+	if config != nil {
+		packetConf = *config
+		if packetConf.DefaultHash == 0 {
+			packetConf.DefaultHash = crypto.SHA256
+		}
+	}
+	plaintext, err := openpgp.Encrypt(encoder, entityList, signer, nil, &packetConf)
+	if err != nil {
+		return cryptoError(err)
+	}
+
+	if _, err = io.Copy(plaintext, r); err != nil {
+		return cryptoError(err)
+	}
+	if err = plaintext.Close(); err != nil {
+		return cryptoError(err)
+	}
+	return cryptoError(encoder.Close())
+}
+
+// DecryptStream reverses EncryptStream, writing the plaintext of the base64
+// encoded ciphertext read from r to w. If privateKey is passphrase protected
+// prompt is called to unlock it, an unprotected privateKey may hold several
+// keys any of which can decrypt.
+//
+// If signerKeys (armoured public keys) is set any signature must have been
+// made by one of them, and the fingerprint of the signer is returned; an
+// unsigned payload returns an empty fingerprint. Signatures and integrity
+// can only be checked once the whole payload has been read, so w may have
+// been given data before an error is returned.
+func DecryptStream(w io.Writer, r io.Reader, privateKey string, prompt PassphraseFunc, signerKeys string) (string, error) {
+	privateKey, err := UnlockPrivateKey(privateKey, prompt)
+	if err != nil {
+		return "", cryptoError(err)
+	}
+
+	entityList, err := ReadKeyRing(privateKey)
+	if err != nil {
+		return "", cryptoError(err)
+	}
+
+	var signers openpgp.EntityList
+	if signerKeys != "" {
+		if signers, err = ReadKeyRing(signerKeys); err != nil {
+			return "", cryptoError(err)
+		}
+	}
+
+	keyRing := append(append(openpgp.EntityList{}, entityList...), signers...)
+	md, err := openpgp.ReadMessage(base64.NewDecoder(base64.StdEncoding, r), keyRing, nil, nil)
+	if err != nil {
+		return "", cryptoError(err)
+	}
+	return readVerified(w, md, signers, signerKeys != "")
+}
+
+// readVerified copies the body of md to w and, if verify is set, checks any
+// signature was made by one of signers, returning the signers fingerprint
+func readVerified(w io.Writer, md *openpgp.MessageDetails, signers openpgp.EntityList, verify bool) (string, error) {
+	// The integrity check happens once the body has been read to the end, so
+	// an error here means w has been given tampered data
+	if _, err := io.Copy(w, md.UnverifiedBody); err != nil {
+		return "", cryptoError(err)
+	}
+
+	if verify == false || md.IsSigned == false {
+		return "", nil
+	}
+	if md.SignedBy == nil {
+		return "", &Error{Kind: KindCrypto, Message: fmt.Sprintf("the payload was signed by an unknown key %X", md.SignedByKeyId)}
+	}
+	if md.SignatureError != nil {
+		return "", &Error{Kind: KindCrypto, Message: "the payload signature does not verify, it has been tampered with", Err: md.SignatureError}
+	}
+
+	signer := KeyFingerprint(md.SignedBy.Entity.PrimaryKey)
+	for _, entity := range signers {
+		if KeyFingerprint(entity.PrimaryKey) == signer {
+			return signer, nil
+		}
+	}
+	return "", &Error{Kind: KindCrypto, Message: "the payload was signed by " + signer + " which is not a trusted signer"}
+}
+
+// EncryptPayload encrypts everything read from r with the clients public key
+// and any Recipients, signed with its private key, writing the base64 encoded
+// ciphertext to w
+func (c *Client) EncryptPayload(w io.Writer, r io.Reader) error {
+	publicKeys := strings.Join(append([]string{c.Credentials.PublicKey}, c.Recipients...), "\n")
+	if c.KeyBackend != nil {
+		return c.KeyBackend.EncryptStream(w, r, publicKeys)
+	}
+
+	privateKey, err := c.UnlockPrivateKey()
+	if err != nil {
+		return err
+	}
+	return encryptStream(w, r, publicKeys, privateKey, c.PacketConfig)
+}
+
+// newEncryptedCrypt encrypts data with the clients public key and stores it
+func (c *Client) newEncryptedCrypt(data []byte, description string, checkInDuration, missCount int64) (NewCryptAPIResponse, error) {
+	ciphertext := new(bytes.Buffer)
+	if err := c.EncryptPayload(ciphertext, bytes.NewReader(data)); err != nil {
+		return NewCryptAPIResponse{}, err
+	}
+
+	return c.NewCrypt(ciphertext.String(), description, checkInDuration, missCount, true)
+}
+
+// NewStreamCrypt stores everything read from r. Payloads no bigger than the
+// clients ChunkSize go in a single crypt, larger ones are split across chunk
+// crypts and the crypt returned holds a ChunkManifest listing them. The IDs
+// of any chunk crypts created are returned, even on failure, so they can be
+// kept alive (or cleaned up).
+func (c *Client) NewStreamCrypt(r io.Reader, description string, checkInDuration, missCount int64) (NewCryptAPIResponse, []string, error) {
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = CHUNKSIZE
+	}
+
+	manifest := ChunkManifest{Magic: chunkManifestMagic}
+	hash := sha256.New()
+	buf := make([]byte, chunkSize)
+
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return NewCryptAPIResponse{}, manifest.Chunks, readErr
+		}
+		last := readErr != nil
+
+		// Small enough for a single crypt
+		if last == true && len(manifest.Chunks) == 0 {
+			apiResponse, err := c.newEncryptedCrypt(buf[:n], description, checkInDuration, missCount)
+			return apiResponse, nil, err
+		}
+
+		if n > 0 {
+			hash.Write(buf[:n])
+			manifest.Size += int64(n)
+
+			chunkDescription := strings.TrimSpace(fmt.Sprintf("%s (chunk %d)", description, len(manifest.Chunks)+1))
+			apiResponse, err := c.newEncryptedCrypt(buf[:n], chunkDescription, checkInDuration, missCount)
+			if err != nil {
+				return apiResponse, manifest.Chunks, err
+			}
+			manifest.Chunks = append(manifest.Chunks, apiResponse.CryptPayload.CryptID)
+		}
+
+		if last == true {
+			break
+		}
+	}
+
+	manifest.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	manifestBuffer, err := json.Marshal(manifest)
+	if err != nil {
+		return NewCryptAPIResponse{}, manifest.Chunks, err
+	}
+
+	apiResponse, err := c.newEncryptedCrypt(manifestBuffer, description, checkInDuration, missCount)
+	return apiResponse, manifest.Chunks, err
+}
+
+// parseManifest returns the manifest in plaintext, if it is one
+func parseManifest(plaintext []byte) (ChunkManifest, bool) {
+	var manifest ChunkManifest
+	if bytes.HasPrefix(plaintext, []byte(`{"magic":"`+chunkManifestMagic+`"`)) == false {
+		return manifest, false
+	}
+	if err := json.Unmarshal(plaintext, &manifest); err != nil {
+		return manifest, false
+	}
+	return manifest, true
+}
+
+// chunkError adds which chunk failed to err, keeping its kind
+func chunkError(err error, i, count int, cryptID string) error {
+	return fmt.Errorf("chunk %d of %d (crypt %s): %w", i+1, count, cryptID, err)
+}
+
+// GetStream fetches cryptID and writes its decrypted contents to w,
+// transparently reassembling payloads stored by NewStreamCrypt in chunks. The
+// response for cryptID itself is returned.
+func (c *Client) GetStream(cryptID string, w io.Writer) (NewCryptAPIResponse, Payload, error) {
+	apiResponse, err := c.GetCrypt(cryptID)
+	if err != nil {
+		return apiResponse, Payload{}, err
+	}
+
+	payload, err := c.DecryptPayload(apiResponse.CryptPayload, w)
+	return apiResponse, payload, err
+}
+
+// decryptVerified decrypts one crypts worth of ciphertext, insisting it was
+// signed by the clients own key (retired ones included) or one of its Signers
+// unless AllowUnsigned is set
+func (c *Client) decryptVerified(w io.Writer, cipherText string) (string, error) {
+	signerKeys := []string{c.Credentials.PublicKey}
+	for _, retired := range c.Credentials.RetiredKeys {
+		signerKeys = append(signerKeys, retired.PublicKey)
+	}
+
+	signer, err := c.decryptStream(w, strings.NewReader(cipherText), strings.Join(append(signerKeys, c.Signers...), "\n"))
+	if err == nil && signer == "" && c.AllowUnsigned == false {
+		err = &Error{Kind: KindCrypto, Err: ErrUnsigned}
+	}
+	return signer, err
+}
+
+// ownKey reports whether fingerprint is the clients key, or one it has
+// rotated away from
+func (c *Client) ownKey(fingerprint string) bool {
+	if fingerprint == c.Credentials.Fingerprint {
+		return true
+	}
+	for _, retired := range c.Credentials.RetiredKeys {
+		if fingerprint == retired.Fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// DecryptPayload writes the decrypted contents of an already fetched crypt to
+// w, fetching and reassembling its chunks if it holds a ChunkManifest. Every
+// part must carry a valid signature by the clients key (or one of its
+// Signers) unless AllowUnsigned is set.
+func (c *Client) DecryptPayload(crypt Crypt, w io.Writer) (Payload, error) {
+	var payload Payload
+	var err error
+
+	// A crypt holds at most a chunk, so this is bounded, and nothing reaches
+	// w before its signature has been checked
+	first := new(bytes.Buffer)
+	if payload.Signer, err = c.decryptVerified(first, crypt.CipherText); err != nil {
+		return payload, err
+	}
+
+	manifest, isManifest := parseManifest(first.Bytes())
+	if isManifest == false {
+		_, err = w.Write(first.Bytes())
+		return payload, err
+	}
+	payload.Chunks = manifest.Chunks
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	out := io.MultiWriter(w, hash, counter)
+
+	for i, chunkID := range manifest.Chunks {
+		chunkResponse, err := c.GetCrypt(chunkID)
+		if err != nil {
+			return payload, chunkError(err, i, len(manifest.Chunks), chunkID)
+		}
+
+		signer, err := c.decryptVerified(out, chunkResponse.CryptPayload.CipherText)
+		if err == nil && signer != payload.Signer && (c.ownKey(signer) == false || c.ownKey(payload.Signer) == false) {
+			err = &Error{Kind: KindCrypto, Message: "the chunk was signed by a different key to its manifest"}
+		}
+		if err != nil {
+			return payload, chunkError(err, i, len(manifest.Chunks), chunkID)
+		}
+	}
+
+	if counter.n != manifest.Size || hex.EncodeToString(hash.Sum(nil)) != manifest.SHA256 {
+		return payload, &Error{Kind: KindCrypto, Message: "the reassembled chunks do not match their checksum"}
+	}
+	return payload, nil
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}